@@ -0,0 +1,116 @@
+package addrs
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+)
+
+// Address types of the SOCKS wire format, RFC 1928.
+const (
+	SocksaddrTypeIPv4 byte = 0x01
+	SocksaddrTypeFqdn byte = 0x03
+	SocksaddrTypeIPv6 byte = 0x04
+)
+
+// SocksaddrLen returns the length of addr in the SOCKS wire format.
+func SocksaddrLen(addr Socksaddr) int {
+	switch {
+	case addr.FqdnOnly():
+		return 1 + 1 + len(addr.Fqdn) + 2
+	case addr.Addr.Unmap().Is4():
+		return 1 + 4 + 2
+	default:
+		return 1 + 16 + 2
+	}
+}
+
+// AppendSocksaddr appends addr to b in the SOCKS wire format: the address type,
+// the address and the port in network byte order.
+func AppendSocksaddr(b []byte, addr Socksaddr) ([]byte, error) {
+	switch {
+	case addr.FqdnOnly():
+		if addr.Fqdn == "" || len(addr.Fqdn) > MaxFqdnLength {
+			return b, ErrInvalidSocksaddr
+		}
+		b = append(b, SocksaddrTypeFqdn, byte(len(addr.Fqdn)))
+		b = append(b, addr.Fqdn...)
+	case addr.Addr.Unmap().Is4():
+		ip := addr.Addr.Unmap().As4()
+		b = append(b, SocksaddrTypeIPv4)
+		b = append(b, ip[:]...)
+	default:
+		ip := addr.Addr.As16()
+		b = append(b, SocksaddrTypeIPv6)
+		b = append(b, ip[:]...)
+	}
+	return binary.BigEndian.AppendUint16(b, addr.Port), nil
+}
+
+// WriteSocksaddr writes addr to w in the SOCKS wire format.
+func WriteSocksaddr(w io.Writer, addr Socksaddr) error {
+	b, err := AppendSocksaddr(make([]byte, 0, SocksaddrLen(addr)), addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ParseSocksaddr parses an address in the SOCKS wire format at the start of b,
+// it returns the address and its length.
+func ParseSocksaddr(b []byte) (Socksaddr, int, error) {
+	if len(b) < 1 {
+		return Socksaddr{}, 0, ErrInvalidSocksaddr
+	}
+	var addr Socksaddr
+	n := 1
+	switch b[0] {
+	case SocksaddrTypeIPv4:
+		if len(b) < n+4+2 {
+			return Socksaddr{}, 0, ErrInvalidSocksaddr
+		}
+		addr.Addr = netip.AddrFrom4([4]byte(b[n : n+4]))
+		n += 4
+	case SocksaddrTypeIPv6:
+		if len(b) < n+16+2 {
+			return Socksaddr{}, 0, ErrInvalidSocksaddr
+		}
+		addr.Addr = netip.AddrFrom16([16]byte(b[n : n+16]))
+		n += 16
+	case SocksaddrTypeFqdn:
+		if len(b) < n+1 || b[n] == 0 || len(b) < n+1+int(b[n])+2 {
+			return Socksaddr{}, 0, ErrInvalidSocksaddr
+		}
+		addr.Fqdn = string(b[n+1 : n+1+int(b[n])])
+		n += 1 + int(b[n])
+	default:
+		return Socksaddr{}, 0, ErrInvalidSocksaddr
+	}
+	addr.Port = binary.BigEndian.Uint16(b[n:])
+	return addr, n + 2, nil
+}
+
+// ReadSocksaddr reads an address in the SOCKS wire format from r.
+func ReadSocksaddr(r io.Reader) (Socksaddr, error) {
+	var b [1 + 1 + MaxFqdnLength + 2]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return Socksaddr{}, err
+	}
+	var length int
+	switch b[0] {
+	case SocksaddrTypeIPv4:
+		length = 1 + 4 + 2
+	case SocksaddrTypeIPv6:
+		length = 1 + 16 + 2
+	case SocksaddrTypeFqdn:
+		length = 1 + 1 + int(b[1]) + 2
+	default:
+		return Socksaddr{}, ErrInvalidSocksaddr
+	}
+	if _, err := io.ReadFull(r, b[2:length]); err != nil {
+		return Socksaddr{}, err
+	}
+	addr, _, err := ParseSocksaddr(b[:length])
+	return addr, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qnetwork/resolve"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+func runDial(ctx context.Context, args []string) error {
+	flags := newFlagSet("dial", "host:port")
+	network := flags.String("network", "tcp", "tcp, tcp4, tcp6, udp, udp4 or udp6")
+	fallbackDelay := flags.Duration("fallback-delay", netvars.DefaultDialerFallbackDelay, "delay before racing the fallback family")
+	var strategy meta.Strategy
+	strategyFlag(flags, &strategy)
+	config := dialerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return ex.New("need exactly one address")
+	}
+	parsedNetwork, ok := meta.ParseNetwork(*network)
+	if !ok {
+		return ex.New("invalid network: ", *network)
+	}
+	destination := addrs.FromParseSocksaddr(flags.Arg(0))
+	if !destination.Dialable() {
+		return ex.New("invalid address: ", flags.Arg(0))
+	}
+
+	start := time.Now()
+	addresses := []netip.Addr{destination.Addr}
+	if destination.FqdnOnly() {
+		var err error
+		addresses, err = resolve.SystemClient.Lookup(ctx, destination.Fqdn, strategy)
+		if err != nil {
+			return ex.Cause(err, "lookup "+destination.Fqdn)
+		}
+		fmt.Printf("resolved %s to %v in %s\n", destination.Fqdn, addresses, since(start))
+	}
+
+	trace := &timelineDialer{Dialer: dialer.NewDefaultConfig(*config), start: time.Now(), output: os.Stdout}
+	conn, err := dialer.DialParallel(ctx, trace, parsedNetwork, addresses, destination.Port, dialer.HappyEyeballConf{
+		FallbackDelay: *fallbackDelay,
+		Strategy:      strategy,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Printf("connected to %s from %s in %s\n", conn.RemoteAddr(), conn.LocalAddr(), since(trace.start))
+	if config.TFO && parsedNetwork.IsTCP() {
+		fmt.Println("tfo: the connection is established by the first write")
+	}
+	return nil
+}
+
+// dialerFlags defines the flags of dialer.Config on flags.
+func dialerFlags(flags *flag.FlagSet) *dialer.Config {
+	config := &dialer.Config{
+		Keepalive: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     netvars.DefaultTCPKeepAliveInitial,
+			Interval: netvars.DefaultTCPKeepAliveInterval,
+			Count:    netvars.DefaultTCPKeepAliveProbeCount,
+		},
+	}
+	flags.DurationVar(&config.Timeout, "timeout", netvars.DefaultDialerTimeout, "timeout of each attempt")
+	flags.BoolVar(&config.Keepalive.Enable, "keepalive", true, "enable tcp keepalive")
+	flags.StringVar(&config.Interface, "interface", "", "bind to the interface")
+	flags.Func("bind4", "bind the ipv4 attempts to the address", addrFlag(&config.BindAddress4))
+	flags.Func("bind6", "bind the ipv6 attempts to the address", addrFlag(&config.BindAddress6))
+	flags.Func("fwmark", "set the routing mark", func(s string) error {
+		mark, err := strconv.ParseUint(s, 0, 32)
+		config.FwMark = uint32(mark)
+		return err
+	})
+	flags.BoolVar(&config.ReuseAddr, "reuse-addr", false, "set SO_REUSEADDR")
+	flags.BoolVar(&config.ReusePort, "reuse-port", false, "set SO_REUSEPORT")
+	flags.BoolVar(&config.MPTCP, "mptcp", false, "use multipath tcp")
+	flags.BoolVar(&config.TFO, "tfo", false, "use tcp fast open")
+	flags.BoolVar(&config.UDPFragment, "udp-fragment", false, "allow the fragmentation of udp packets")
+	return config
+}
+
+func addrFlag(addr *netip.Addr) func(string) error {
+	return func(s string) (err error) {
+		*addr, err = netip.ParseAddr(s)
+		return err
+	}
+}
+
+func since(start time.Time) time.Duration {
+	return time.Since(start).Round(time.Microsecond)
+}
+
+// timelineDialer prints when each attempt of a race starts and ends, relative to start.
+type timelineDialer struct {
+	dialer.Dialer
+	start  time.Time
+	access sync.Mutex
+	output io.Writer
+}
+
+func (d *timelineDialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	d.print("dial", address, nil)
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		d.print("fail", address, err)
+		return nil, err
+	}
+	d.print("done", address, nil)
+	return conn, nil
+}
+
+func (d *timelineDialer) print(event string, address addrs.Socksaddr, err error) {
+	d.access.Lock()
+	defer d.access.Unlock()
+	line := fmt.Sprintf("%12s  %-4s  %s", "+"+since(d.start).String(), event, address)
+	if err != nil {
+		line += "  " + err.Error()
+	}
+	fmt.Fprintln(d.output, line)
+}
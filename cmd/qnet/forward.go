@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/forward"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+func runForward(ctx context.Context, args []string) error {
+	flags := newFlagSet("forward", "protocol/listen=target...")
+	maxConns := flags.Int("max-conns", 0, "limit the connections or sessions of each rule, 0 for unlimited")
+	idleTimeout := flags.Duration("idle-timeout", 0, "close the connections or sessions idle for the duration")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return ex.New("no rule, e.g. tcp/127.0.0.1:8080=example.com:80")
+	}
+	rules := make([]forward.Rule, 0, flags.NArg())
+	for _, arg := range flags.Args() {
+		rule, err := parseRule(arg)
+		if err != nil {
+			return err
+		}
+		rule.MaxConns = *maxConns
+		rule.IdleTimeout = *idleTimeout
+		rules = append(rules, rule)
+	}
+
+	forwarder, err := forward.New(forward.Options{Dialer: systemDialer()})
+	if err != nil {
+		return err
+	}
+	defer forwarder.Close()
+	if err = forwarder.Reload(ctx, rules); err != nil {
+		return err
+	}
+	for _, rule := range forwarder.Rules() {
+		fmt.Printf("%s (bound to %s)\n", rule, forwarder.Addr(rule.Protocol, rule.Listen))
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// parseRule parses a rule as protocol/listen=target, e.g. udp/:5353=1.1.1.1:53.
+func parseRule(s string) (forward.Rule, error) {
+	protocol, addresses, found := strings.Cut(s, "/")
+	if !found {
+		return forward.Rule{}, ex.New("invalid rule ", s, ": missing protocol")
+	}
+	listen, target, found := strings.Cut(addresses, "=")
+	if !found {
+		return forward.Rule{}, ex.New("invalid rule ", s, ": missing target")
+	}
+	rule := forward.Rule{
+		Protocol: meta.ParseProtocol(protocol),
+		Listen:   addrs.FromParseSocksaddr(listen),
+		Target:   addrs.FromParseSocksaddr(target),
+	}
+	if !rule.Protocol.IsValid() {
+		return rule, ex.New("invalid rule ", s, ": unknown protocol ", protocol)
+	}
+	if !rule.Target.Dialable() {
+		return rule, ex.New("invalid rule ", s, ": invalid target ", target)
+	}
+	return rule, nil
+}
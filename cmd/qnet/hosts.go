@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/qtraffics/qnetwork/resolve/hosts"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+func runHosts(_ context.Context, args []string) error {
+	flags := newFlagSet("hosts", "name...")
+	path := flags.String("file", "/etc/hosts", "path of the hosts file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return ex.New("no name to query")
+	}
+	file := hosts.NewFile(*path)
+	var missing bool
+	for _, name := range flags.Args() {
+		addresses := file.Lookup(name)
+		if len(addresses) == 0 {
+			missing = true
+			fmt.Printf("%s\tnot found\n", name)
+			continue
+		}
+		fmt.Printf("%s\t%v\n", name, addresses)
+	}
+	if missing {
+		return ex.New("some names not found in ", *path)
+	}
+	return nil
+}
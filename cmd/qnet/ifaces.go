@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/qtraffics/qnetwork/control"
+)
+
+func runIfaces(_ context.Context, args []string) error {
+	flags := newFlagSet("ifaces", "[name...]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	finder := control.NewDefaultInterfaceFinder()
+	if err := finder.Update(); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		for _, iif := range finder.Interfaces() {
+			printInterface(os.Stdout, iif)
+		}
+		return nil
+	}
+	for _, name := range flags.Args() {
+		iif, err := finder.ByName(name)
+		if err != nil {
+			return err
+		}
+		printInterface(os.Stdout, *iif)
+	}
+	return nil
+}
+
+func printInterface(w io.Writer, iif control.Interface) {
+	fmt.Fprintf(w, "%d: %s <%s> mtu %d\n", iif.Index, iif.Name, iif.Flags, iif.MTU)
+	if len(iif.HardwareAddr) > 0 {
+		fmt.Fprintf(w, "    ether %s\n", iif.HardwareAddr)
+	}
+	for _, prefix := range iif.Addresses {
+		family := "inet"
+		if prefix.Addr().Is6() {
+			family = "inet6"
+		}
+		fmt.Fprintf(w, "    %s %s\n", family, prefix)
+	}
+}
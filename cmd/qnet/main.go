@@ -0,0 +1,97 @@
+// Command qnet inspects the network of the host with the library: it resolves names,
+// dials addresses, lists the interfaces, queries the hosts file and relays ports.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/resolve"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"resolve", "resolve names by the system or a dns server", runResolve},
+	{"dial", "dial an address and print the happy eyeballs race", runDial},
+	{"ifaces", "list the network interfaces", runIfaces},
+	{"hosts", "query the hosts file", runHosts},
+	{"forward", "relay local ports to targets", runForward},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: qnet <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `run "qnet <command> -h" for the flags of a command.`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage()
+		return
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := c.run(ctx, os.Args[2:])
+		stop()
+		if err == flag.ErrHelp {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "qnet "+name+":", err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "qnet: unknown command", name)
+	usage()
+	os.Exit(2)
+}
+
+// newFlagSet returns the flag set of a command, it reports the errors to the caller.
+func newFlagSet(name string, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet("qnet "+name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: qnet %s [flags] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// strategyFlag defines a flag of meta.Strategy on flags.
+func strategyFlag(flags *flag.FlagSet, strategy *meta.Strategy) {
+	*strategy = meta.StrategyDefault
+	flags.Func("strategy", "prefer_ipv4, prefer_ipv6, ipv4_only or ipv6_only (default "+strategy.String()+")",
+		func(s string) (err error) {
+			*strategy, err = meta.ParseStrategy(s)
+			return err
+		})
+}
+
+// systemDialer dials the domains by resolve.SystemClient.
+func systemDialer() dialer.Dialer {
+	return resolve.NewResolveDialer(dialer.System, resolve.SystemClient)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/resolve"
+	"github.com/qtraffics/qnetwork/resolve/transport"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := parseRule("udp/:5353=1.1.1.1:53")
+	require.NoError(t, err)
+	assert.Equal(t, meta.ProtocolUDP, rule.Protocol)
+	assert.Equal(t, addrs.FromParseSocksaddr(":5353"), rule.Listen)
+	assert.Equal(t, addrs.FromParseSocksaddr("1.1.1.1:53"), rule.Target)
+
+	rule, err = parseRule("tcp/127.0.0.1:8080=example.com:80")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", rule.Target.Fqdn)
+
+	for _, s := range []string{"127.0.0.1:80=1.1.1.1:53", "tcp/127.0.0.1:80", "sctp/:80=1.1.1.1:80", "tcp/:80=1.1.1.1"} {
+		_, err = parseRule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	port := addrs.FromNetAddr(ln.Addr()).Port
+
+	var output bytes.Buffer
+	trace := &timelineDialer{Dialer: dialer.NewDefault(), start: time.Now(), output: &output}
+	addresses := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}
+	conn, err := dialer.DialParallel(context.Background(), trace, meta.NetworkTCP4, addresses, port, dialer.DefaultHappyEyeballConf)
+	require.NoError(t, err)
+	conn.Close()
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "dial  127.0.0.1:")
+	assert.Contains(t, lines[1], "done  127.0.0.1:")
+}
+
+func TestNewClient(t *testing.T) {
+	// the system client is shared, the command closes a client of its own
+	client, err := newClient("", false, false, false, transport.GroupParallel)
+	require.NoError(t, err)
+	assert.NotSame(t, resolve.SystemClient, client)
+	assert.NotSame(t, resolve.SystemClient.Transport, client.Transport)
+	require.NoError(t, client.Close())
+
+	_, err = newClient("", true, false, false, transport.GroupParallel)
+	assert.Error(t, err)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/resolve"
+	"github.com/qtraffics/qnetwork/resolve/transport"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+func runResolve(ctx context.Context, args []string) error {
+	flags := newFlagSet("resolve", "name...")
+	server := flags.String("server", "", "comma separated dns servers as host[:port] or an url of scheme "+strings.Join(transport.Schemes(), ", ")+", the system resolver if empty")
+	tcp := flags.Bool("tcp", false, "query the server over tcp")
+	overTLS := flags.Bool("tls", false, "query the server over tls (DoT)")
+	overQUIC := flags.Bool("quic", false, "query the server over quic (DoQ)")
+	group := flags.String("group", "parallel", "strategy of multiple servers: parallel, failover, fastest, random or round_robin")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of each name")
+	var strategy meta.Strategy
+	strategyFlag(flags, &strategy)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return ex.New("no name to resolve")
+	}
+
+	groupStrategy, err := transport.ParseGroupStrategy(*group)
+	if err != nil {
+		return err
+	}
+	client, err := newClient(*server, *tcp, *overTLS, *overQUIC, groupStrategy)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var failed bool
+	for _, name := range flags.Args() {
+		lookupCtx, cancel := context.WithTimeout(ctx, *timeout)
+		start := time.Now()
+		addresses, err := client.Lookup(lookupCtx, name, strategy)
+		elapsed := time.Since(start)
+		cancel()
+		if err != nil {
+			failed = true
+			fmt.Printf("%s\terror: %v (%s)\n", name, err, elapsed.Round(time.Microsecond))
+			continue
+		}
+		list := make([]string, 0, len(addresses))
+		for _, address := range addresses {
+			list = append(list, address.String())
+		}
+		fmt.Printf("%s\t%s (%s)\n", name, strings.Join(list, " "), elapsed.Round(time.Microsecond))
+	}
+	if failed {
+		return ex.New("some names failed")
+	}
+	return nil
+}
+
+func newClient(server string, tcp bool, overTLS bool, overQUIC bool, groupStrategy transport.GroupStrategy) (*resolve.TransportClient, error) {
+	if server == "" {
+		if tcp || overTLS || overQUIC {
+			return nil, ex.New("-tcp, -tls and -quic require -server")
+		}
+		// a client of its own, closing resolve.SystemClient would break its other users
+		return &resolve.TransportClient{
+			HeadlessClient: resolve.NewHeadlessClient(resolve.NewCache()),
+			Transport:      transport.NewLocalTransport(nil),
+		}, nil
+	}
+	var transports []transport.Transport
+	for _, upstream := range strings.Split(server, ",") {
+		// the flags set the scheme of a server without one
+		if !strings.Contains(upstream, "://") {
+			switch {
+			case overQUIC:
+				upstream = "quic://" + upstream
+			case overTLS:
+				upstream = "tls://" + upstream
+			case tcp:
+				upstream = "tcp://" + upstream
+			}
+		}
+		trans, err := transport.New(upstream, transport.Options{Dialer: systemDialer()})
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, trans)
+	}
+	trans := transports[0]
+	if len(transports) > 1 {
+		var err error
+		trans, err = transport.NewGroupTransport(transports, transport.GroupTransportOptions{Strategy: groupStrategy})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &resolve.TransportClient{
+		HeadlessClient: resolve.NewHeadlessClient(resolve.NewCache()),
+		Transport:      trans,
+	}, nil
+}
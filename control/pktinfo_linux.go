@@ -0,0 +1,38 @@
+package control
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/qtraffics/qnetwork/meta"
+
+	"golang.org/x/sys/unix"
+)
+
+// PacketInfo asks the kernel to report the destination address and the interface index
+// of each received datagram by IP_PKTINFO and IPV6_RECVPKTINFO control messages.
+func PacketInfo() Func {
+	return func(network, address string, conn syscall.RawConn) error {
+		var mn meta.Network
+		var ok bool
+		if mn, ok = meta.ParseNetwork(network); !ok || mn.Protocol != meta.ProtocolUDP {
+			return nil
+		}
+		return Raw(conn, func(fd uintptr) error {
+			if mn.Version == meta.NetworkVersion4 {
+				err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+				if err != nil {
+					return os.NewSyscallError("SETSOCKOPT IP_PKTINFO", err)
+				}
+				return nil
+			}
+			err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1)
+			if err != nil {
+				return os.NewSyscallError("SETSOCKOPT IPV6_RECVPKTINFO", err)
+			}
+			// ipv4 packets received by a dual stack socket, fails on IPV6_V6ONLY sockets.
+			_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+			return nil
+		})
+	}
+}
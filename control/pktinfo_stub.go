@@ -0,0 +1,7 @@
+//go:build !linux
+
+package control
+
+func PacketInfo() Func {
+	return nil
+}
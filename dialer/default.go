@@ -42,12 +42,12 @@ func (d *DefaultDialer) DialContext(ctx context.Context, network meta.Network, a
 	if !address.Dialable() {
 		return nil, addrs.ErrNotDialable
 	}
-	if !address.FqdnOnly() {
+	if address.FqdnOnly() {
 		return nil, addrs.ErrAddressNotResolved
 	}
 	address = address.Unwrap()
-	if address.Addr.Is4() && network.Version == meta.NetworkVersion4 ||
-		address.Addr.Is6() && network.Version == meta.NetworkVersion6 {
+	if address.Addr.Is4() && network.Version == meta.NetworkVersion6 ||
+		address.Addr.Is6() && network.Version == meta.NetworkVersion4 {
 		return nil, ex.New("no address to dialer")
 	}
 
@@ -0,0 +1,34 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultDialContext(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer packetConn.Close()
+	server := addrs.FromNetAddr(packetConn.LocalAddr())
+
+	ctx := context.Background()
+	for _, network := range []meta.Network{meta.NetworkUDP, meta.NetworkUDP4} {
+		conn, err := System.DialContext(ctx, network, server)
+		if assert.NoError(t, err, network.String()) {
+			assert.Equal(t, server.UDPAddr().String(), conn.RemoteAddr().String())
+			conn.Close()
+		}
+	}
+
+	_, err = System.DialContext(ctx, meta.NetworkUDP6, server)
+	assert.Error(t, err, "ipv4 address on an ipv6 network")
+	_, err = System.DialContext(ctx, meta.NetworkTCP, addrs.FromParseSocksaddr("localhost:80"))
+	assert.ErrorIs(t, err, addrs.ErrAddressNotResolved)
+}
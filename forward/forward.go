@@ -0,0 +1,250 @@
+// Package forward relays the connections and the datagrams received on local addresses
+// to fixed targets, by a set of rules which can be changed while running.
+package forward
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/listener"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+var (
+	ErrRuleExists   = ex.New("forward: rule exists")
+	ErrRuleNotFound = ex.New("forward: rule not found")
+)
+
+// Rule forwards what is received on Listen to Target. A rule is identified by its
+// protocol and its listen address.
+type Rule struct {
+	Protocol meta.Protocol
+	// Listen is the address to listen on, a domain is resolved by the listener package.
+	Listen addrs.Socksaddr
+	// Target is the address to forward to, a domain is passed to the dialer as is and is only
+	// allowed for TCP.
+	Target addrs.Socksaddr
+
+	// optional
+
+	// Dialer reaches the target. Default to the dialer of the Forwarder.
+	Dialer dialer.Dialer
+	// MaxConns limits the TCP connections or the UDP sessions at once, zero means unlimited.
+	MaxConns int
+	// IdleTimeout closes the connections or the sessions idle for the duration. Zero means
+	// no timeout for TCP, and netvars.DefaultUDPKeepAlive for UDP.
+	IdleTimeout time.Duration
+}
+
+func (r Rule) String() string {
+	return r.Protocol.String() + " " + r.Listen.String() + " -> " + r.Target.String()
+}
+
+type ruleKey struct {
+	protocol meta.Protocol
+	listen   addrs.Socksaddr
+}
+
+func (r Rule) key() ruleKey {
+	return ruleKey{protocol: r.Protocol, listen: r.Listen}
+}
+
+type Options struct {
+	// Dialer is the dialer of the rules without one, required.
+	Dialer dialer.Dialer
+	// Listen configures the sockets of the rules.
+	Listen listener.Options
+}
+
+// forwarder runs a rule.
+type forwarder interface {
+	Rule() Rule
+	Addr() net.Addr
+	// update replaces the rule of a running forwarder, the listen address is unchanged.
+	update(rule Rule)
+	close()
+}
+
+// Forwarder runs a set of rules. Changing the rules leaves the connections and the
+// sessions of the rules not changed alone.
+type Forwarder struct {
+	options Options
+
+	access     sync.Mutex
+	forwarders map[ruleKey]forwarder
+	closed     bool
+}
+
+func New(options Options) (*Forwarder, error) {
+	if options.Dialer == nil {
+		return nil, ex.New("dialer required")
+	}
+	return &Forwarder{
+		options:    options,
+		forwarders: make(map[ruleKey]forwarder),
+	}, nil
+}
+
+func (f *Forwarder) prepare(rule Rule) (Rule, error) {
+	if !rule.Protocol.IsValid() {
+		return rule, ex.New("forward: unknown protocol ", rule.Protocol)
+	}
+	if !rule.Target.Dialable() {
+		return rule, ex.New("forward: invalid target ", rule.Target)
+	}
+	if rule.Protocol == meta.ProtocolUDP && rule.Target.FqdnOnly() {
+		// the datagrams are written to the target as is, which requires an address
+		return rule, ex.New("forward: udp target must be an address ", rule.Target)
+	}
+	if rule.Dialer == nil {
+		rule.Dialer = f.options.Dialer
+	}
+	return rule, nil
+}
+
+func (f *Forwarder) start(ctx context.Context, rule Rule) (forwarder, error) {
+	if rule.Protocol == meta.ProtocolTCP {
+		return startTCP(ctx, rule, f.options.Listen)
+	}
+	return startUDP(ctx, rule, f.options.Listen)
+}
+
+// Add starts a rule, which must not exist.
+func (f *Forwarder) Add(ctx context.Context, rule Rule) error {
+	rule, err := f.prepare(rule)
+	if err != nil {
+		return err
+	}
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.closed {
+		return net.ErrClosed
+	}
+	if f.forwarders[rule.key()] != nil {
+		return ErrRuleExists
+	}
+	forwarder, err := f.start(ctx, rule)
+	if err != nil {
+		return ex.Cause(err, "forward: start "+rule.String())
+	}
+	f.forwarders[rule.key()] = forwarder
+	return nil
+}
+
+// Remove stops the rule of protocol and listen, with its connections and sessions.
+func (f *Forwarder) Remove(protocol meta.Protocol, listen addrs.Socksaddr) error {
+	f.access.Lock()
+	defer f.access.Unlock()
+	key := ruleKey{protocol: protocol, listen: listen}
+	forwarder := f.forwarders[key]
+	if forwarder == nil {
+		return ErrRuleNotFound
+	}
+	delete(f.forwarders, key)
+	forwarder.close()
+	return nil
+}
+
+// Reload replaces the rules by rules. The rules not listed are stopped, the new ones are
+// started, and the others are updated in place: their connections keep going to the
+// previous target, while their UDP sessions are closed when the target changed. The other
+// changes apply to the connections and the sessions started after.
+//
+// The rules failing to start are reported together, the others are applied anyway.
+func (f *Forwarder) Reload(ctx context.Context, rules []Rule) error {
+	var errs []error
+	wanted := make(map[ruleKey]Rule, len(rules))
+	for _, rule := range rules {
+		rule, err := f.prepare(rule)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		wanted[rule.key()] = rule
+	}
+
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.closed {
+		return net.ErrClosed
+	}
+	for key, forwarder := range f.forwarders {
+		if _, loaded := wanted[key]; !loaded {
+			delete(f.forwarders, key)
+			forwarder.close()
+		}
+	}
+	for key, rule := range wanted {
+		if forwarder := f.forwarders[key]; forwarder != nil {
+			forwarder.update(rule)
+			continue
+		}
+		forwarder, err := f.start(ctx, rule)
+		if err != nil {
+			errs = append(errs, ex.Cause(err, "forward: start "+rule.String()))
+			continue
+		}
+		f.forwarders[key] = forwarder
+	}
+	return errors.Join(errs...)
+}
+
+// Rules returns the running rules, sorted by protocol and listen address.
+func (f *Forwarder) Rules() []Rule {
+	f.access.Lock()
+	defer f.access.Unlock()
+	rules := make([]Rule, 0, len(f.forwarders))
+	for _, forwarder := range f.forwarders {
+		rules = append(rules, forwarder.Rule())
+	}
+	slices.SortFunc(rules, func(a Rule, b Rule) int {
+		return cmp.Or(cmp.Compare(a.Protocol, b.Protocol), cmp.Compare(a.Listen.String(), b.Listen.String()))
+	})
+	return rules
+}
+
+// Addr returns the address the rule of protocol and listen is bound to, or nil if it
+// does not exist.
+func (f *Forwarder) Addr(protocol meta.Protocol, listen addrs.Socksaddr) net.Addr {
+	f.access.Lock()
+	defer f.access.Unlock()
+	forwarder := f.forwarders[ruleKey{protocol: protocol, listen: listen}]
+	if forwarder == nil {
+		return nil
+	}
+	return forwarder.Addr()
+}
+
+// Close stops all rules.
+func (f *Forwarder) Close() error {
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.closed = true
+	for key, forwarder := range f.forwarders {
+		delete(f.forwarders, key)
+		forwarder.close()
+	}
+	return nil
+}
+
+// backoff waits before retrying a failed accept or read, doubling delay from 5ms up to 1s
+// like net/http.Server. It returns false if ctx is done meanwhile.
+func backoff(ctx context.Context, delay *time.Duration) bool {
+	*delay = min(max(*delay*2, 5*time.Millisecond), time.Second)
+	timer := time.NewTimer(*delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,266 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var listen = addrs.FromParseSocksaddr("127.0.0.1:0")
+
+// netDialer dials with the standard library, the tests only dial addresses.
+type netDialer struct{}
+
+func (netDialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network.String(), address.String())
+}
+
+func (netDialer) ListenPacket(ctx context.Context, _ addrs.Socksaddr) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp", "127.0.0.1:0")
+}
+
+func newForwarder(t *testing.T) *Forwarder {
+	f, err := New(Options{Dialer: netDialer{}})
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// echoTCP replies to each read with tag and the data read.
+func echoTCP(t *testing.T, tag string) addrs.Socksaddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 1500)
+				for {
+					n, err := conn.Read(b)
+					if err != nil {
+						return
+					}
+					if _, err = conn.Write(append([]byte(tag), b[:n]...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return addrs.FromNetAddr(ln.Addr())
+}
+
+func echoUDP(t *testing.T) addrs.Socksaddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(b[:n], addr)
+		}
+	}()
+	return addrs.FromNetAddr(conn.LocalAddr())
+}
+
+func exchange(t *testing.T, conn net.Conn, message string) string {
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	_, err := conn.Write([]byte(message))
+	require.NoError(t, err)
+	b := make([]byte, 1500)
+	n, err := conn.Read(b)
+	require.NoError(t, err)
+	return string(b[:n])
+}
+
+func TestTCP(t *testing.T) {
+	f := newForwarder(t)
+	ctx := context.Background()
+	rule := Rule{Protocol: meta.ProtocolTCP, Listen: listen, Target: echoTCP(t, "a:"), MaxConns: 1, IdleTimeout: 100 * time.Millisecond}
+	require.NoError(t, f.Add(ctx, rule))
+	assert.ErrorIs(t, f.Add(ctx, rule), ErrRuleExists)
+	addr := f.Addr(meta.ProtocolTCP, listen).String()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a:ping", exchange(t, conn, "ping"))
+
+	// beyond the limit
+	second, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+	require.NoError(t, second.SetDeadline(time.Now().Add(time.Second)))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// closed once idle
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, f.Remove(meta.ProtocolTCP, listen))
+	assert.ErrorIs(t, f.Remove(meta.ProtocolTCP, listen), ErrRuleNotFound)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+func TestUDP(t *testing.T) {
+	f := newForwarder(t)
+	require.NoError(t, f.Add(context.Background(), Rule{Protocol: meta.ProtocolUDP, Listen: listen, Target: echoUDP(t), MaxConns: 1}))
+	addr := f.Addr(meta.ProtocolUDP, listen).String()
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, message := range []string{"first", "second"} {
+		assert.Equal(t, message, exchange(t, conn, message))
+	}
+
+	// beyond the limit
+	second, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+	_, err = second.Write([]byte("dropped"))
+	require.NoError(t, err)
+	require.NoError(t, second.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = second.Read(make([]byte, 1500))
+	assert.Error(t, err)
+
+	// the datagrams can not be sent to a domain
+	domain := Rule{Protocol: meta.ProtocolUDP, Listen: addrs.FromParseSocksaddr("127.0.0.1:0"), Target: addrs.FromParseSocksaddr("example.com:53")}
+	assert.Error(t, f.Add(context.Background(), domain))
+	assert.Error(t, f.Reload(context.Background(), []Rule{domain}))
+	assert.Empty(t, f.Rules())
+}
+
+func TestUDPIdle(t *testing.T) {
+	// the target answers each datagram with a stream of replies, from the same address
+	// as long as the session is kept
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer server.Close()
+	sources := make(chan net.Addr, 2)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			_, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			sources <- addr
+			for range 10 {
+				_, _ = server.WriteTo([]byte("reply"), addr)
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}()
+
+	f := newForwarder(t)
+	require.NoError(t, f.Add(context.Background(), Rule{Protocol: meta.ProtocolUDP, Listen: listen, Target: addrs.FromNetAddr(server.LocalAddr()), IdleTimeout: 80 * time.Millisecond}))
+	conn, err := net.Dial("udp", f.Addr(meta.ProtocolUDP, listen).String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the replies keep the session alive beyond the idle timeout
+	b := make([]byte, 1500)
+	for _, message := range []string{"first", "second"} {
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+		for range 10 {
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := conn.Read(b)
+			require.NoError(t, err)
+			assert.Equal(t, "reply", string(b[:n]))
+		}
+	}
+	assert.Equal(t, <-sources, <-sources)
+}
+
+func TestReload(t *testing.T) {
+	f := newForwarder(t)
+	ctx := context.Background()
+	udpListen := addrs.FromParseSocksaddr("127.0.0.1:0")
+	require.NoError(t, f.Reload(ctx, []Rule{{Protocol: meta.ProtocolTCP, Listen: listen, Target: echoTCP(t, "a:")}}))
+	addr := f.Addr(meta.ProtocolTCP, listen).String()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a:1", exchange(t, conn, "1"))
+
+	target := echoTCP(t, "b:")
+	require.NoError(t, f.Reload(ctx, []Rule{
+		{Protocol: meta.ProtocolTCP, Listen: listen, Target: target},
+		{Protocol: meta.ProtocolUDP, Listen: udpListen, Target: echoUDP(t)},
+	}))
+	assert.Len(t, f.Rules(), 2)
+	assert.Equal(t, target, f.Rules()[0].Target)
+	// the listener and the conn are kept, new conns go to the new target
+	assert.Equal(t, addr, f.Addr(meta.ProtocolTCP, listen).String())
+	assert.Equal(t, "a:2", exchange(t, conn, "2"))
+	updated, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer updated.Close()
+	assert.Equal(t, "b:3", exchange(t, updated, "3"))
+
+	err = f.Reload(ctx, []Rule{
+		{Protocol: meta.ProtocolUDP, Listen: udpListen, Target: echoUDP(t)},
+		{Protocol: meta.ProtocolTCP, Listen: listen},
+	})
+	assert.Error(t, err)
+	assert.Nil(t, f.Addr(meta.ProtocolTCP, listen))
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+// flakyListener fails the first accepts, like a process out of file descriptors.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	flaky := &flakyListener{Listener: ln}
+	flaky.failures.Store(3)
+	forwarder := &tcpForwarder{listener: flaky}
+	forwarder.rule.Store(&Rule{Protocol: meta.ProtocolTCP, Target: echoTCP(t, "a:"), Dialer: netDialer{}})
+	forwarder.ctx, forwarder.cancel = context.WithCancel(context.Background())
+	go forwarder.serve()
+	defer forwarder.close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a:ping", exchange(t, conn, "ping"))
+}
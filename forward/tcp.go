@@ -0,0 +1,140 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/qtraffics/qnetwork/listener"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio"
+)
+
+type tcpForwarder struct {
+	rule     atomic.Pointer[Rule]
+	listener net.Listener
+	conns    atomic.Int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func startTCP(ctx context.Context, rule Rule, options listener.Options) (*tcpForwarder, error) {
+	ln, err := listener.ListenTCP(ctx, rule.Listen.AddrString(), rule.Listen.Port, options)
+	if err != nil {
+		return nil, err
+	}
+	t := &tcpForwarder{listener: ln}
+	t.rule.Store(&rule)
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	go t.serve()
+	return t, nil
+}
+
+func (t *tcpForwarder) Rule() Rule {
+	return *t.rule.Load()
+}
+
+func (t *tcpForwarder) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+func (t *tcpForwarder) update(rule Rule) {
+	t.rule.Store(&rule)
+}
+
+func (t *tcpForwarder) close() {
+	t.cancel()
+	t.listener.Close()
+}
+
+func (t *tcpForwarder) serve() {
+	var delay time.Duration
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			// e.g. too many open files, which goes away once some conns are closed
+			if errors.Is(err, net.ErrClosed) || !backoff(t.ctx, &delay) {
+				return
+			}
+			continue
+		}
+		delay = 0
+		rule := t.rule.Load()
+		if rule.MaxConns > 0 && t.conns.Load() >= int64(rule.MaxConns) {
+			conn.Close()
+			continue
+		}
+		t.conns.Add(1)
+		go func() {
+			defer t.conns.Add(-1)
+			t.relay(conn, rule)
+		}()
+	}
+}
+
+func (t *tcpForwarder) relay(conn net.Conn, rule *Rule) {
+	remote, err := rule.Dialer.DialContext(t.ctx, meta.NetworkTCP, rule.Target)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	ctx := t.ctx
+	if rule.IdleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		activity := new(atomic.Int64)
+		activity.Store(time.Now().UnixNano())
+		conn = &idleConn{Conn: conn, activity: activity}
+		remote = &idleConn{Conn: remote, activity: activity}
+		go watchIdle(ctx, cancel, activity, rule.IdleTimeout)
+	}
+	_ = netio.CopyConn(ctx, conn, remote)
+}
+
+// idleConn records the last activity of a relay. Like netio.RateLimitedConn it does not
+// expose syscall.Conn, so that the copies can not bypass it by splice.
+type idleConn struct {
+	net.Conn
+	activity *atomic.Int64
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.activity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.activity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) UnderlayConn() net.Conn {
+	return c.Conn
+}
+
+// watchIdle cancels the relay once no byte passed for timeout.
+func watchIdle(ctx context.Context, cancel context.CancelFunc, activity *atomic.Int64, timeout time.Duration) {
+	ticker := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, activity.Load())) >= timeout {
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/listener"
+	"github.com/qtraffics/qnetwork/netio"
+	"github.com/qtraffics/qnetwork/netio/udpnat"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/buf"
+	"github.com/qtraffics/qtfra/values"
+)
+
+var allPrefixes = []netip.Prefix{
+	netip.PrefixFrom(netip.IPv4Unspecified(), 0),
+	netip.PrefixFrom(netip.IPv6Unspecified(), 0),
+}
+
+type udpForwarder struct {
+	rule atomic.Pointer[Rule]
+	conn *net.UDPConn
+	nat  *udpnat.UdpNat
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func startUDP(ctx context.Context, rule Rule, options listener.Options) (*udpForwarder, error) {
+	conn, err := listener.ListenUDP(ctx, rule.Listen.AddrString(), rule.Listen.Port, options)
+	if err != nil {
+		return nil, err
+	}
+	u := &udpForwarder{conn: conn}
+	u.rule.Store(&rule)
+	// the sessions expire by the idle timeout of their relay, which counts the packets of
+	// both directions and follows the rule, the nat only replaces the closed sessions
+	u.nat, err = udpnat.New(u.prepare, &udpnat.Option{Timeout: math.MaxInt64})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+	go u.serve()
+	return u, nil
+}
+
+func (u *udpForwarder) Rule() Rule {
+	return *u.rule.Load()
+}
+
+func (u *udpForwarder) Addr() net.Addr {
+	return u.conn.LocalAddr()
+}
+
+func (u *udpForwarder) update(rule Rule) {
+	previous := u.rule.Swap(&rule)
+	if previous.Target != rule.Target {
+		for _, prefix := range allPrefixes {
+			u.nat.ClosePrefix(prefix)
+		}
+	}
+}
+
+func (u *udpForwarder) close() {
+	u.cancel()
+	u.conn.Close()
+	u.nat.Close()
+}
+
+func (u *udpForwarder) prepare(source addrs.Socksaddr, _ addrs.Socksaddr, _ netio.UDPPacket) udpnat.PrepareResult {
+	rule := u.rule.Load()
+	if rule.MaxConns > 0 && u.nat.Stats().Active >= uint64(rule.MaxConns) {
+		return udpnat.PrepareResult{}
+	}
+	return udpnat.PrepareResult{
+		Success:      true,
+		PacketWriter: &netio.BindPacketWriter{PacketWriter: u.conn, Destination: source.UDPAddr()},
+	}
+}
+
+func (u *udpForwarder) serve() {
+	var delay time.Duration
+	for {
+		buffer := buf.NewSize(netvars.DefaultUDPReadBufferSize)
+		n, addr, err := u.conn.ReadFromUDPAddrPort(buffer.FreeBytes())
+		if err != nil {
+			buffer.Free()
+			if errors.Is(err, net.ErrClosed) || !backoff(u.ctx, &delay) {
+				return
+			}
+			continue
+		}
+		delay = 0
+		buffer.Truncated(n)
+		rule := u.rule.Load()
+		session, isNew := u.nat.NewPacket(buffer, addrs.FromAddrPort(addr), rule.Target)
+		if session == nil {
+			buffer.Free()
+		} else if isNew {
+			go u.relay(session, rule)
+		}
+	}
+}
+
+func (u *udpForwarder) relay(session udpnat.Conn, rule *Rule) {
+	outbound, err := rule.Dialer.ListenPacket(u.ctx, rule.Target)
+	if err != nil {
+		session.Close()
+		return
+	}
+	_ = netio.CopyPacketConn(u.ctx, session, outbound, &netio.PacketCopyOptions{
+		IdleTimeout: values.UseDefault(rule.IdleTimeout, netvars.DefaultUDPKeepAlive),
+	})
+}
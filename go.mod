@@ -8,7 +8,9 @@ require (
 	github.com/metacubex/tfo-go v0.0.0-20251024101424-368b42b59148
 	github.com/miekg/dns v1.1.68
 	github.com/qtraffics/qtfra v0.0.9
+	github.com/quic-go/quic-go v0.59.1
 	github.com/stretchr/testify v1.11.1
+	golang.org/x/net v0.43.0
 	golang.org/x/sys v0.37.0
 )
 
@@ -16,9 +18,9 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/logrusorgru/aurora v2.0.3+incompatible // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/mod v0.25.0 // indirect
-	golang.org/x/net v0.42.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/mod v0.27.0 // indirect
 	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/tools v0.34.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,204 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// netDialer dials with the standard library, the tests only dial addresses.
+type netDialer struct{}
+
+func (netDialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network.String(), address.String())
+}
+
+func (netDialer) ListenPacket(ctx context.Context, _ addrs.Socksaddr) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp", "127.0.0.1:0")
+}
+
+func startServer(t *testing.T, options Options) *url.URL {
+	options.Dialer = netDialer{}
+	server, err := NewServer(options)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+func newClient(proxy *url.URL, transport *http.Transport) *http.Client {
+	if transport == nil {
+		transport = &http.Transport{}
+	}
+	transport.Proxy = http.ProxyURL(proxy)
+	return &http.Client{Transport: transport}
+}
+
+func TestForward(t *testing.T) {
+	var upstreamConns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		assert.Empty(t, r.Header.Get("X-Hop"))
+		assert.Equal(t, "kept", r.Header.Get("X-End"))
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "removed")
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			upstreamConns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	proxy := startServer(t, Options{Authenticate: func(username string, password string) bool {
+		return username == "user" && password == "secret"
+	}})
+	proxy.User = url.UserPassword("user", "secret")
+	client := newClient(proxy, nil)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut} {
+		request, err := http.NewRequest(method, upstream.URL+"/path", nil)
+		require.NoError(t, err)
+		request.Header.Set("Connection", "X-Hop")
+		request.Header.Set("X-Hop", "removed")
+		request.Header.Set("X-End", "kept")
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, method+" /path ", string(body))
+		assert.Empty(t, response.Header.Get("X-Upstream-Hop"))
+	}
+	// the upstream conn is kept alive
+	assert.Equal(t, int32(1), upstreamConns.Load())
+
+	proxy.User = url.UserPassword("user", "wrong")
+	response, err := newClient(proxy, nil).Get(upstream.URL)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, response.StatusCode)
+	assert.Equal(t, `Basic realm="qnetwork"`, response.Header.Get("Proxy-Authenticate"))
+}
+
+func TestForwardUnreadBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			// answer without reading the body, which net/http only does when closing the conn
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+	proxy := startServer(t, Options{})
+	host := upstream.Listener.Addr().String()
+	// the body looks like a request, which must not be forwarded
+	smuggled := "GET http://" + host + "/smuggled HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+	post := "POST http://" + host + "/upload HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: " + strconv.Itoa(len(smuggled)) + "\r\n\r\n"
+	get := "GET http://" + host + "/next HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+
+	// the body is fully sent, it is drained
+	conn, err := net.Dial("tcp", proxy.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, post+smuggled+get)
+	require.NoError(t, err)
+	for _, expected := range []string{"", "/next"} {
+		response, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(body))
+	}
+
+	// the body is sent after the response, while the upstream still waits for it
+	conn, err = net.Dial("tcp", proxy.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	_, err = io.WriteString(conn, post)
+	require.NoError(t, err)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	_, _ = io.WriteString(conn, smuggled+get)
+	// the conn can not be reused, it is closed
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = http.ReadResponse(reader, nil)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestConnect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled")
+	}))
+	defer upstream.Close()
+
+	proxy := startServer(t, Options{})
+	client := newClient(proxy, upstream.Client().Transport.(*http.Transport).Clone())
+	for range 2 {
+		response, err := client.Get(upstream.URL)
+		require.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "tunneled", string(body))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := ln.Addr().String()
+	ln.Close()
+	conn, err := net.Dial("tcp", proxy.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+closed+" HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+	require.NoError(t, err)
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":          {"close, X-Custom"},
+		"X-Custom":            {"1"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic dXNlcjpzZWNyZXQ="},
+		"Content-Type":        {"text/plain"},
+	}
+	username, password, ok := basicAuth(header)
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "secret", password)
+	removeHopHeaders(header)
+	assert.Equal(t, http.Header{"Content-Type": {"text/plain"}}, header)
+}
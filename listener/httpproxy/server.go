@@ -0,0 +1,331 @@
+// Package httpproxy implements an HTTP/1.1 proxy server, tunneling CONNECT requests
+// and forwarding the requests for absolute URIs.
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/listener"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/buf"
+	"github.com/qtraffics/qtfra/ex"
+	"github.com/qtraffics/qtfra/values"
+)
+
+type Options struct {
+	// Dialer carries the tunnels and the connections to the upstreams, required.
+	Dialer dialer.Dialer
+
+	// optional
+
+	// Authenticate verifies the Basic credentials of the clients, nil accepts every client.
+	Authenticate func(username string, password string) bool
+	// Realm is the realm of the Basic challenge. Default to "qnetwork".
+	Realm string
+
+	// HandshakeTimeout bounds the reading of a request header, and the wait for the next
+	// request of a client. Default to netvars.DefaultProxyHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes the upstream connections kept alive once idle for the duration.
+	// Default to netvars.DefaultProxyIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxIdleConnsPerHost limits the upstream connections kept alive for a host.
+	// Default to netvars.DefaultProxyMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+}
+
+type Server struct {
+	options   Options
+	transport *http.Transport
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	access    sync.Mutex
+	listeners map[net.Listener]struct{}
+}
+
+func NewServer(options Options) (*Server, error) {
+	if options.Dialer == nil {
+		return nil, ex.New("dialer required")
+	}
+	options.Realm = values.UseDefault(options.Realm, "qnetwork")
+	options.HandshakeTimeout = values.UseDefault(options.HandshakeTimeout, netvars.DefaultProxyHandshakeTimeout)
+	options.IdleTimeout = values.UseDefault(options.IdleTimeout, netvars.DefaultProxyIdleTimeout)
+	options.MaxIdleConnsPerHost = values.UseDefault(options.MaxIdleConnsPerHost, netvars.DefaultProxyMaxIdleConnsPerHost)
+
+	s := &Server{
+		options:   options,
+		listeners: make(map[net.Listener]struct{}),
+	}
+	s.transport = &http.Transport{
+		DialContext: func(ctx context.Context, _ string, address string) (net.Conn, error) {
+			return options.Dialer.DialContext(ctx, meta.NetworkTCP, addrs.FromParseSocksaddr(address))
+		},
+		MaxIdleConnsPerHost: options.MaxIdleConnsPerHost,
+		IdleConnTimeout:     options.IdleTimeout,
+		DisableCompression:  true,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// ListenAndServe listens on address and port with the listener package and serves the
+// accepted conns, see Serve.
+func (s *Server) ListenAndServe(ctx context.Context, address string, port uint16, options listener.Options) error {
+	ln, err := listener.ListenTCP(ctx, address, port, options)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves the conns accepted from ln until it fails or the server is closed.
+// ln is closed on return.
+func (s *Server) Serve(ln net.Listener) error {
+	s.access.Lock()
+	if s.ctx.Err() != nil {
+		s.access.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.access.Unlock()
+	defer func() {
+		s.access.Lock()
+		delete(s.listeners, ln)
+		s.access.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return net.ErrClosed
+			}
+			return err
+		}
+		go s.ServeConn(s.ctx, conn)
+	}
+}
+
+// ServeConn serves the requests of a client on conn until it closes, a tunnel is done
+// or ctx is done, then closes conn.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(s.options.HandshakeTimeout))
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+
+		if !s.authorize(request) {
+			header := http.Header{"Proxy-Authenticate": {`Basic realm="` + s.options.Realm + `"`}}
+			_ = request.Body.Close()
+			if err = writeResponse(conn, request, http.StatusProxyAuthRequired, header); err != nil || request.Close {
+				return err
+			}
+			continue
+		}
+		if request.Method == http.MethodConnect {
+			return s.connect(ctx, conn, reader, request)
+		}
+		keepAlive, err := s.forward(ctx, conn, request)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+// Close stops the listeners, the clients and the upstream connections kept alive.
+func (s *Server) Close() error {
+	s.access.Lock()
+	s.cancel()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.access.Unlock()
+	s.transport.CloseIdleConnections()
+	return nil
+}
+
+func (s *Server) authorize(request *http.Request) bool {
+	if s.options.Authenticate == nil {
+		return true
+	}
+	username, password, ok := basicAuth(request.Header)
+	return ok && s.options.Authenticate(username, password)
+}
+
+func (s *Server) connect(ctx context.Context, conn net.Conn, reader *bufio.Reader, request *http.Request) error {
+	destination := addrs.FromParseSocksaddr(request.Host)
+	if !destination.Dialable() {
+		_ = writeResponse(conn, request, http.StatusBadRequest, nil)
+		return ex.New("httpproxy: bad CONNECT target ", request.Host)
+	}
+	remote, err := s.options.Dialer.DialContext(ctx, meta.NetworkTCP, destination)
+	if err != nil {
+		_ = writeResponse(conn, request, statusCode(err), nil)
+		return ex.Cause(err, "httpproxy: dial "+destination.String())
+	}
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		remote.Close()
+		return err
+	}
+
+	// the client may send its first bytes along with the request
+	var clientConn net.Conn = conn
+	if n := reader.Buffered(); n > 0 {
+		peeked, _ := reader.Peek(n)
+		clientConn = netio.NewPrefixConn(conn, buf.As(bytes.Clone(peeked)))
+	}
+	return netio.CopyConn(ctx, clientConn, remote)
+}
+
+// forward sends a request for an absolute URI to its upstream and writes back the response,
+// it reports whether the conn of the client can be kept alive.
+func (s *Server) forward(ctx context.Context, conn net.Conn, request *http.Request) (bool, error) {
+	if !request.URL.IsAbs() || request.URL.Host == "" || request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+		_ = writeResponse(conn, request, http.StatusBadRequest, nil)
+		return false, ex.New("httpproxy: not an absolute URI: ", request.RequestURI)
+	}
+	keepAlive := !request.Close
+	// the body of a client waiting for 100 Continue may never come
+	expectContinue := strings.EqualFold(request.Header.Get("Expect"), "100-continue")
+	var body *requestBody
+	if request.Body != nil && request.Body != http.NoBody {
+		body = &requestBody{body: request.Body}
+		request.Body = body
+	}
+
+	request = request.WithContext(ctx)
+	request.RequestURI = ""
+	request.Close = false
+	removeHopHeaders(request.Header)
+	response, err := s.transport.RoundTrip(request)
+	if err != nil {
+		_ = writeResponse(conn, request, statusCode(err), nil)
+		return false, ex.Cause(err, "httpproxy: round trip")
+	}
+	defer response.Body.Close()
+
+	removeHopHeaders(response.Header)
+	response.Proto, response.ProtoMajor, response.ProtoMinor = "HTTP/1.1", 1, 1
+	// a body of unknown length ends with the conn
+	if response.ContentLength < 0 && !slices.Contains(response.TransferEncoding, "chunked") {
+		keepAlive = false
+	}
+	response.Close = !keepAlive
+	if err = response.Write(conn); err != nil {
+		return false, err
+	}
+	// the upstream may answer before reading the whole body, whose rest would be read as
+	// the next request
+	if body != nil && !body.finish(!expectContinue) {
+		keepAlive = false
+	}
+	return keepAlive, nil
+}
+
+// maxDrainSize is the size of the rest of a request body read to keep the conn of the
+// client alive, as net/http.Server does.
+const maxDrainSize = 256 << 10
+
+// requestBody is the body of a forwarded request, the upstream reads it from the conn of
+// the client until the response is written.
+type requestBody struct {
+	access sync.Mutex
+	body   io.ReadCloser
+	eof    bool
+	done   bool
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.done {
+		return 0, net.ErrClosed
+	}
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// Close does not close the body, which would read all of it.
+func (b *requestBody) Close() error {
+	return nil
+}
+
+// finish stops the reads of the upstream and reads the rest of the body if drain, up to
+// maxDrainSize. It reports whether the body was read entirely, so that the conn can be
+// kept alive.
+func (b *requestBody) finish(drain bool) bool {
+	// the upstream is still waiting for the body
+	if !b.access.TryLock() {
+		return false
+	}
+	defer b.access.Unlock()
+	b.done = true
+	if !b.eof && drain {
+		_, err := io.CopyN(io.Discard, b.body, maxDrainSize)
+		b.eof = err == io.EOF
+	}
+	return b.eof
+}
+
+// writeResponse writes a response without body, only the authentication challenge keeps
+// the conn alive.
+func writeResponse(w io.Writer, request *http.Request, status int, header http.Header) error {
+	if header == nil {
+		header = make(http.Header)
+	}
+	response := &http.Response{
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    request,
+		Close:      request.Close || status != http.StatusProxyAuthRequired,
+	}
+	return response.Write(w)
+}
+
+// statusCode maps the error of a dial or a round trip to a status.
+func statusCode(err error) int {
+	var netErr net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
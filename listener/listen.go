@@ -8,6 +8,7 @@ import (
 	"github.com/qtraffics/qnetwork/addrs"
 	"github.com/qtraffics/qnetwork/control"
 	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio"
 	"github.com/qtraffics/qnetwork/resolve"
 	"github.com/qtraffics/qtfra/enhancements/slicelib"
 	"github.com/qtraffics/qtfra/ex"
@@ -29,6 +30,11 @@ type Options struct {
 
 	// udp
 	UDPFragment bool
+	UDPGSO      bool
+	UDPGRO      bool
+	// UDPPacketInfo reports the destination address of each datagram, so that a socket bound to
+	// an unspecified address can reply from the address a request was sent to.
+	UDPPacketInfo bool
 }
 
 type Listener struct {
@@ -51,6 +57,29 @@ func ListenUDP(ctx context.Context, address string, port uint16, opt Options) (*
 	return l.ListenUDP(ctx, address, port)
 }
 
+// ListenUDPBatch listens like ListenUDP and returns a conn implementing netio.BatchPacketConn.
+func ListenUDPBatch(ctx context.Context, address string, port uint16, opt Options) (*netio.BatchConn, error) {
+	l := NewListener(opt)
+	return l.ListenUDPBatch(ctx, address, port)
+}
+
+func (l *Listener) ListenUDPBatch(ctx context.Context, address string, port uint16) (*netio.BatchConn, error) {
+	conn, err := l.ListenUDP(ctx, address, port)
+	if err != nil {
+		return nil, err
+	}
+	batchConn, err := netio.NewBatchConn(conn, netio.BatchOptions{
+		GSO:        l.options.UDPGSO,
+		GRO:        l.options.UDPGRO,
+		PacketInfo: l.options.UDPPacketInfo,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, ex.Cause(err, "ListenUDPBatch")
+	}
+	return batchConn, nil
+}
+
 func (l *Listener) ListenUDP(ctx context.Context, address string, port uint16) (*net.UDPConn, error) {
 	var listenConfig net.ListenConfig
 
@@ -68,6 +97,9 @@ func (l *Listener) ListenUDP(ctx context.Context, address string, port uint16) (
 	if !l.options.UDPFragment {
 		listenConfig.Control = control.Append(listenConfig.Control, control.DisableUDPFragment())
 	}
+	if l.options.UDPPacketInfo {
+		listenConfig.Control = control.Append(listenConfig.Control, control.PacketInfo())
+	}
 
 	network := meta.Network{Protocol: meta.ProtocolUDP}
 	if l.options.Family == meta.NetworkFamily6 {
@@ -103,9 +135,9 @@ func (l *Listener) ListenTCP(ctx context.Context, address string, port uint16) (
 	network := meta.Network{Protocol: meta.ProtocolTCP}
 	switch l.options.Family {
 	case meta.NetworkFamily4:
-		network.Version = meta.NetworkVersion6
-	case meta.NetworkFamily6:
 		network.Version = meta.NetworkVersion4
+	case meta.NetworkFamily6:
+		network.Version = meta.NetworkVersion6
 	}
 
 	addresses, err := resolveListenAddresses(ctx, network, address, port, resolve.SystemClient, meta.StrategyDefault)
@@ -163,7 +195,7 @@ func ListenUDPSerial(ctx context.Context, lc net.ListenConfig, network meta.Netw
 		if a.FqdnOnly() {
 			return nil, ex.New("ListenUDPSerial : listen on a not-resolved address:", a.String())
 		}
-		if network.Is4() && a.Addr.Is6() || network.Is6() && a.Addr.Is4() {
+		if !network.Is6() && a.Addr.Is6() || !network.Is4() && a.Addr.Is4() {
 			continue // skip
 		}
 		pn, err = lc.ListenPacket(ctx, networkString, a.String())
@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"io"
+
+	"github.com/qtraffics/qtfra/ex"
+)
+
+const (
+	MethodNoAuth       = 0
+	MethodPassword     = 2
+	MethodNoAcceptable = 0xff
+)
+
+const passwordVersion = 1
+
+var ErrAuthFailed = ex.New("socks5: authentication failed")
+
+// Authenticator is an authentication method of the server.
+type Authenticator interface {
+	Method() byte
+	// Authenticate runs the sub-negotiation of the method after it was selected.
+	Authenticate(conn io.ReadWriter) error
+}
+
+// NoAuth accepts every client.
+type NoAuth struct{}
+
+func (NoAuth) Method() byte {
+	return MethodNoAuth
+}
+
+func (NoAuth) Authenticate(io.ReadWriter) error {
+	return nil
+}
+
+// PasswordAuth is the username/password method of RFC 1929.
+type PasswordAuth struct {
+	Verify func(username string, password string) bool
+}
+
+// NewPasswordAuth creates a PasswordAuth accepting the users, mapped to their password.
+func NewPasswordAuth(users map[string]string) *PasswordAuth {
+	return &PasswordAuth{Verify: func(username string, password string) bool {
+		expected, loaded := users[username]
+		return loaded && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	}}
+}
+
+func (a *PasswordAuth) Method() byte {
+	return MethodPassword
+}
+
+func (a *PasswordAuth) Authenticate(conn io.ReadWriter) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != passwordVersion {
+		return ex.New("socks5: unsupported password auth version ", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	if !a.Verify(string(username), string(password)) {
+		_, _ = conn.Write([]byte{passwordVersion, 1})
+		return ErrAuthFailed
+	}
+	_, err := conn.Write([]byte{passwordVersion, 0})
+	return err
+}
@@ -0,0 +1,298 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/listener"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio"
+	"github.com/qtraffics/qnetwork/netio/udpnat"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/ex"
+	"github.com/qtraffics/qtfra/values"
+)
+
+type Options struct {
+	// Dialer carries the connections of CONNECT and the packets of UDP ASSOCIATE, required.
+	Dialer dialer.Dialer
+
+	// optional
+
+	// Authenticators are the methods of the server in order of preference. Default to NoAuth.
+	Authenticators []Authenticator
+	// Listen configures the sockets of BIND and UDP ASSOCIATE, which are bound to the
+	// address the client connected to.
+	Listen listener.Options
+	// NAT configures the sessions of UDP ASSOCIATE.
+	NAT *udpnat.Option
+
+	// HandshakeTimeout bounds the negotiation and the request.
+	// Default to netvars.DefaultProxyHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// BindTimeout bounds the wait for the incoming connection of BIND.
+	// Default to netvars.DefaultSocksBindTimeout.
+	BindTimeout time.Duration
+	// UDPIdleTimeout closes the UDP sessions idle for the duration.
+	// Default to netvars.DefaultUDPKeepAlive.
+	UDPIdleTimeout time.Duration
+}
+
+type Server struct {
+	options Options
+	nat     *udpnat.UdpNat
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	access       sync.RWMutex
+	listeners    map[net.Listener]struct{}
+	associations map[addrs.Socksaddr]*association
+}
+
+func NewServer(options Options) (*Server, error) {
+	if options.Dialer == nil {
+		return nil, ex.New("dialer required")
+	}
+	if len(options.Authenticators) == 0 {
+		options.Authenticators = []Authenticator{NoAuth{}}
+	}
+	options.HandshakeTimeout = values.UseDefault(options.HandshakeTimeout, netvars.DefaultProxyHandshakeTimeout)
+	options.BindTimeout = values.UseDefault(options.BindTimeout, netvars.DefaultSocksBindTimeout)
+	options.UDPIdleTimeout = values.UseDefault(options.UDPIdleTimeout, netvars.DefaultUDPKeepAlive)
+
+	s := &Server{
+		options:      options,
+		listeners:    make(map[net.Listener]struct{}),
+		associations: make(map[addrs.Socksaddr]*association),
+	}
+	nat, err := udpnat.New(s.prepare, options.NAT)
+	if err != nil {
+		return nil, err
+	}
+	s.nat = nat
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// ListenAndServe listens on address and port with the listener package and serves the
+// accepted conns, see Serve.
+func (s *Server) ListenAndServe(ctx context.Context, address string, port uint16, options listener.Options) error {
+	ln, err := listener.ListenTCP(ctx, address, port, options)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves the conns accepted from ln until it fails or the server is closed.
+// ln is closed on return.
+func (s *Server) Serve(ln net.Listener) error {
+	s.access.Lock()
+	if s.ctx.Err() != nil {
+		s.access.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.access.Unlock()
+	defer func() {
+		s.access.Lock()
+		delete(s.listeners, ln)
+		s.access.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return net.ErrClosed
+			}
+			return err
+		}
+		go s.ServeConn(s.ctx, conn)
+	}
+}
+
+// ServeConn serves a client on conn until the command is done or ctx is done,
+// then closes conn.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	request, err := s.handshake(conn)
+	if err != nil {
+		return err
+	}
+	switch request.Command {
+	case CommandConnect:
+		return s.connect(ctx, conn, request.Destination)
+	case CommandBind:
+		return s.bind(ctx, conn, request.Destination)
+	case CommandUDPAssociate:
+		return s.associate(ctx, conn, request.Destination)
+	default:
+		_ = writeReply(conn, ReplyCommandNotSupported, addrs.Socksaddr{})
+		return ex.New("socks5: unsupported command ", request.Command)
+	}
+}
+
+// Close stops the listeners, the clients and the UDP sessions.
+func (s *Server) Close() error {
+	s.access.Lock()
+	s.cancel()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.access.Unlock()
+	return s.nat.Close()
+}
+
+func (s *Server) handshake(conn net.Conn) (request, error) {
+	_ = conn.SetDeadline(time.Now().Add(s.options.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	methods, err := readMethods(conn)
+	if err != nil {
+		return request{}, err
+	}
+	var authenticator Authenticator
+	for _, candidate := range s.options.Authenticators {
+		if slices.Contains(methods, candidate.Method()) {
+			authenticator = candidate
+			break
+		}
+	}
+	if authenticator == nil {
+		_, _ = conn.Write([]byte{Version, MethodNoAcceptable})
+		return request{}, ErrNoAcceptableMethods
+	}
+	if _, err = conn.Write([]byte{Version, authenticator.Method()}); err != nil {
+		return request{}, err
+	}
+	if err = authenticator.Authenticate(conn); err != nil {
+		return request{}, err
+	}
+
+	r, err := readRequest(conn)
+	if err != nil {
+		if errors.Is(err, addrs.ErrInvalidSocksaddr) {
+			_ = writeReply(conn, ReplyAddressNotSupported, addrs.Socksaddr{})
+		}
+		return request{}, err
+	}
+	return r, nil
+}
+
+func (s *Server) connect(ctx context.Context, conn net.Conn, destination addrs.Socksaddr) error {
+	remote, err := s.options.Dialer.DialContext(ctx, meta.NetworkTCP, destination)
+	if err != nil {
+		_ = writeReply(conn, replyCode(err), addrs.Socksaddr{})
+		return ex.Cause(err, "socks5: dial "+destination.String())
+	}
+	if err = writeReply(conn, ReplySucceeded, addrs.FromNetAddr(remote.LocalAddr())); err != nil {
+		remote.Close()
+		return err
+	}
+	return netio.CopyConn(ctx, conn, remote)
+}
+
+// bind accepts a single connection on a new socket. A destination with an address
+// restricts the peers accepted to that address.
+func (s *Server) bind(ctx context.Context, conn net.Conn, destination addrs.Socksaddr) error {
+	local := addrs.FromNetAddr(conn.LocalAddr()).Unwrap()
+	ln, err := listener.ListenTCP(ctx, local.AddrString(), 0, s.options.Listen)
+	if err != nil {
+		_ = writeReply(conn, ReplyGeneralFailure, addrs.Socksaddr{})
+		return ex.Cause(err, "socks5: bind")
+	}
+	defer ln.Close()
+	stop := context.AfterFunc(ctx, func() {
+		ln.Close()
+	})
+	defer stop()
+	if err = writeReply(conn, ReplySucceeded, addrs.FromNetAddr(ln.Addr())); err != nil {
+		return err
+	}
+
+	if deadline, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = deadline.SetDeadline(time.Now().Add(s.options.BindTimeout))
+	}
+	expected := destination.Unwrap().Addr
+	var peer net.Conn
+	for {
+		peer, err = ln.Accept()
+		if err != nil {
+			_ = writeReply(conn, replyCode(err), addrs.Socksaddr{})
+			return ex.Cause(err, "socks5: bind accept")
+		}
+		if !expected.IsValid() || expected.IsUnspecified() ||
+			addrs.FromNetAddr(peer.RemoteAddr()).Unwrap().Addr == expected {
+			break
+		}
+		peer.Close()
+	}
+	ln.Close()
+
+	if err = writeReply(conn, ReplySucceeded, addrs.FromNetAddr(peer.RemoteAddr())); err != nil {
+		peer.Close()
+		return err
+	}
+	return netio.CopyConn(ctx, conn, peer)
+}
+
+// associate relays the datagrams of the client until conn is closed. A destination with
+// an address or a port restricts the client to them, the address of the conn is used otherwise.
+func (s *Server) associate(ctx context.Context, conn net.Conn, destination addrs.Socksaddr) error {
+	local := addrs.FromNetAddr(conn.LocalAddr()).Unwrap()
+	packetConn, err := listener.ListenUDP(ctx, local.AddrString(), 0, s.options.Listen)
+	if err != nil {
+		_ = writeReply(conn, ReplyGeneralFailure, addrs.Socksaddr{})
+		return ex.Cause(err, "socks5: udp associate")
+	}
+	expected := destination.Unwrap()
+	if !expected.Addr.IsValid() || expected.Addr.IsUnspecified() {
+		expected.Addr = addrs.FromNetAddr(conn.RemoteAddr()).Unwrap().Addr
+	}
+	a := &association{server: s, conn: packetConn, expected: expected}
+	defer a.close()
+	if err = writeReply(conn, ReplySucceeded, addrs.FromNetAddr(packetConn.LocalAddr())); err != nil {
+		return err
+	}
+
+	go a.loop()
+	// the association lasts as long as the conn
+	_, err = io.Copy(io.Discard, conn)
+	return err
+}
+
+func (s *Server) prepare(source addrs.Socksaddr, _ addrs.Socksaddr, _ netio.UDPPacket) udpnat.PrepareResult {
+	s.access.RLock()
+	a := s.associations[source]
+	s.access.RUnlock()
+	if a == nil {
+		return udpnat.PrepareResult{}
+	}
+	return udpnat.PrepareResult{Success: true, PacketWriter: a}
+}
+
+// relay forwards the packets of a session through the dialer until it is idle.
+func (s *Server) relay(session udpnat.Conn, destination addrs.Socksaddr) {
+	outbound, err := s.options.Dialer.ListenPacket(s.ctx, destination)
+	if err != nil {
+		session.Close()
+		return
+	}
+	_ = netio.CopyPacketConn(s.ctx, session, outbound, &netio.PacketCopyOptions{IdleTimeout: s.options.UDPIdleTimeout})
+}
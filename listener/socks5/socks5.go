@@ -0,0 +1,109 @@
+// Package socks5 implements a SOCKS5 server, RFC 1928, with the username/password
+// authentication of RFC 1929.
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+const Version = 5
+
+const (
+	CommandConnect      = 1
+	CommandBind         = 2
+	CommandUDPAssociate = 3
+)
+
+const (
+	ReplySucceeded           = 0
+	ReplyGeneralFailure      = 1
+	ReplyNotAllowed          = 2
+	ReplyNetworkUnreachable  = 3
+	ReplyHostUnreachable     = 4
+	ReplyConnectionRefused   = 5
+	ReplyTTLExpired          = 6
+	ReplyCommandNotSupported = 7
+	ReplyAddressNotSupported = 8
+)
+
+var (
+	ErrVersion             = ex.New("socks5: unsupported version")
+	ErrNoAcceptableMethods = ex.New("socks5: no acceptable authentication methods")
+)
+
+// request is the request of a client after the negotiation.
+type request struct {
+	Command     byte
+	Destination addrs.Socksaddr
+}
+
+// readMethods reads the authentication methods offered by the client.
+func readMethods(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != Version {
+		return nil, ErrVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// readRequest reads a request, a destination of unknown type is reported by addrs.ErrInvalidSocksaddr.
+func readRequest(r io.Reader) (request, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return request{}, err
+	}
+	if header[0] != Version {
+		return request{}, ErrVersion
+	}
+	destination, err := addrs.ReadSocksaddr(r)
+	if err != nil {
+		return request{}, err
+	}
+	return request{Command: header[1], Destination: destination}, nil
+}
+
+func writeReply(w io.Writer, reply byte, bind addrs.Socksaddr) error {
+	if !bind.Addr.IsValid() && bind.Fqdn == "" {
+		bind = addrs.FromAddrPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	}
+	b, err := addrs.AppendSocksaddr([]byte{Version, reply, 0}, bind.Unwrap())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// replyCode maps the error of a dial to a reply.
+func replyCode(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ReplyHostUnreachable
+	default:
+		return ReplyGeneralFailure
+	}
+}
@@ -0,0 +1,225 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+var unspecified = addrs.FromParseSocksaddr("0.0.0.0:0")
+
+// netDialer dials with the standard library, the tests only dial addresses.
+type netDialer struct{}
+
+func (netDialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network.String(), address.String())
+}
+
+func (netDialer) ListenPacket(ctx context.Context, _ addrs.Socksaddr) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp", "127.0.0.1:0")
+}
+
+func startServer(t *testing.T, options Options) string {
+	options.Dialer = netDialer{}
+	server, err := NewServer(options)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+func echoTCP(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echoUDP(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// sendRequest negotiates no authentication, sends a request and reads the first reply.
+func sendRequest(t *testing.T, conn net.Conn, command byte, destination addrs.Socksaddr) (byte, addrs.Socksaddr) {
+	_, err := conn.Write([]byte{Version, 1, MethodNoAuth})
+	require.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	require.NoError(t, err)
+	require.Equal(t, []byte{Version, MethodNoAuth}, method)
+
+	b, err := addrs.AppendSocksaddr([]byte{Version, command, 0}, destination)
+	require.NoError(t, err)
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+	return readReply(t, conn)
+}
+
+func readReply(t *testing.T, conn net.Conn) (byte, addrs.Socksaddr) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(conn, header)
+	require.NoError(t, err)
+	bind, err := addrs.ReadSocksaddr(conn)
+	require.NoError(t, err)
+	return header[1], bind
+}
+
+func TestConnect(t *testing.T) {
+	server := startServer(t, Options{Authenticators: []Authenticator{NewPasswordAuth(map[string]string{"user": "secret"})}})
+	echo := echoTCP(t)
+
+	client, err := proxy.SOCKS5("tcp", server, &proxy.Auth{User: "user", Password: "secret"}, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := client.Dial("tcp", echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(reply))
+
+	client, err = proxy.SOCKS5("tcp", server, &proxy.Auth{User: "user", Password: "wrong"}, proxy.Direct)
+	require.NoError(t, err)
+	_, err = client.Dial("tcp", echo)
+	assert.Error(t, err)
+
+	// no acceptable method
+	conn, err = net.Dial("tcp", server)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{Version, 1, MethodNoAuth})
+	require.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{Version, MethodNoAcceptable}, method)
+}
+
+func TestConnectRefused(t *testing.T) {
+	server := startServer(t, Options{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := addrs.FromNetAddr(ln.Addr())
+	ln.Close()
+
+	conn, err := net.Dial("tcp", server)
+	require.NoError(t, err)
+	defer conn.Close()
+	reply, _ := sendRequest(t, conn, CommandConnect, closed)
+	assert.Equal(t, byte(ReplyConnectionRefused), reply)
+
+	conn, err = net.Dial("tcp", server)
+	require.NoError(t, err)
+	defer conn.Close()
+	reply, _ = sendRequest(t, conn, 9, closed)
+	assert.Equal(t, byte(ReplyCommandNotSupported), reply)
+}
+
+func TestBind(t *testing.T) {
+	server := startServer(t, Options{})
+	conn, err := net.Dial("tcp", server)
+	require.NoError(t, err)
+	defer conn.Close()
+	reply, bind := sendRequest(t, conn, CommandBind, unspecified)
+	require.Equal(t, byte(ReplySucceeded), reply)
+
+	peer, err := net.Dial("tcp", bind.String())
+	require.NoError(t, err)
+	defer peer.Close()
+	reply, remote := readReply(t, conn)
+	require.Equal(t, byte(ReplySucceeded), reply)
+	assert.Equal(t, addrs.FromNetAddr(peer.LocalAddr()), remote)
+
+	_, err = peer.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(peer, b)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(b))
+}
+
+func TestUDPAssociate(t *testing.T) {
+	server := startServer(t, Options{})
+	echo := echoUDP(t)
+	conn, err := net.Dial("tcp", server)
+	require.NoError(t, err)
+	defer conn.Close()
+	reply, bind := sendRequest(t, conn, CommandUDPAssociate, unspecified)
+	require.Equal(t, byte(ReplySucceeded), reply)
+
+	packetConn, err := net.DialUDP("udp", nil, bind.UDPAddr())
+	require.NoError(t, err)
+	defer packetConn.Close()
+	require.NoError(t, packetConn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	destination := addrs.FromNetAddr(echo)
+	for _, payload := range []string{"first", "second"} {
+		frame, err := addrs.AppendSocksaddr([]byte{0, 0, 0}, destination)
+		require.NoError(t, err)
+		_, err = packetConn.Write(append(frame, payload...))
+		require.NoError(t, err)
+
+		b := make([]byte, 1500)
+		n, err := packetConn.Read(b)
+		require.NoError(t, err)
+		source, length, err := addrs.ParseSocksaddr(b[3:n])
+		require.NoError(t, err)
+		assert.Equal(t, destination, source)
+		assert.Equal(t, payload, string(b[3+length:n]))
+	}
+
+	// fragments are dropped
+	frame, err := addrs.AppendSocksaddr([]byte{0, 0, 1}, destination)
+	require.NoError(t, err)
+	_, err = packetConn.Write(append(frame, "fragment"...))
+	require.NoError(t, err)
+	require.NoError(t, packetConn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = packetConn.Read(make([]byte, 1500))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"net"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/buf"
+)
+
+// association is the UDP socket of an UDP ASSOCIATE. The first datagram accepted
+// fixes the address of the client, which identifies its sessions in the nat.
+//
+// Datagrams are framed as:
+//
+//	reserved(2) fragment(1) address payload
+//
+// Fragmented datagrams are dropped.
+type association struct {
+	server   *Server
+	conn     *net.UDPConn
+	expected addrs.Socksaddr
+
+	// client is written once by loop before the association is registered.
+	client addrs.Socksaddr
+	closed bool
+}
+
+func (a *association) loop() {
+	for {
+		buffer := buf.NewSize(netvars.DefaultUDPReadBufferSize)
+		n, addr, err := a.conn.ReadFromUDPAddrPort(buffer.FreeBytes())
+		if err != nil {
+			buffer.Free()
+			return
+		}
+		buffer.Truncated(n)
+		source := addrs.FromAddrPort(addr).Unwrap()
+		b := buffer.Bytes()
+		if len(b) < 3 || b[0] != 0 || b[1] != 0 || b[2] != 0 || !a.accept(source) {
+			buffer.Free()
+			continue
+		}
+		destination, length, err := addrs.ParseSocksaddr(b[3:])
+		if err != nil || !destination.Dialable() {
+			buffer.Free()
+			continue
+		}
+		_, _ = buffer.Discard(3 + length)
+		session, isNew := a.server.nat.NewPacket(buffer, source, destination)
+		if session == nil {
+			buffer.Free()
+		} else if isNew {
+			go a.server.relay(session, destination)
+		}
+	}
+}
+
+// accept reports whether a datagram from source belongs to the client.
+func (a *association) accept(source addrs.Socksaddr) bool {
+	if a.client.Addr.IsValid() {
+		return source == a.client
+	}
+	if source.Addr != a.expected.Addr || a.expected.Port != 0 && source.Port != a.expected.Port {
+		return false
+	}
+	s := a.server
+	s.access.Lock()
+	defer s.access.Unlock()
+	if a.closed || s.associations[source] != nil {
+		return false
+	}
+	a.client = source
+	s.associations[source] = a
+	return true
+}
+
+func (a *association) close() {
+	a.conn.Close()
+	s := a.server
+	s.access.Lock()
+	a.closed = true
+	registered := a.client.Addr.IsValid()
+	if registered {
+		delete(s.associations, a.client)
+	}
+	s.access.Unlock()
+	if registered {
+		s.nat.CloseSession(a.client.AddrPort())
+	}
+}
+
+// WriteTo frames a datagram from remote and sends it to the client.
+func (a *association) WriteTo(p []byte, remote net.Addr) (int, error) {
+	address, isSocksaddr := remote.(addrs.Socksaddr)
+	if !isSocksaddr {
+		address = addrs.FromNetAddr(remote)
+	}
+	address = address.Unwrap()
+	frame, err := addrs.AppendSocksaddr(make([]byte, 3, 3+addrs.SocksaddrLen(address)+len(p)), address)
+	if err != nil {
+		return 0, err
+	}
+	frame = append(frame, p...)
+	if _, err = a.conn.WriteToUDPAddrPort(frame, a.client.AddrPort()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -30,11 +30,11 @@ type Network struct {
 }
 
 func (n Network) Is4() bool {
-	return n.Version == NetworkVersionDual || n.Version == NetworkVersion6
+	return n.Version == NetworkVersionDual || n.Version == NetworkVersion4
 }
 
 func (n Network) Is6() bool {
-	return n.Version == NetworkVersionDual || n.Version == NetworkVersion4
+	return n.Version == NetworkVersionDual || n.Version == NetworkVersion6
 }
 
 func (n Network) IsUDP() bool {
@@ -0,0 +1,24 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkVersion(t *testing.T) {
+	for _, testCase := range []struct {
+		network string
+		is4     bool
+		is6     bool
+	}{
+		{"tcp", true, true},
+		{"udp4", true, false},
+		{"tcp6", false, true},
+	} {
+		network, ok := ParseNetwork(testCase.network)
+		assert.True(t, ok)
+		assert.Equal(t, testCase.is4, network.Is4(), testCase.network)
+		assert.Equal(t, testCase.is6, network.Is6(), testCase.network)
+	}
+}
@@ -0,0 +1,112 @@
+package netio
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/buf"
+)
+
+// BatchPacketConn reads and writes many datagrams per call.
+//
+// ReadBatch fills packets in order and returns how many were filled. Each packet must carry
+// a Buf with free space for a whole datagram; a non-nil OOB is filled with the control messages.
+// WriteBatch sends packets to their Addr and returns how many were sent.
+type BatchPacketConn interface {
+	net.PacketConn
+	ReadBatch(packets []UDPPacket) (n int, err error)
+	WriteBatch(packets []UDPPacket) (n int, err error)
+}
+
+type BatchOptions struct {
+	// GSO sends a packet with SegmentSize set as a single UDP_SEGMENT super datagram, linux only.
+	GSO bool
+	// GRO lets the kernel coalesce received datagrams, the segment size is reported
+	// by SegmentSize of the packet, linux only.
+	GRO bool
+	// PacketInfo parses the destination address and interface of received packets into
+	// LocalAddr and IfIndex, the socket must be created with control.PacketInfo.
+	// Packets with LocalAddr set are always sent from that address.
+	PacketInfo bool
+}
+
+var (
+	_ BatchPacketConn  = (*BatchConn)(nil)
+	_ PacketReader     = (*BatchConn)(nil)
+	_ PacketInfoWriter = (*BatchConn)(nil)
+)
+
+// NewBatchConn wraps conn with the batch packet API.
+// On linux recvmmsg and sendmmsg are used, elsewhere it falls back to one syscall per packet.
+func NewBatchConn(conn *net.UDPConn, options BatchOptions) (*BatchConn, error) {
+	return newBatchConn(conn, options)
+}
+
+// ReadPacket reads a single datagram into a pooled packet.
+func (c *BatchConn) ReadPacket() (UDPPacket, error) {
+	packets := [1]UDPPacket{NewPacket(buf.NewSize(netvars.DefaultUDPReadBufferSize), nil)}
+	_, err := c.ReadBatch(packets[:])
+	if err != nil {
+		PutPacket(packets[0])
+		return UDPPacket{}, err
+	}
+	return packets[0], nil
+}
+
+func (c *BatchConn) WriteToFrom(bs []byte, destination net.Addr, local netip.Addr, ifIndex int) (int, error) {
+	var oob []byte
+	if local.IsValid() {
+		oob = AppendPacketInfo(make([]byte, 0, packetInfoOOBSize), local, ifIndex)
+	}
+	var (
+		n   int
+		err error
+	)
+	if destination == nil {
+		n, _, err = c.WriteMsgUDP(bs, oob, nil)
+	} else {
+		addrPort := addrs.AddrPortFromNetAddr(destination)
+		n, _, err = c.WriteMsgUDPAddrPort(bs, oob, netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()))
+	}
+	return n, err
+}
+
+// Segments splits a coalesced packet into its datagrams,
+// the returned slices share the memory of the packet buffer.
+func (p UDPPacket) Segments() [][]byte {
+	data := p.Buf.Bytes()
+	if p.SegmentSize <= 0 || len(data) <= p.SegmentSize {
+		return [][]byte{data}
+	}
+	segments := make([][]byte, 0, (len(data)+p.SegmentSize-1)/p.SegmentSize)
+	for len(data) > 0 {
+		size := min(len(data), p.SegmentSize)
+		segments = append(segments, data[:size])
+		data = data[size:]
+	}
+	return segments
+}
+
+// SplitPacket turns a coalesced packet into one pooled packet per datagram.
+// The original packet is released when it has been split.
+func SplitPacket(p UDPPacket) []UDPPacket {
+	segments := p.Segments()
+	if len(segments) <= 1 {
+		p.SegmentSize = 0
+		return []UDPPacket{p}
+	}
+	packets := make([]UDPPacket, 0, len(segments))
+	for _, segment := range segments {
+		buffer := buf.NewSize(len(segment))
+		_, _ = buffer.Write(segment)
+		pack := NewPacket(buffer, nil)
+		pack.Addr = p.Addr
+		pack.LocalAddr = p.LocalAddr
+		pack.IfIndex = p.IfIndex
+		packets = append(packets, pack)
+	}
+	PutPacket(p)
+	return packets
+}
@@ -0,0 +1,172 @@
+package netio
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/control"
+	"github.com/qtraffics/qtfra/ex"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const maxBatchSize = 64
+
+// ipv4.Message and ipv6.Message are both aliases of the same socket message.
+type batchReadWriter interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type BatchConn struct {
+	*net.UDPConn
+
+	batch      batchReadWriter
+	gso        bool
+	gro        bool
+	packetInfo bool
+
+	readAccess   sync.Mutex
+	readMessages []ipv4.Message
+	readOOB      [][]byte
+
+	writeAccess   sync.Mutex
+	writeMessages []ipv4.Message
+	writeOOB      [][]byte
+}
+
+func newBatchConn(conn *net.UDPConn, options BatchOptions) (*BatchConn, error) {
+	c := &BatchConn{
+		UDPConn:       conn,
+		gso:           options.GSO,
+		packetInfo:    options.PacketInfo,
+		readMessages:  make([]ipv4.Message, maxBatchSize),
+		readOOB:       make([][]byte, maxBatchSize),
+		writeMessages: make([]ipv4.Message, maxBatchSize),
+		writeOOB:      make([][]byte, maxBatchSize),
+	}
+	if localAddr, isUDPAddr := conn.LocalAddr().(*net.UDPAddr); isUDPAddr && localAddr.IP.To4() != nil {
+		c.batch = ipv4.NewPacketConn(conn)
+	} else {
+		c.batch = ipv6.NewPacketConn(conn)
+	}
+	for i := range maxBatchSize {
+		c.readMessages[i].Buffers = make([][]byte, 1)
+		c.writeMessages[i].Buffers = make([][]byte, 1)
+	}
+	if options.GRO {
+		err := control.Conn(conn, func(fd uintptr) error {
+			return unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1)
+		})
+		if err != nil {
+			return nil, os.NewSyscallError("SETSOCKOPT UDP_GRO", err)
+		}
+		c.gro = true
+	}
+	return c, nil
+}
+
+func (c *BatchConn) ReadBatch(packets []UDPPacket) (int, error) {
+	if len(packets) == 0 {
+		return 0, nil
+	}
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+
+	messages := c.readMessages[:min(len(packets), maxBatchSize)]
+	for i := range messages {
+		messages[i].Buffers[0] = packets[i].Buf.FreeBytes()
+		messages[i].OOB = packets[i].OOB[:cap(packets[i].OOB)]
+		if len(messages[i].OOB) == 0 && (c.gro || c.packetInfo) {
+			if c.readOOB[i] == nil {
+				c.readOOB[i] = make([]byte, unix.CmsgSpace(4)+packetInfoOOBSize)
+			}
+			messages[i].OOB = c.readOOB[i]
+		}
+		messages[i].Addr = nil
+	}
+	n, err := c.batch.ReadBatch(messages, 0)
+	for i := 0; i < n; i++ {
+		message := &messages[i]
+		packets[i].Buf.Truncated(packets[i].Buf.Len() + message.N)
+		packets[i].Addr = addrs.FromNetAddr(message.Addr)
+		if c.gro {
+			packets[i].SegmentSize = parseSegmentSize(message.OOB[:message.NN])
+		}
+		if c.packetInfo {
+			packets[i].LocalAddr, packets[i].IfIndex, _ = ParsePacketInfo(message.OOB[:message.NN])
+		}
+		if packets[i].OOB != nil {
+			packets[i].OOB = packets[i].OOB[:message.NN]
+		}
+	}
+	return n, err
+}
+
+func (c *BatchConn) WriteBatch(packets []UDPPacket) (int, error) {
+	var written int
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	for len(packets) > 0 {
+		messages := c.writeMessages[:min(len(packets), maxBatchSize)]
+		for i := range messages {
+			pack := packets[i]
+			messages[i].Buffers[0] = pack.Buf.Bytes()
+			messages[i].Addr = PacketAddr(pack.Addr)
+			messages[i].OOB = pack.OOB
+			coalesced := pack.SegmentSize > 0 && pack.Buf.Len() > pack.SegmentSize
+			if coalesced && !c.gso {
+				return written, ex.New("WriteBatch: coalesced packet without GSO enabled")
+			}
+			if coalesced || pack.LocalAddr.IsValid() {
+				oob := append(c.writeOOB[i][:0], pack.OOB...)
+				if coalesced {
+					oob = appendSegmentSize(oob, pack.SegmentSize)
+				}
+				oob = AppendPacketInfo(oob, pack.LocalAddr, pack.IfIndex)
+				c.writeOOB[i] = oob
+				messages[i].OOB = oob
+			}
+		}
+		n, err := c.batch.WriteBatch(messages, 0)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		packets = packets[n:]
+	}
+	return written, nil
+}
+
+func parseSegmentSize(oob []byte) int {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, message := range messages {
+		if message.Header.Level == unix.IPPROTO_UDP && message.Header.Type == unix.UDP_GRO && len(message.Data) >= 2 {
+			if len(message.Data) >= 4 {
+				return int(binary.NativeEndian.Uint32(message.Data))
+			}
+			return int(binary.NativeEndian.Uint16(message.Data))
+		}
+	}
+	return 0
+}
+
+func appendSegmentSize(b []byte, segmentSize int) []byte {
+	start := len(b)
+	b = append(b, make([]byte, unix.CmsgSpace(2))...)
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&b[start]))
+	header.Level = unix.IPPROTO_UDP
+	header.Type = unix.UDP_SEGMENT
+	header.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(b[start+unix.CmsgLen(0):], uint16(segmentSize))
+	return b
+}
@@ -0,0 +1,59 @@
+//go:build !linux
+
+package netio
+
+import (
+	"net"
+	"sync"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+type BatchConn struct {
+	*net.UDPConn
+
+	writeAccess sync.Mutex
+}
+
+func newBatchConn(conn *net.UDPConn, options BatchOptions) (*BatchConn, error) {
+	if options.GSO || options.GRO || options.PacketInfo {
+		return nil, ex.New("UDP GSO/GRO and packet info are only supported on linux")
+	}
+	return &BatchConn{UDPConn: conn}, nil
+}
+
+// ReadBatch reads a single packet per call, batch reads are only available on linux.
+func (c *BatchConn) ReadBatch(packets []UDPPacket) (int, error) {
+	if len(packets) == 0 {
+		return 0, nil
+	}
+	pack := &packets[0]
+	n, oobn, _, addr, err := c.ReadMsgUDPAddrPort(pack.Buf.FreeBytes(), pack.OOB[:cap(pack.OOB)])
+	if err != nil {
+		return 0, err
+	}
+	pack.Buf.Truncated(pack.Buf.Len() + n)
+	if pack.OOB != nil {
+		pack.OOB = pack.OOB[:oobn]
+	}
+	pack.Addr = addrs.FromAddrPort(addr)
+	return 1, nil
+}
+
+func (c *BatchConn) WriteBatch(packets []UDPPacket) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	for i, pack := range packets {
+		var err error
+		if pack.Addr.Addr.IsValid() {
+			_, _, err = c.WriteMsgUDPAddrPort(pack.Buf.Bytes(), pack.OOB, pack.Addr.AddrPort())
+		} else {
+			_, _, err = c.WriteMsgUDP(pack.Buf.Bytes(), pack.OOB, nil)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
@@ -0,0 +1,130 @@
+package netio
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/control"
+	"github.com/qtraffics/qtfra/buf"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBatchPackets(n int) []UDPPacket {
+	packets := make([]UDPPacket, n)
+	for i := range packets {
+		packets[i] = NewPacket(buf.NewSize(2048), nil)
+	}
+	return packets
+}
+
+func TestBatchConn(t *testing.T) {
+	options := BatchOptions{}
+	if runtime.GOOS == "linux" {
+		options = BatchOptions{GSO: true, GRO: true}
+	}
+	receiver, err := NewBatchConn(listenLoopback(t), options)
+	require.NoError(t, err)
+	defer receiver.Close()
+	sender, err := NewBatchConn(listenLoopback(t), options)
+	require.NoError(t, err)
+	defer sender.Close()
+
+	destination := addrs.FromNetAddr(receiver.LocalAddr())
+	outgoing := make([]UDPPacket, 4)
+	for i := range outgoing {
+		outgoing[i] = NewPacket(buf.As(bytes.Repeat([]byte{byte(i)}, 100)), nil)
+		outgoing[i].Addr = destination
+	}
+	n, err := sender.WriteBatch(outgoing)
+	require.NoError(t, err)
+	assert.Equal(t, len(outgoing), n)
+
+	var received [][]byte
+	require.NoError(t, receiver.SetReadDeadline(time.Now().Add(time.Second)))
+	for len(received) < len(outgoing) {
+		incoming := newBatchPackets(8)
+		n, err = receiver.ReadBatch(incoming)
+		require.NoError(t, err)
+		for _, pack := range incoming[:n] {
+			assert.Equal(t, addrs.FromNetAddr(sender.LocalAddr()).AddrPort(), pack.Addr.AddrPort())
+			for _, segment := range pack.Segments() {
+				received = append(received, bytes.Clone(segment))
+			}
+		}
+		for _, pack := range incoming {
+			PutPacket(pack)
+		}
+	}
+	for i, data := range received {
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 100), data)
+	}
+
+	if !options.GSO {
+		return
+	}
+	// one super datagram of three segments
+	super := NewPacket(buf.As(bytes.Repeat([]byte{7}, 250)), nil)
+	super.Addr = destination
+	super.SegmentSize = 100
+	_, err = sender.WriteBatch([]UDPPacket{super})
+	require.NoError(t, err)
+
+	var sizes []int
+	for len(sizes) < 3 {
+		incoming := newBatchPackets(4)
+		n, err = receiver.ReadBatch(incoming)
+		require.NoError(t, err)
+		for _, pack := range incoming[:n] {
+			for _, split := range SplitPacket(pack) {
+				sizes = append(sizes, split.Buf.Len())
+				PutPacket(split)
+			}
+		}
+		for _, pack := range incoming[n:] {
+			PutPacket(pack)
+		}
+	}
+	assert.Equal(t, []int{100, 100, 50}, sizes)
+}
+
+func TestBatchConnPacketInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("packet info is only supported on linux")
+	}
+	listenConfig := net.ListenConfig{Control: control.PacketInfo()}
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp4", "0.0.0.0:0")
+	require.NoError(t, err)
+	server, err := NewBatchConn(packetConn.(*net.UDPConn), BatchOptions{PacketInfo: true})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := listenLoopback(t)
+	defer client.Close()
+	secondary := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), server.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+	_, err = client.WriteToUDPAddrPort([]byte("ping"), secondary)
+	require.NoError(t, err)
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Second)))
+	pack, err := server.ReadPacket()
+	require.NoError(t, err)
+	defer PutPacket(pack)
+	assert.Equal(t, secondary.Addr(), pack.LocalAddr)
+	assert.NotZero(t, pack.IfIndex)
+
+	_, err = server.WriteToFrom([]byte("pong"), pack.Addr.UDPAddr(), pack.LocalAddr, 0)
+	require.NoError(t, err)
+	buffer := make([]byte, 64)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	n, from, err := client.ReadFromUDPAddrPort(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buffer[:n]))
+	assert.Equal(t, secondary, from)
+}
@@ -12,43 +12,18 @@ type closeWriter interface {
 	CloseWrite() error
 }
 
+// CopyConn copies between source and destination until both directions are done. When a
+// direction reaches EOF its writer is half closed, using the first conn of its wrapper chain
+// supporting CloseWrite, or closed when there is none.
 func CopyConn(ctx context.Context, source net.Conn, destination net.Conn) error {
 	var group threads.Group
 
-	if closer, ok := destination.(closeWriter); ok {
-		group.Append("download", func(ctx context.Context) error {
-			_, err := iolib.Copy(source, destination)
-			if err == nil {
-				_ = closer.CloseWrite()
-			} else {
-				_ = iolib.Close(destination)
-			}
-			return err
-		})
-	} else {
-		group.Append("download", func(ctx context.Context) error {
-			defer iolib.Close(destination)
-			_, err := iolib.Copy(source, destination)
-			return err
-		})
-	}
-	if closer, ok := source.(closeWriter); ok {
-		group.Append("upload", func(ctx context.Context) error {
-			_, err := iolib.Copy(destination, source)
-			if err == nil {
-				_ = closer.CloseWrite()
-			} else {
-				_ = iolib.Close(source)
-			}
-			return err
-		})
-	} else {
-		group.Append("upload", func(ctx context.Context) error {
-			defer iolib.Close(source)
-			_, err := iolib.Copy(destination, source)
-			return err
-		})
-	}
+	group.Append("download", func(ctx context.Context) error {
+		return copyHalf(source, destination)
+	})
+	group.Append("upload", func(ctx context.Context) error {
+		return copyHalf(destination, source)
+	})
 
 	group.Cleanup(func() {
 		_ = iolib.Close(source)
@@ -57,3 +32,23 @@ func CopyConn(ctx context.Context, source net.Conn, destination net.Conn) error
 
 	return group.Run(ctx)
 }
+
+// copyHalf copies source to destination, then shuts down the write side of destination.
+func copyHalf(destination net.Conn, source net.Conn) error {
+	_, err := iolib.Copy(destination, source)
+	if closer, ok := findCloseWriter(destination); ok && err == nil {
+		_ = closer.CloseWrite()
+	} else {
+		_ = iolib.Close(destination)
+	}
+	return err
+}
+
+// CopyConnLimit works like CopyConn, but traffic read from source is throttled by upload
+// and traffic written back to source is throttled by download. A nil limiter means unlimited.
+func CopyConnLimit(ctx context.Context, source net.Conn, destination net.Conn, upload *Limiter, download *Limiter) error {
+	if upload == nil && download == nil {
+		return CopyConn(ctx, source, destination)
+	}
+	return CopyConn(ctx, NewRateLimitedConn(source, upload, download), destination)
+}
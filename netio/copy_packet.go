@@ -0,0 +1,145 @@
+package netio
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/buf"
+	"github.com/qtraffics/qtfra/threads"
+)
+
+type PacketCounters struct {
+	UploadPackets   atomic.Uint64
+	UploadBytes     atomic.Uint64
+	DownloadPackets atomic.Uint64
+	DownloadBytes   atomic.Uint64
+}
+
+type PacketCopyOptions struct {
+	// IdleTimeout closes both conns once no packet passed in either direction for the duration.
+	// Default to netvars.DefaultUDPKeepAlive.
+	IdleTimeout time.Duration
+
+	// optional
+	Counters *PacketCounters
+}
+
+type packetCopyState struct {
+	lastActive atomic.Int64
+	stopped    atomic.Bool
+}
+
+func (s *packetCopyState) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// CopyPacketConn relays datagrams between source and destination until one side fails,
+// ctx is done or the relay stays idle for IdleTimeout.
+//
+// The address reported for a packet read from one side is used as the destination
+// when writing it to the other side. Conns implementing PacketReader, such as udpnat
+// sessions, hand their packets over directly and keep their per-packet destination.
+func CopyPacketConn(ctx context.Context, source net.PacketConn, destination net.PacketConn, options *PacketCopyOptions) error {
+	if options == nil {
+		options = &PacketCopyOptions{}
+	}
+	idleTimeout := options.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = netvars.DefaultUDPKeepAlive
+	}
+	counters := options.Counters
+	if counters == nil {
+		counters = &PacketCounters{}
+	}
+
+	var (
+		group threads.Group
+		state packetCopyState
+	)
+	state.touch()
+	stop := func() {
+		if state.stopped.CompareAndSwap(false, true) {
+			_ = source.Close()
+			_ = destination.Close()
+		}
+	}
+
+	group.Append("upload", func(ctx context.Context) error {
+		return copyPacket(destination, source, &state, &counters.UploadPackets, &counters.UploadBytes)
+	})
+	group.Append("download", func(ctx context.Context) error {
+		return copyPacket(source, destination, &state, &counters.DownloadPackets, &counters.DownloadBytes)
+	})
+	group.Append("idle", func(ctx context.Context) error {
+		ticker := time.NewTicker(max(idleTimeout/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case now := <-ticker.C:
+				if now.Sub(time.Unix(0, state.lastActive.Load())) >= idleTimeout {
+					stop()
+					return nil
+				}
+			}
+		}
+	})
+	group.FastFail()
+	group.Cleanup(stop)
+	return group.Run(ctx)
+}
+
+func copyPacket(destination net.PacketConn, source net.PacketConn, state *packetCopyState, packets *atomic.Uint64, bytes *atomic.Uint64) error {
+	reader, isPacketReader := source.(PacketReader)
+	for {
+		var (
+			pack UDPPacket
+			err  error
+		)
+		if isPacketReader {
+			pack, err = reader.ReadPacket()
+		} else {
+			pack, err = readPacket(source)
+		}
+		if err != nil {
+			if state.stopped.Load() {
+				return nil
+			}
+			return err
+		}
+		state.touch()
+		n := pack.Buf.Len()
+		_, err = destination.WriteTo(pack.Buf.Bytes(), PacketAddr(pack.Addr))
+		PutPacket(pack)
+		if err != nil {
+			if state.stopped.Load() {
+				return nil
+			}
+			return err
+		}
+		packets.Add(1)
+		bytes.Add(uint64(n))
+	}
+}
+
+func readPacket(source net.PacketConn) (UDPPacket, error) {
+	buffer := buf.NewSize(netvars.DefaultUDPReadBufferSize)
+	n, addr, err := source.ReadFrom(buffer.FreeBytes())
+	if err != nil {
+		buffer.Free()
+		return UDPPacket{}, err
+	}
+	buffer.Truncated(n)
+	pack := NewPacket(buffer, nil)
+	if socksaddr, isSocksaddr := addr.(addrs.Socksaddr); isSocksaddr {
+		pack.Addr = socksaddr
+	} else {
+		pack.Addr = addrs.FromNetAddr(addr)
+	}
+	return pack, nil
+}
@@ -0,0 +1,83 @@
+package netio
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	return conn
+}
+
+func TestCopyPacketConn(t *testing.T) {
+	client := listenLoopback(t)
+	defer client.Close()
+	echo := listenLoopback(t)
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	relayIn := listenLoopback(t)
+	relayOut := listenLoopback(t)
+	// packets from the client are relayed to the echo server and replies go back to the client.
+	source := &mappedPacketConn{PacketConn: relayIn, client: client.LocalAddr(), server: echo.LocalAddr()}
+
+	var counters PacketCounters
+	done := make(chan error, 1)
+	go func() {
+		done <- CopyPacketConn(context.Background(), source, relayOut, &PacketCopyOptions{
+			IdleTimeout: 200 * time.Millisecond,
+			Counters:    &counters,
+		})
+	}()
+
+	buffer := make([]byte, 2048)
+	for range 3 {
+		_, err := client.WriteTo([]byte("hello"), relayIn.LocalAddr())
+		require.NoError(t, err)
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := client.ReadFrom(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buffer[:n]))
+	}
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay not closed after idle timeout")
+	}
+	assert.Equal(t, uint64(3), counters.UploadPackets.Load())
+	assert.Equal(t, uint64(15), counters.DownloadBytes.Load())
+}
+
+// mappedPacketConn maps the client to the server in both directions.
+type mappedPacketConn struct {
+	net.PacketConn
+	client net.Addr
+	server net.Addr
+}
+
+func (c *mappedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, _, err := c.PacketConn.ReadFrom(p)
+	return n, c.server, err
+}
+
+func (c *mappedPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(p, c.client)
+}
@@ -0,0 +1,174 @@
+package fault
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netio"
+)
+
+var _ net.Conn = (*Conn)(nil)
+
+// Conn injects the faults of its destination into a stream conn.
+type Conn struct {
+	net.Conn
+	injector    *Injector
+	destination addrs.Socksaddr
+
+	transferred atomic.Int64
+	reset       atomic.Bool
+	limiter     *netio.Limiter
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// NewConn wraps conn with the faults injector sets for destination.
+func NewConn(conn net.Conn, injector *Injector, destination addrs.Socksaddr) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{
+		Conn:        conn,
+		injector:    injector,
+		destination: destination,
+		limiter:     netio.NewLimiter(0, 0),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		if c.reset.Load() {
+			return 0, c.resetError("read")
+		}
+		n, err := c.Conn.Read(p)
+		if n == 0 {
+			return n, err
+		}
+		faults := c.injector.Faults(c.destination)
+		if blackholed(c.transferred.Load(), faults) {
+			// discard what arrives, the deadline of the inner conn still applies.
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if resetErr := c.account(n, faults, "read"); resetErr != nil {
+			return 0, resetErr
+		}
+		if throttleErr := c.throttle(n, faults); throttleErr != nil {
+			return 0, throttleErr
+		}
+		if !sleep(c.ctx, faults.ReadLatency) {
+			return 0, net.ErrClosed
+		}
+		return n, err
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.reset.Load() {
+		return 0, c.resetError("write")
+	}
+	faults := c.injector.Faults(c.destination)
+	if blackholed(c.transferred.Load(), faults) {
+		return len(p), nil
+	}
+	if !sleep(c.ctx, faults.WriteLatency) {
+		return 0, net.ErrClosed
+	}
+	data, truncated := p, false
+	if len(p) > 1 && c.injector.chance(faults.TruncateWrite) {
+		data, truncated = p[:1+c.injector.intN(len(p)-1)], true
+	}
+	if faults.ResetAfter > 0 {
+		data = data[:min(int64(len(data)), max(faults.ResetAfter-c.transferred.Load(), 0))]
+	}
+	if err := c.throttle(len(data), faults); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(data)
+	if err != nil {
+		return n, err
+	}
+	if resetErr := c.account(n, faults, "write"); resetErr != nil {
+		return n, resetErr
+	}
+	if truncated {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// account counts n transferred bytes and resets the conn once ResetAfter is reached.
+func (c *Conn) account(n int, faults Faults, op string) error {
+	transferred := c.transferred.Add(int64(n))
+	if faults.ResetAfter > 0 && transferred >= faults.ResetAfter && c.reset.CompareAndSwap(false, true) {
+		if tcpConn, isTCPConn := c.Conn.(*net.TCPConn); isTCPConn {
+			// send a real RST to the peer
+			_ = tcpConn.SetLinger(0)
+		}
+		_ = c.Conn.Close()
+		c.cancel()
+		return c.resetError(op)
+	}
+	return nil
+}
+
+func (c *Conn) resetError(op string) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: os.NewSyscallError(op, syscall.ECONNRESET)}
+}
+
+func (c *Conn) throttle(n int, faults Faults) error {
+	if faults.Throttle == 0 {
+		return nil
+	}
+	if c.limiter.Limit() != faults.Throttle {
+		c.limiter.SetLimit(faults.Throttle)
+		c.limiter.SetBurst(int(max(faults.Throttle/10, 1)))
+	}
+	if err := c.limiter.WaitN(c.ctx, n); err != nil {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func blackholed(transferred int64, faults Faults) bool {
+	return faults.BlackholeAfter > 0 && transferred >= faults.BlackholeAfter
+}
+
+func (c *Conn) CloseWrite() error {
+	if closer, isCloser := c.Conn.(interface{ CloseWrite() error }); isCloser {
+		return closer.CloseWrite()
+	}
+	return os.ErrInvalid
+}
+
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *Conn) UnderlayConn() net.Conn {
+	return c.Conn
+}
+
+// sleep waits for d, it reports false when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,68 @@
+package fault
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+)
+
+var _ dialer.Dialer = (*Dialer)(nil)
+
+// Dialer injects dial faults and wraps the dialed conns with the faults of their destination.
+type Dialer struct {
+	dialer   dialer.Dialer
+	injector *Injector
+}
+
+func NewDialer(dialer dialer.Dialer, injector *Injector) *Dialer {
+	return &Dialer{dialer: dialer, injector: injector}
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	faults := d.injector.Faults(address)
+	if !sleep(ctx, faults.DialDelay) {
+		return nil, ctx.Err()
+	}
+	if d.injector.chance(faults.DialFailure) {
+		return nil, &net.OpError{Op: "dial", Net: network.String(), Addr: address, Err: os.NewSyscallError("connect", faults.dialErrno())}
+	}
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if packetConn, isPacketConn := conn.(net.PacketConn); isPacketConn && network.Protocol == meta.ProtocolUDP {
+		return &udpConn{PacketConn: NewPacketConn(packetConn, d.injector), conn: conn}, nil
+	}
+	return NewConn(conn, d.injector, address), nil
+}
+
+func (d *Dialer) ListenPacket(ctx context.Context, address addrs.Socksaddr) (net.PacketConn, error) {
+	conn, err := d.dialer.ListenPacket(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewPacketConn(conn, d.injector), nil
+}
+
+// udpConn is a connected udp conn with packet faults.
+type udpConn struct {
+	*PacketConn
+	conn net.Conn
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	return c.writeTo(p, c.conn.RemoteAddr(), c.conn.Write)
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
@@ -0,0 +1,244 @@
+package fault
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio/pipe"
+	"github.com/qtraffics/qnetwork/vnet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var destination = addrs.FromAddrPort(netip.MustParseAddrPort("10.0.0.2:80"))
+
+func TestInjectorLookup(t *testing.T) {
+	injector := NewInjector(1)
+	injector.SetDefault(Faults{Drop: 0.1})
+	injector.SetPrefix(netip.MustParsePrefix("10.0.0.0/8"), Faults{Drop: 0.2})
+	injector.SetPrefix(netip.MustParsePrefix("10.0.0.0/24"), Faults{Drop: 0.3})
+	injector.Set(addrs.Socksaddr{Addr: netip.MustParseAddr("10.0.0.2")}, Faults{Drop: 0.4})
+	injector.Set(destination, Faults{Drop: 0.5})
+	injector.Set(addrs.Socksaddr{Fqdn: "example.com"}, Faults{Drop: 0.6})
+
+	for address, drop := range map[string]float64{
+		"10.0.0.2:80":       0.5,
+		"10.0.0.2:443":      0.4,
+		"[::ffff:10.0.0.2]": 0.4,
+		"10.0.0.3:80":       0.3,
+		"10.1.0.1:80":       0.2,
+		"192.0.2.1:80":      0.1,
+		"example.com:443":   0.6,
+		"example.org:443":   0.1,
+	} {
+		assert.Equal(t, drop, injector.Faults(addrs.FromParseSocksaddr(address)).Drop, address)
+	}
+	injector.Reset()
+	assert.Equal(t, Faults{}, injector.Faults(destination))
+}
+
+func TestDialer(t *testing.T) {
+	network := vnet.New(1)
+	listener, err := network.Listen(destination)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	injector := NewInjector(1)
+	injector.Set(destination, Faults{DialDelay: 20 * time.Millisecond, DialFailure: 1, DialErrno: syscall.ENETUNREACH})
+	faultDialer := NewDialer(network.Host(netip.MustParseAddr("10.0.0.1")), injector)
+	start := time.Now()
+	_, err = faultDialer.DialContext(context.Background(), meta.NetworkTCP, destination)
+	assert.True(t, errors.Is(err, syscall.ENETUNREACH))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// the faults change at runtime
+	injector.Set(destination, Faults{})
+	conn, err := faultDialer.DialContext(context.Background(), meta.NetworkTCP, destination)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func dialResults(seed uint64) []bool {
+	injector := NewInjector(seed)
+	injector.SetDefault(Faults{DialFailure: 0.5, DialErrno: syscall.EHOSTUNREACH})
+	faultDialer := NewDialer(vnet.New(1).Host(netip.MustParseAddr("10.0.0.1")), injector)
+	results := make([]bool, 32)
+	for i := range results {
+		_, err := faultDialer.DialContext(context.Background(), meta.NetworkTCP, destination)
+		// nothing listens, so the dials passing the injector are refused by the network
+		results[i] = errors.Is(err, syscall.EHOSTUNREACH)
+	}
+	return results
+}
+
+func TestSeed(t *testing.T) {
+	assert.Equal(t, dialResults(7), dialResults(7))
+	assert.NotEqual(t, dialResults(7), dialResults(8))
+}
+
+func newConnPair(injector *Injector) (*Conn, net.Conn) {
+	client, server := pipe.BufferedPipe(nil, nil, 0)
+	return NewConn(client, injector, destination), server
+}
+
+func TestReset(t *testing.T) {
+	injector := NewInjector(1)
+	injector.Set(destination, Faults{ResetAfter: 10})
+	conn, server := newConnPair(injector)
+	defer server.Close()
+
+	n, err := conn.Write(make([]byte, 20))
+	assert.Equal(t, 10, n)
+	assert.True(t, errors.Is(err, syscall.ECONNRESET))
+	_, err = conn.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, syscall.ECONNRESET))
+	data, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.Len(t, data, 10)
+}
+
+func TestTruncateWrite(t *testing.T) {
+	injector := NewInjector(1)
+	injector.Set(destination, Faults{TruncateWrite: 1})
+	conn, server := newConnPair(injector)
+	defer server.Close()
+	defer conn.Close()
+
+	n, err := conn.Write(make([]byte, 100))
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Less(t, n, 100)
+	assert.Positive(t, n)
+}
+
+func TestBlackhole(t *testing.T) {
+	injector := NewInjector(1)
+	injector.Set(destination, Faults{BlackholeAfter: 5})
+	conn, server := newConnPair(injector)
+	defer server.Close()
+	defer conn.Close()
+
+	for _, message := range []string{"hello", "world"} {
+		n, err := conn.Write([]byte(message))
+		require.NoError(t, err)
+		assert.Equal(t, len(message), n)
+	}
+	_, err := server.Write([]byte("ignored"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 16))
+	assert.True(t, isTimeout(err), "reads are discarded until the deadline")
+
+	require.NoError(t, conn.UnderlayConn().(interface{ CloseWrite() error }).CloseWrite())
+	data, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// a packet conn counts the bytes of its datagrams
+	clientAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	client, packetServer := pipe.PacketPipe(clientAddr, destination.UDPAddr(), 0)
+	defer packetServer.Close()
+	packetConn := NewPacketConn(client, injector)
+	defer packetConn.Close()
+	for _, message := range []string{"hello", "world"} {
+		n, err := packetConn.WriteTo([]byte(message), destination.UDPAddr())
+		require.NoError(t, err)
+		assert.Equal(t, len(message), n)
+	}
+	buffer := make([]byte, 16)
+	require.NoError(t, packetServer.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	n, _, err := packetServer.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer[:n]))
+	_, _, err = packetServer.ReadFrom(buffer)
+	assert.True(t, isTimeout(err), "the second datagram is swallowed")
+
+	_, err = packetServer.WriteTo([]byte("ignored"), clientAddr)
+	require.NoError(t, err)
+	require.NoError(t, packetConn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, _, err = packetConn.ReadFrom(buffer)
+	assert.True(t, isTimeout(err), "reads are discarded until the deadline")
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestThrottle(t *testing.T) {
+	injector := NewInjector(1)
+	injector.Set(destination, Faults{Throttle: 100 << 10, WriteLatency: 10 * time.Millisecond})
+	conn, server := newConnPair(injector)
+	defer server.Close()
+	defer conn.Close()
+	go io.Copy(io.Discard, server)
+
+	start := time.Now()
+	_, err := conn.Write(make([]byte, 20<<10))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestPacketConn(t *testing.T) {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	client, server := pipe.PacketPipe(clientAddr, destination.UDPAddr(), 0)
+	defer server.Close()
+	injector := NewInjector(1)
+	conn := NewPacketConn(client, injector)
+	defer conn.Close()
+	buffer := make([]byte, 16)
+	readPacket := func() string {
+		require.NoError(t, server.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+		n, _, err := server.ReadFrom(buffer)
+		if err != nil {
+			return ""
+		}
+		return string(buffer[:n])
+	}
+
+	injector.Set(destination, Faults{Drop: 1})
+	_, err := conn.WriteTo([]byte("drop"), destination.UDPAddr())
+	require.NoError(t, err)
+	assert.Empty(t, readPacket())
+
+	injector.Set(destination, Faults{Duplicate: 1})
+	_, err = conn.WriteTo([]byte("twice"), destination.UDPAddr())
+	require.NoError(t, err)
+	assert.Equal(t, "twice", readPacket())
+	assert.Equal(t, "twice", readPacket())
+
+	injector.Set(destination, Faults{Corrupt: 1})
+	_, err = conn.WriteTo([]byte("intact"), destination.UDPAddr())
+	require.NoError(t, err)
+	corrupted := readPacket()
+	assert.Len(t, corrupted, len("intact"))
+	assert.NotEqual(t, "intact", corrupted)
+
+	// inbound faults are looked up by the source
+	_, err = server.WriteTo([]byte("reply"), clientAddr)
+	require.NoError(t, err)
+	injector.Set(destination, Faults{Duplicate: 1})
+	for range 2 {
+		n, from, err := conn.ReadFrom(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "reply", string(buffer[:n]))
+		assert.Equal(t, destination.UDPAddr().String(), from.String())
+	}
+}
@@ -0,0 +1,161 @@
+// Package fault injects network faults into dialers, conns and packet conns for chaos testing.
+//
+// An Injector holds the Faults to apply per destination and can be changed at runtime,
+// wrapped conns look the faults up on every operation. All random decisions are drawn
+// from a seeded source, so a run can be reproduced with the same seed.
+package fault
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+)
+
+// Faults is the set of faults applied to a destination, the zero value injects nothing.
+type Faults struct {
+	// DialDelay delays every dial.
+	DialDelay time.Duration
+	// DialFailure is the probability in [0, 1] a dial fails with DialErrno, default to ECONNREFUSED.
+	DialFailure float64
+	DialErrno   syscall.Errno
+
+	// ReadLatency and WriteLatency delay every read and write.
+	ReadLatency  time.Duration
+	WriteLatency time.Duration
+	// Throttle limits the bytes per second read and written by each conn, zero means unlimited.
+	Throttle uint64
+
+	// ResetAfter resets a stream conn with ECONNRESET once this many bytes have been read and written.
+	ResetAfter int64
+	// TruncateWrite is the probability in [0, 1] a stream write only sends a random part of its buffer
+	// and fails with io.ErrShortWrite.
+	TruncateWrite float64
+	// BlackholeAfter silently swallows all traffic of a conn once this many bytes have been read and written:
+	// writes succeed without sending and reads discard what arrives.
+	BlackholeAfter int64
+
+	// Drop, Duplicate and Corrupt are the probabilities in [0, 1] a datagram is dropped,
+	// delivered twice or delivered with a flipped byte.
+	Drop      float64
+	Duplicate float64
+	Corrupt   float64
+}
+
+func (f Faults) dialErrno() syscall.Errno {
+	if f.DialErrno != 0 {
+		return f.DialErrno
+	}
+	return syscall.ECONNREFUSED
+}
+
+type Injector struct {
+	access      sync.RWMutex
+	defaults    Faults
+	destination map[netip.AddrPort]Faults
+	domain      map[string]Faults
+	prefix      map[netip.Prefix]Faults
+
+	randAccess sync.Mutex
+	rand       *rand.Rand
+}
+
+// NewInjector creates an injector whose random decisions are derived from seed.
+func NewInjector(seed uint64) *Injector {
+	return &Injector{
+		destination: make(map[netip.AddrPort]Faults),
+		domain:      make(map[string]Faults),
+		prefix:      make(map[netip.Prefix]Faults),
+		rand:        rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+// SetDefault sets the faults of destinations without faults of their own.
+func (i *Injector) SetDefault(faults Faults) {
+	i.access.Lock()
+	defer i.access.Unlock()
+	i.defaults = faults
+}
+
+// Set sets the faults of destination, a domain or address with a zero port matches all ports.
+func (i *Injector) Set(destination addrs.Socksaddr, faults Faults) {
+	i.access.Lock()
+	defer i.access.Unlock()
+	if destination.FqdnOnly() {
+		i.domain[destination.String()] = faults
+	} else {
+		i.destination[unmap(destination.AddrPort())] = faults
+	}
+}
+
+// SetPrefix sets the faults of all addresses within prefix, the longest prefix wins.
+func (i *Injector) SetPrefix(prefix netip.Prefix, faults Faults) {
+	i.access.Lock()
+	defer i.access.Unlock()
+	i.prefix[prefix.Masked()] = faults
+}
+
+// Reset removes all faults.
+func (i *Injector) Reset() {
+	i.access.Lock()
+	defer i.access.Unlock()
+	i.defaults = Faults{}
+	clear(i.destination)
+	clear(i.domain)
+	clear(i.prefix)
+}
+
+// Faults returns the faults of destination: the exact address, the address on any port,
+// the longest matching prefix, then the default.
+func (i *Injector) Faults(destination addrs.Socksaddr) Faults {
+	i.access.RLock()
+	defer i.access.RUnlock()
+	if destination.FqdnOnly() {
+		for _, key := range [...]string{destination.String(), destination.NoPort().String()} {
+			if faults, loaded := i.domain[key]; loaded {
+				return faults
+			}
+		}
+		return i.defaults
+	}
+	addrPort := unmap(destination.AddrPort())
+	for _, key := range [...]netip.AddrPort{addrPort, netip.AddrPortFrom(addrPort.Addr(), 0)} {
+		if faults, loaded := i.destination[key]; loaded {
+			return faults
+		}
+	}
+	var (
+		matched netip.Prefix
+		faults  = i.defaults
+	)
+	for prefix, prefixFaults := range i.prefix {
+		if prefix.Contains(addrPort.Addr()) && (!matched.IsValid() || prefix.Bits() > matched.Bits()) {
+			matched, faults = prefix, prefixFaults
+		}
+	}
+	return faults
+}
+
+// chance reports true with probability p.
+func (i *Injector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	i.randAccess.Lock()
+	defer i.randAccess.Unlock()
+	return i.rand.Float64() < p
+}
+
+// intN returns a random number in [0, n).
+func (i *Injector) intN(n int) int {
+	i.randAccess.Lock()
+	defer i.randAccess.Unlock()
+	return i.rand.IntN(n)
+}
+
+func unmap(addrPort netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
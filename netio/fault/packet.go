@@ -0,0 +1,151 @@
+package fault
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netio"
+)
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// PacketConn injects faults into a packet conn, looked up by the destination of each
+// written datagram and the source of each read one.
+type PacketConn struct {
+	net.PacketConn
+	injector *Injector
+
+	transferred atomic.Int64
+	limiter     *netio.Limiter
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	// duplicate is the copy of the last read datagram to be returned by the next read.
+	access    sync.Mutex
+	duplicate []byte
+	from      net.Addr
+}
+
+// NewPacketConn wraps conn with the faults of injector.
+func NewPacketConn(conn net.PacketConn, injector *Injector) *PacketConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PacketConn{
+		PacketConn: conn,
+		injector:   injector,
+		limiter:    netio.NewLimiter(0, 0),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.access.Lock()
+	if c.duplicate != nil {
+		n, from := copy(p, c.duplicate), c.from
+		c.duplicate, c.from = nil, nil
+		c.access.Unlock()
+		return n, from, nil
+	}
+	c.access.Unlock()
+	for {
+		n, from, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, from, err
+		}
+		faults := c.injector.Faults(socksaddr(from))
+		if blackholed(c.transferred.Load(), faults) || c.injector.chance(faults.Drop) {
+			// discard what arrives, the deadline of the inner conn still applies.
+			continue
+		}
+		c.transferred.Add(int64(n))
+		if err = c.throttle(n, faults); err != nil {
+			return 0, nil, err
+		}
+		if !sleep(c.ctx, faults.ReadLatency) {
+			return 0, nil, net.ErrClosed
+		}
+		if c.injector.chance(faults.Corrupt) {
+			c.corrupt(p[:n])
+		}
+		if c.injector.chance(faults.Duplicate) {
+			c.access.Lock()
+			c.duplicate, c.from = append([]byte(nil), p[:n]...), from
+			c.access.Unlock()
+		}
+		return n, from, nil
+	}
+}
+
+// WriteTo reports dropped datagrams as sent, like a lossy network.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.writeTo(p, addr, func(data []byte) (int, error) {
+		return c.PacketConn.WriteTo(data, addr)
+	})
+}
+
+func (c *PacketConn) writeTo(p []byte, addr net.Addr, write func(data []byte) (int, error)) (int, error) {
+	faults := c.injector.Faults(socksaddr(addr))
+	if blackholed(c.transferred.Load(), faults) || c.injector.chance(faults.Drop) {
+		return len(p), nil
+	}
+	if err := c.throttle(len(p), faults); err != nil {
+		return 0, err
+	}
+	if !sleep(c.ctx, faults.WriteLatency) {
+		return 0, net.ErrClosed
+	}
+	data := p
+	if c.injector.chance(faults.Corrupt) {
+		data = append([]byte(nil), p...)
+		c.corrupt(data)
+	}
+	n, err := write(data)
+	if err != nil {
+		return n, err
+	}
+	c.transferred.Add(int64(n))
+	if c.injector.chance(faults.Duplicate) {
+		_, _ = write(data)
+	}
+	return n, nil
+}
+
+// corrupt flips a random byte of data.
+func (c *PacketConn) corrupt(data []byte) {
+	if len(data) > 0 {
+		data[c.injector.intN(len(data))] ^= 0xff
+	}
+}
+
+func (c *PacketConn) throttle(n int, faults Faults) error {
+	if faults.Throttle == 0 {
+		return nil
+	}
+	if c.limiter.Limit() != faults.Throttle {
+		c.limiter.SetLimit(faults.Throttle)
+		c.limiter.SetBurst(int(max(faults.Throttle/10, 1)))
+	}
+	if err := c.limiter.WaitN(c.ctx, n); err != nil {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (c *PacketConn) Close() error {
+	c.cancel()
+	return c.PacketConn.Close()
+}
+
+func (c *PacketConn) UnderlayPacketConn() net.PacketConn {
+	return c.PacketConn
+}
+
+func socksaddr(addr net.Addr) addrs.Socksaddr {
+	if address, isSocksaddr := addr.(addrs.Socksaddr); isSocksaddr {
+		return address
+	}
+	return addrs.FromNetAddr(addr)
+}
@@ -0,0 +1,126 @@
+package mux
+
+import (
+	"encoding/binary"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+// A frame is a 12 bytes header followed by length bytes of payload for data frames:
+//
+//	version(1) type(1) flags(2) stream id(4) length(4)
+//
+// The length of a window update is the window increment, of a ping its opaque value
+// and of a go away its code.
+const (
+	protocolVersion = 0
+	headerLength    = 12
+
+	// initialWindow is the receive window every stream starts with.
+	initialWindow = 256 << 10
+	// maxFrameSize is the largest payload of a data frame.
+	maxFrameSize = 32 << 10
+)
+
+const (
+	typeData uint8 = iota
+	typeWindowUpdate
+	typePing
+	typeGoAway
+)
+
+const (
+	// flagSYN opens a stream or starts a ping.
+	flagSYN uint16 = 1 << iota
+	// flagACK acknowledges a stream or answers a ping.
+	flagACK
+	// flagFIN half closes a stream.
+	flagFIN
+	// flagRST resets a stream.
+	flagRST
+)
+
+const (
+	goAwayNormal uint32 = iota
+	goAwayProtocolError
+	goAwayInternalError
+)
+
+type header [headerLength]byte
+
+func newHeader(frameType uint8, flags uint16, streamID uint32, length uint32) header {
+	var h header
+	h[0] = protocolVersion
+	h[1] = frameType
+	binary.BigEndian.PutUint16(h[2:], flags)
+	binary.BigEndian.PutUint32(h[4:], streamID)
+	binary.BigEndian.PutUint32(h[8:], length)
+	return h
+}
+
+func (h header) version() uint8 {
+	return h[0]
+}
+
+func (h header) frameType() uint8 {
+	return h[1]
+}
+
+func (h header) flags() uint16 {
+	return binary.BigEndian.Uint16(h[2:])
+}
+
+func (h header) streamID() uint32 {
+	return binary.BigEndian.Uint32(h[4:])
+}
+
+func (h header) length() uint32 {
+	return binary.BigEndian.Uint32(h[8:])
+}
+
+// The payload of the frame opening a stream is its network and destination:
+//
+//	protocol(1) version(1) socks address
+const (
+	networkTCP = 1
+	networkUDP = 2
+)
+
+func appendRequest(b []byte, network meta.Network, destination addrs.Socksaddr) ([]byte, error) {
+	switch network.Protocol {
+	case meta.ProtocolTCP:
+		b = append(b, networkTCP)
+	case meta.ProtocolUDP:
+		b = append(b, networkUDP)
+	default:
+		return nil, ex.New("mux: not supported network: ", network.String())
+	}
+	b = append(b, byte(network.Version))
+	return addrs.AppendSocksaddr(b, destination)
+}
+
+func parseRequest(b []byte) (meta.Network, addrs.Socksaddr, error) {
+	if len(b) < 2 {
+		return meta.Network{}, addrs.Socksaddr{}, ErrProtocol
+	}
+	var network meta.Network
+	switch b[0] {
+	case networkTCP:
+		network.Protocol = meta.ProtocolTCP
+	case networkUDP:
+		network.Protocol = meta.ProtocolUDP
+	default:
+		return meta.Network{}, addrs.Socksaddr{}, ErrProtocol
+	}
+	network.Version = meta.NetworkVersion(b[1])
+	if !network.IsValid() {
+		return meta.Network{}, addrs.Socksaddr{}, ErrProtocol
+	}
+	destination, n, err := addrs.ParseSocksaddr(b[2:])
+	if err != nil || 2+n != len(b) {
+		return meta.Network{}, addrs.Socksaddr{}, ErrProtocol
+	}
+	return network, destination, nil
+}
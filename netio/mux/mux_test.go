@@ -0,0 +1,197 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio/pipe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var destination = addrs.FromParseSocksaddr("example.com:443")
+
+func newSessionPair(t *testing.T, clientOption Option, serverOption Option) (*Session, *Session) {
+	clientConn, serverConn := pipe.BufferedPipe(nil, nil, 0)
+	client, err := Client(clientConn, clientOption)
+	require.NoError(t, err)
+	server, err := Server(serverConn, serverOption)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStream(t *testing.T) {
+	client, server := newSessionPair(t, Option{}, Option{StreamWindow: 512 << 10})
+	ctx := context.Background()
+
+	payload := make([]byte, 4<<20)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+	go func() {
+		conn, err := client.DialContext(ctx, meta.NetworkTCP, destination)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write(payload)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.(*Stream).CloseWrite())
+		reply, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "done", string(reply))
+	}()
+
+	stream, err := server.AcceptStream()
+	require.NoError(t, err)
+	assert.Equal(t, meta.NetworkTCP, stream.Network())
+	assert.Equal(t, destination, stream.Destination())
+	// read slowly at first, the writer must be stopped by the window
+	time.Sleep(20 * time.Millisecond)
+	data, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(payload, data))
+
+	// the other direction is still open after the half close
+	_, err = stream.Write([]byte("done"))
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseWrite())
+	require.Eventually(t, func() bool {
+		return server.NumStreams() == 0 && client.NumStreams() == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestMaxStreams(t *testing.T) {
+	client, server := newSessionPair(t, Option{MaxStreams: 2}, Option{MaxStreams: 1})
+	ctx := context.Background()
+
+	first, err := client.Open(ctx, meta.NetworkTCP, destination)
+	require.NoError(t, err)
+	_, err = server.AcceptStream()
+	require.NoError(t, err)
+
+	// the server resets the streams beyond its limit
+	second, err := client.Open(ctx, meta.NetworkUDP, destination)
+	require.NoError(t, err)
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+
+	_, err = client.Open(ctx, meta.NetworkTCP, destination)
+	require.NoError(t, err)
+	_, err = client.Open(ctx, meta.NetworkTCP, destination)
+	assert.Equal(t, ErrTooManyStreams, err)
+	require.NoError(t, first.Close())
+}
+
+func TestDeadline(t *testing.T) {
+	client, server := newSessionPair(t, Option{}, Option{})
+	stream, err := client.Open(context.Background(), meta.NetworkTCP, destination)
+	require.NoError(t, err)
+	_, err = server.AcceptStream()
+	require.NoError(t, err)
+
+	require.NoError(t, stream.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = stream.Read(make([]byte, 1))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestShutdown(t *testing.T) {
+	client, server := newSessionPair(t, Option{}, Option{})
+	ctx := context.Background()
+	stream, err := client.Open(ctx, meta.NetworkTCP, destination)
+	require.NoError(t, err)
+	accepted, err := server.AcceptStream()
+	require.NoError(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := client.Open(ctx, meta.NetworkTCP, destination)
+		return err == ErrGoAway
+	}, time.Second, time.Millisecond)
+
+	// the open stream still works
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+	buffer := make([]byte, 4)
+	_, err = io.ReadFull(accepted, buffer)
+	require.NoError(t, err)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown before the streams are closed")
+	default:
+	}
+
+	require.NoError(t, stream.CloseWrite())
+	require.NoError(t, accepted.CloseWrite())
+	select {
+	case err = <-shutdown:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown not finished")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	clientConn, serverConn := pipe.BufferedPipe(nil, nil, 0)
+	defer serverConn.Close()
+	go io.Copy(io.Discard, serverConn)
+	client, err := Client(clientConn, Option{KeepAliveInterval: 10 * time.Millisecond, KeepAliveTimeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = client.Accept()
+	assert.Equal(t, ErrKeepAliveTimeout, err)
+
+	// the peer never reads, the ping is stuck writing
+	clientConn, serverConn = net.Pipe()
+	defer serverConn.Close()
+	client, err = Client(clientConn, Option{KeepAliveInterval: 10 * time.Millisecond, KeepAliveTimeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := client.Accept()
+		accepted <- err
+	}()
+	select {
+	case err = <-accepted:
+		assert.Equal(t, ErrKeepAliveTimeout, err)
+	case <-time.After(time.Second):
+		t.Fatal("keepalive blocked by a stuck peer")
+	}
+
+	client, server := newSessionPair(t, Option{}, Option{})
+	_, err = client.Ping(context.Background())
+	require.NoError(t, err)
+	_, err = server.Ping(context.Background())
+	require.NoError(t, err)
+}
+
+func TestStreamExhausted(t *testing.T) {
+	client, server := newSessionPair(t, Option{}, Option{})
+	client.nextID = math.MaxUint32 - 2
+	for _, id := range []uint32{math.MaxUint32 - 2, math.MaxUint32} {
+		stream, err := client.Open(context.Background(), meta.NetworkTCP, destination)
+		require.NoError(t, err)
+		assert.Equal(t, id, stream.id)
+		accepted, err := server.AcceptStream()
+		require.NoError(t, err)
+		assert.Equal(t, id, accepted.id)
+	}
+	_, err := client.Open(context.Background(), meta.NetworkTCP, destination)
+	assert.Equal(t, ErrStreamExhausted, err)
+}
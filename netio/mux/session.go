@@ -0,0 +1,485 @@
+// Package mux runs many streams over a single net.Conn.
+//
+// Each stream has its own flow control window, so a slow reader only stalls its own stream.
+// A Session is symmetric: both sides can open streams, as a dialer.Dialer carrying the
+// destination of each stream, and accept them, as a net.Listener. Keepalive pings close
+// a dead session, GoAway stops new streams while the open ones finish.
+package mux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/ex"
+	"github.com/qtraffics/qtfra/values"
+)
+
+var (
+	_ dialer.Dialer = (*Session)(nil)
+	_ net.Listener  = (*Session)(nil)
+)
+
+var (
+	ErrProtocol         = ex.New("mux: protocol error")
+	ErrGoAway           = ex.New("mux: session is going away")
+	ErrTooManyStreams   = ex.New("mux: too many streams")
+	ErrStreamReset      = ex.New("mux: stream reset")
+	ErrKeepAliveTimeout = ex.New("mux: keepalive timeout")
+	ErrStreamExhausted  = ex.New("mux: stream ids exhausted")
+)
+
+type Option struct {
+	// MaxStreams limits the streams open at once, streams opened by the peer beyond
+	// the limit are reset. Default to netvars.DefaultMuxMaxStreams.
+	MaxStreams int
+	// StreamWindow is the receive window of each stream, at least and default to 256KiB.
+	StreamWindow uint32
+	// AcceptBacklog is the number of streams waiting for Accept, default to netvars.DefaultMuxAcceptBacklog.
+	AcceptBacklog int
+
+	// KeepAliveInterval is the period of the pings, a negative value disables them.
+	// The session is closed when a ping is not answered within KeepAliveTimeout.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+type Session struct {
+	conn   net.Conn
+	option Option
+
+	access       sync.Mutex
+	streams      map[uint32]*Stream
+	nextID       uint32
+	exhausted    bool
+	goAwayLocal  bool
+	goAwayRemote bool
+	idle         chan struct{}
+
+	pingAccess sync.Mutex
+	pings      map[uint32]chan struct{}
+	pingID     uint32
+
+	writeAccess sync.Mutex
+	accept      chan *Stream
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// Client starts a session on the client end of conn, whose streams have odd ids.
+func Client(conn net.Conn, option Option) (*Session, error) {
+	return newSession(conn, option, 1)
+}
+
+// Server starts a session on the server end of conn, whose streams have even ids.
+func Server(conn net.Conn, option Option) (*Session, error) {
+	return newSession(conn, option, 2)
+}
+
+func newSession(conn net.Conn, option Option, firstID uint32) (*Session, error) {
+	option.MaxStreams = values.UseDefault(option.MaxStreams, netvars.DefaultMuxMaxStreams)
+	option.StreamWindow = values.UseDefault(option.StreamWindow, netvars.DefaultMuxStreamWindow)
+	option.AcceptBacklog = values.UseDefault(option.AcceptBacklog, netvars.DefaultMuxAcceptBacklog)
+	option.KeepAliveInterval = values.UseDefault(option.KeepAliveInterval, netvars.DefaultMuxKeepAliveInterval)
+	option.KeepAliveTimeout = values.UseDefault(option.KeepAliveTimeout, netvars.DefaultMuxKeepAliveTimeout)
+	if option.MaxStreams < 0 || option.AcceptBacklog < 0 {
+		return nil, ex.New("mux: negative limit")
+	}
+	if option.StreamWindow < initialWindow {
+		return nil, ex.New("mux: stream window less than ", initialWindow)
+	}
+	s := &Session{
+		conn:    conn,
+		option:  option,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		idle:    make(chan struct{}, 1),
+		pings:   make(map[uint32]chan struct{}),
+		accept:  make(chan *Stream, option.AcceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go s.recvLoop()
+	if option.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s, nil
+}
+
+// Open opens a stream to destination, it does not wait for the peer to acknowledge it.
+func (s *Session) Open(ctx context.Context, network meta.Network, destination addrs.Socksaddr) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	request, err := appendRequest(nil, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	s.access.Lock()
+	switch {
+	case s.isClosed():
+		s.access.Unlock()
+		return nil, s.closeErr()
+	case s.goAwayLocal || s.goAwayRemote:
+		s.access.Unlock()
+		return nil, ErrGoAway
+	case len(s.streams) >= s.option.MaxStreams:
+		s.access.Unlock()
+		return nil, ErrTooManyStreams
+	case s.exhausted:
+		s.access.Unlock()
+		return nil, ErrStreamExhausted
+	}
+	stream := newStream(s, s.nextID, network, destination)
+	// the ids never wrap around, which would reuse the id of a live stream
+	if s.nextID > math.MaxUint32-2 {
+		s.exhausted = true
+	} else {
+		s.nextID += 2
+	}
+	s.streams[stream.id] = stream
+	s.access.Unlock()
+
+	if err = s.writeFrame(typeData, flagSYN, stream.id, request); err != nil {
+		s.removeStream(stream.id)
+		return nil, err
+	}
+	if err = stream.growWindow(); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// DialContext opens a stream to address, see Open.
+func (s *Session) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	return s.Open(ctx, network, address)
+}
+
+func (s *Session) ListenPacket(ctx context.Context, address addrs.Socksaddr) (net.PacketConn, error) {
+	return nil, ex.New("mux: packet conn not supported")
+}
+
+// Accept waits for a stream opened by the peer, the stream tells its network and destination.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return len(s.streams)
+}
+
+// GoAway tells the peer not to open new streams and resets the streams it opens from now on.
+// The open streams are not affected.
+func (s *Session) GoAway() error {
+	s.access.Lock()
+	if s.goAwayLocal {
+		s.access.Unlock()
+		return nil
+	}
+	s.goAwayLocal = true
+	s.access.Unlock()
+	return s.writeFrame(typeGoAway, 0, 0, nil, goAwayNormal)
+}
+
+// Shutdown sends GoAway, waits for the open streams to be closed or ctx to be done,
+// then closes the session.
+func (s *Session) Shutdown(ctx context.Context) error {
+	if err := s.GoAway(); err != nil {
+		_ = s.Close()
+		return err
+	}
+	for s.NumStreams() > 0 {
+		select {
+		case <-s.idle:
+		case <-s.done:
+			return s.closeErr()
+		case <-ctx.Done():
+			_ = s.Close()
+			return ctx.Err()
+		}
+	}
+	return s.Close()
+}
+
+// Ping sends a ping and waits for its answer, it returns the round trip time.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	answer := make(chan struct{})
+	s.pingAccess.Lock()
+	id := s.pingID
+	s.pingID++
+	s.pings[id] = answer
+	s.pingAccess.Unlock()
+	defer func() {
+		s.pingAccess.Lock()
+		delete(s.pings, id)
+		s.pingAccess.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(typePing, flagSYN, 0, nil, id); err != nil {
+		return 0, err
+	}
+	select {
+	case <-answer:
+		return time.Since(start), nil
+	case <-s.done:
+		return 0, s.closeErr()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.option.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), s.option.KeepAliveTimeout)
+			// the ping may be blocked writing to a stuck peer, closing the session unblocks it
+			stop := context.AfterFunc(ctx, func() {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					s.closeWithError(ErrKeepAliveTimeout)
+				}
+			})
+			_, err := s.Ping(ctx)
+			stop()
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				s.closeWithError(ErrKeepAliveTimeout)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close closes the session and all its streams.
+func (s *Session) Close() error {
+	s.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		_ = s.conn.Close()
+	})
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeErr returns the reason the session was closed.
+func (s *Session) closeErr() error {
+	<-s.done
+	return s.err
+}
+
+// writeFrame writes a frame, the length of frames without payload is given by value.
+func (s *Session) writeFrame(frameType uint8, flags uint16, streamID uint32, payload []byte, value ...uint32) error {
+	length := uint32(len(payload))
+	if len(value) > 0 {
+		length = value[0]
+	}
+	h := newHeader(frameType, flags, streamID, length)
+	frame := append(h[:], payload...)
+
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	if s.isClosed() {
+		return s.closeErr()
+	}
+	_, err := s.conn.Write(frame)
+	if err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, loaded := s.streams[id]; !loaded {
+		return
+	}
+	delete(s.streams, id)
+	if len(s.streams) == 0 {
+		select {
+		case s.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// recvLoop reads the frames of the peer, it must not block on writes: frames
+// answering the peer are sent from other goroutines.
+func (s *Session) recvLoop() {
+	var (
+		h       header
+		payload = make([]byte, maxFrameSize)
+	)
+	for {
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if h.version() != protocolVersion {
+			s.fail(goAwayProtocolError)
+			return
+		}
+		var err error
+		switch h.frameType() {
+		case typeData:
+			if h.length() > maxFrameSize {
+				s.fail(goAwayProtocolError)
+				return
+			}
+			data := payload[:h.length()]
+			if _, err = io.ReadFull(s.conn, data); err != nil {
+				s.closeWithError(err)
+				return
+			}
+			err = s.handleStream(h, data)
+		case typeWindowUpdate:
+			err = s.handleStream(h, nil)
+		case typePing:
+			err = s.handlePing(h)
+		case typeGoAway:
+			s.access.Lock()
+			s.goAwayRemote = true
+			s.access.Unlock()
+		default:
+			err = ErrProtocol
+		}
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				s.fail(goAwayProtocolError)
+			} else {
+				s.closeWithError(err)
+			}
+			return
+		}
+	}
+}
+
+// fail tells the peer why the session is closed and closes it.
+func (s *Session) fail(code uint32) {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = s.writeFrame(typeGoAway, 0, 0, nil, code)
+	s.closeWithError(ErrProtocol)
+}
+
+func (s *Session) handleStream(h header, data []byte) error {
+	flags := h.flags()
+	if flags&flagSYN != 0 {
+		return s.handleOpen(h.streamID(), data)
+	}
+	s.access.Lock()
+	stream := s.streams[h.streamID()]
+	s.access.Unlock()
+	if stream == nil {
+		// frames racing the close of a stream
+		return nil
+	}
+	if h.frameType() == typeWindowUpdate {
+		stream.addSendWindow(h.length())
+	} else if len(data) > 0 {
+		if err := stream.receive(data); err != nil {
+			return err
+		}
+	}
+	if flags&flagFIN != 0 {
+		stream.receiveFIN()
+	}
+	if flags&flagRST != 0 {
+		stream.receiveRST()
+	}
+	return nil
+}
+
+func (s *Session) handleOpen(id uint32, request []byte) error {
+	network, destination, err := parseRequest(request)
+	if err != nil {
+		return err
+	}
+	s.access.Lock()
+	if id == 0 || id%2 == s.nextID%2 || s.streams[id] != nil {
+		s.access.Unlock()
+		return ErrProtocol
+	}
+	if s.goAwayLocal || len(s.streams) >= s.option.MaxStreams {
+		s.access.Unlock()
+		go s.writeFrame(typeWindowUpdate, flagRST, id, nil)
+		return nil
+	}
+	stream := newStream(s, id, network, destination)
+	s.streams[id] = stream
+	s.access.Unlock()
+
+	select {
+	case s.accept <- stream:
+	default:
+		// the backlog is full
+		s.removeStream(id)
+		go s.writeFrame(typeWindowUpdate, flagRST, id, nil)
+		return nil
+	}
+	go func() {
+		if s.writeFrame(typeWindowUpdate, flagACK, id, nil) == nil {
+			_ = stream.growWindow()
+		}
+	}()
+	return nil
+}
+
+func (s *Session) handlePing(h header) error {
+	switch {
+	case h.flags()&flagSYN != 0:
+		// answer from another goroutine, the peer may be blocked writing to us
+		go s.writeFrame(typePing, flagACK, 0, nil, h.length())
+	case h.flags()&flagACK != 0:
+		s.pingAccess.Lock()
+		answer := s.pings[h.length()]
+		delete(s.pings, h.length())
+		s.pingAccess.Unlock()
+		if answer != nil {
+			close(answer)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio/pipe"
+)
+
+var _ net.Conn = (*Stream)(nil)
+
+// Stream is a logical conn of a Session.
+//
+// Close resets the stream when the peer has not finished writing, like a TCP socket
+// closed with unread data, use CloseWrite to finish writing gracefully.
+type Stream struct {
+	session     *Session
+	id          uint32
+	network     meta.Network
+	destination addrs.Socksaddr
+
+	access sync.Mutex
+	buffer bytes.Buffer
+	// recvWindow is the credit of the peer, consumed is read but not credited yet.
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+
+	finSent     bool
+	finReceived bool
+	reset       bool
+	closed      bool
+
+	readable      chan struct{}
+	writable      chan struct{}
+	writeAccess   sync.Mutex
+	readDeadline  pipe.Deadline
+	writeDeadline pipe.Deadline
+}
+
+func newStream(session *Session, id uint32, network meta.Network, destination addrs.Socksaddr) *Stream {
+	return &Stream{
+		session:       session,
+		id:            id,
+		network:       network,
+		destination:   destination,
+		recvWindow:    initialWindow,
+		sendWindow:    initialWindow,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		readDeadline:  pipe.MakeDeadline(),
+		writeDeadline: pipe.MakeDeadline(),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// ID returns the id of the stream in its session.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Network returns the network the opener asked for.
+func (s *Stream) Network() meta.Network {
+	return s.network
+}
+
+// Destination returns the destination the opener asked for.
+func (s *Stream) Destination() addrs.Socksaddr {
+	return s.destination
+}
+
+// growWindow raises the receive window from the initial window to the configured one.
+func (s *Stream) growWindow() error {
+	delta := s.session.option.StreamWindow - initialWindow
+	if delta == 0 {
+		return nil
+	}
+	s.access.Lock()
+	s.recvWindow += delta
+	s.access.Unlock()
+	return s.session.writeFrame(typeWindowUpdate, 0, s.id, nil, delta)
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	for {
+		s.access.Lock()
+		if s.closed {
+			s.access.Unlock()
+			return 0, net.ErrClosed
+		}
+		if s.buffer.Len() > 0 {
+			n, _ := s.buffer.Read(p)
+			more := s.buffer.Len() > 0
+			var credit uint32
+			s.consumed += uint32(n)
+			if !s.finReceived && !s.reset && s.consumed >= s.session.option.StreamWindow/2 {
+				credit, s.consumed = s.consumed, 0
+				s.recvWindow += credit
+			}
+			s.access.Unlock()
+			if more {
+				signal(s.readable)
+			}
+			if credit > 0 {
+				_ = s.session.writeFrame(typeWindowUpdate, 0, s.id, nil, credit)
+			}
+			return n, nil
+		}
+		reset, eof := s.reset, s.finReceived
+		s.access.Unlock()
+		switch {
+		case reset:
+			return 0, ErrStreamReset
+		case eof:
+			return 0, io.EOF
+		case s.session.isClosed():
+			return 0, s.session.closeErr()
+		}
+		deadline := s.readDeadline.Wait()
+		select {
+		case <-s.readable:
+		case <-s.session.done:
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (s *Stream) Write(p []byte) (n int, err error) {
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	for len(p) > 0 {
+		s.access.Lock()
+		switch {
+		case s.closed:
+			s.access.Unlock()
+			return n, net.ErrClosed
+		case s.reset:
+			s.access.Unlock()
+			return n, ErrStreamReset
+		case s.finSent:
+			s.access.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if s.sendWindow == 0 {
+			s.access.Unlock()
+			deadline := s.writeDeadline.Wait()
+			select {
+			case <-s.writable:
+			case <-s.session.done:
+				return n, s.session.closeErr()
+			case <-deadline:
+				return n, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		chunk := min(uint32(len(p)), s.sendWindow, maxFrameSize)
+		s.sendWindow -= chunk
+		s.access.Unlock()
+		if err = s.session.writeFrame(typeData, 0, s.id, p[:chunk]); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// CloseWrite sends EOF to the peer, which can still write to the stream.
+func (s *Stream) CloseWrite() error {
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	s.access.Lock()
+	if s.closed || s.reset || s.finSent {
+		s.access.Unlock()
+		return nil
+	}
+	s.finSent = true
+	done := s.finReceived
+	s.access.Unlock()
+	err := s.session.writeFrame(typeData, flagFIN, s.id, nil)
+	if done {
+		s.session.removeStream(s.id)
+	}
+	return err
+}
+
+func (s *Stream) Close() error {
+	s.access.Lock()
+	if s.closed {
+		s.access.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.buffer.Reset()
+	var flags uint16
+	switch {
+	case s.reset:
+	case s.finReceived && !s.finSent:
+		flags = flagFIN
+	case !s.finReceived:
+		flags = flagRST
+	}
+	s.finSent = true
+	s.access.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+	s.session.removeStream(s.id)
+	if flags != 0 {
+		return s.session.writeFrame(typeWindowUpdate, flags, s.id, nil)
+	}
+	return nil
+}
+
+// receive buffers data from the peer, exceeding the window is a protocol error.
+func (s *Stream) receive(data []byte) error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if uint32(len(data)) > s.recvWindow {
+		return ErrProtocol
+	}
+	s.recvWindow -= uint32(len(data))
+	if s.closed || s.finReceived {
+		return nil
+	}
+	s.buffer.Write(data)
+	signal(s.readable)
+	return nil
+}
+
+func (s *Stream) receiveFIN() {
+	s.access.Lock()
+	s.finReceived = true
+	done := s.finSent
+	s.access.Unlock()
+	signal(s.readable)
+	if done {
+		s.session.removeStream(s.id)
+	}
+}
+
+func (s *Stream) receiveRST() {
+	s.access.Lock()
+	s.reset = true
+	s.access.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+	s.session.removeStream(s.id)
+}
+
+func (s *Stream) addSendWindow(delta uint32) {
+	s.access.Lock()
+	s.sendWindow += delta
+	s.access.Unlock()
+	signal(s.writable)
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.Set(t)
+	s.writeDeadline.Set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Set(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Set(t)
+	return nil
+}
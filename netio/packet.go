@@ -2,7 +2,9 @@ package netio
 
 import (
 	"net"
+	"net/netip"
 
+	"github.com/qtraffics/qnetwork/addrs"
 	"github.com/qtraffics/qtfra/buf"
 	"github.com/qtraffics/qtfra/enhancements/pool"
 )
@@ -11,6 +13,18 @@ type PacketWriter interface {
 	WriteTo(bs []byte, destination net.Addr) (n int, err error)
 }
 
+// PacketReader is implemented by packet conns which hand out pooled packets directly.
+// The caller owns the returned packet and must release it by PutPacket.
+type PacketReader interface {
+	ReadPacket() (UDPPacket, error)
+}
+
+// PacketInfoWriter is implemented by packet conns which can pick the source address of each datagram,
+// see control.PacketInfo.
+type PacketInfoWriter interface {
+	WriteToFrom(bs []byte, destination net.Addr, local netip.Addr, ifIndex int) (n int, err error)
+}
+
 type BindPacketWriter struct {
 	PacketWriter
 
@@ -21,9 +35,28 @@ func (p *BindPacketWriter) WriteTo(bs []byte, destination net.Addr) (n int, err
 	return p.PacketWriter.WriteTo(bs, p.Destination)
 }
 
+func (p *BindPacketWriter) WriteToFrom(bs []byte, destination net.Addr, local netip.Addr, ifIndex int) (n int, err error) {
+	if writer, ok := p.PacketWriter.(PacketInfoWriter); ok {
+		return writer.WriteToFrom(bs, p.Destination, local, ifIndex)
+	}
+	return p.PacketWriter.WriteTo(bs, p.Destination)
+}
+
 type UDPPacket struct {
 	Buf *buf.Buffer
 	OOB []byte
+
+	// Addr is the peer of the packet: the source of a received packet,
+	// or the destination of a packet waiting to be sent.
+	Addr addrs.Socksaddr
+
+	// SegmentSize is the size of each datagram when Buf holds several of them, see BatchOptions.
+	SegmentSize int
+
+	// LocalAddr and IfIndex are the destination address and the interface a datagram was received on,
+	// or the source address and interface to send it from. See control.PacketInfo.
+	LocalAddr netip.Addr
+	IfIndex   int
 }
 
 var packetPool = pool.New[UDPPacket](func() UDPPacket {
@@ -41,5 +74,20 @@ func PutPacket(p UDPPacket) {
 	p.Buf.Free()
 	p.Buf = nil
 	p.OOB = nil
+	p.Addr = addrs.Socksaddr{}
+	p.SegmentSize = 0
+	p.LocalAddr = netip.Addr{}
+	p.IfIndex = 0
 	packetPool.Put(p)
 }
+
+// PacketAddr converts a Socksaddr to the net.Addr expected by net.PacketConn.WriteTo.
+func PacketAddr(addr addrs.Socksaddr) net.Addr {
+	if addr.FqdnOnly() {
+		if addr.Fqdn == "" {
+			return nil
+		}
+		return addr
+	}
+	return addr.UDPAddr()
+}
@@ -0,0 +1,237 @@
+package pipe
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultBufferSize is the capacity of each direction of BufferedPipe when zero is given.
+const DefaultBufferSize = 64 << 10
+
+// stream is one direction of a buffered pipe.
+type stream struct {
+	access   sync.Mutex
+	buffer   []byte
+	capacity int
+	readable chan struct{}
+	writable chan struct{}
+
+	eof    bool // the writer has finished
+	broken bool // the reader is gone
+}
+
+func newStream(capacity int) *stream {
+	return &stream{
+		capacity: capacity,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stream) read(b []byte, localDone <-chan struct{}, deadline <-chan struct{}) (int, error) {
+	for {
+		switch {
+		case isClosedChan(localDone):
+			return 0, io.ErrClosedPipe
+		case isClosedChan(deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.access.Lock()
+		if len(s.buffer) > 0 {
+			n := copy(b, s.buffer)
+			s.buffer = s.buffer[:copy(s.buffer, s.buffer[n:])]
+			more := len(s.buffer) > 0
+			s.access.Unlock()
+			signal(s.writable)
+			if more {
+				signal(s.readable)
+			}
+			return n, nil
+		}
+		eof := s.eof
+		s.access.Unlock()
+		if eof {
+			signal(s.readable)
+			return 0, io.EOF
+		}
+		select {
+		case <-s.readable:
+		case <-localDone:
+		case <-deadline:
+		}
+	}
+}
+
+func (s *stream) write(b []byte, localDone <-chan struct{}, deadline <-chan struct{}) (n int, err error) {
+	for {
+		switch {
+		case isClosedChan(localDone):
+			return n, io.ErrClosedPipe
+		case isClosedChan(deadline):
+			return n, os.ErrDeadlineExceeded
+		}
+		s.access.Lock()
+		if s.broken || s.eof {
+			s.access.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if len(b) == 0 {
+			s.access.Unlock()
+			return n, nil
+		}
+		if space := s.capacity - len(s.buffer); space > 0 {
+			nw := min(space, len(b))
+			s.buffer = append(s.buffer, b[:nw]...)
+			s.access.Unlock()
+			signal(s.readable)
+			b = b[nw:]
+			n += nw
+			continue
+		}
+		s.access.Unlock()
+		select {
+		case <-s.writable:
+		case <-localDone:
+		case <-deadline:
+		}
+	}
+}
+
+// closeWrite lets the reader drain the buffer and then read EOF.
+func (s *stream) closeWrite() {
+	s.access.Lock()
+	s.eof = true
+	s.access.Unlock()
+	signal(s.readable)
+}
+
+// closeRead drops the buffer and fails the following writes.
+func (s *stream) closeRead() {
+	s.access.Lock()
+	s.broken = true
+	s.buffer = nil
+	s.access.Unlock()
+	signal(s.writable)
+}
+
+type bufferedPipe struct {
+	wrMu sync.Mutex // Serialize Write operations
+
+	rd *stream
+	wr *stream
+
+	once      sync.Once // Protects closing localDone
+	localDone chan struct{}
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	readDeadline  Deadline
+	writeDeadline Deadline
+}
+
+// BufferedPipe creates an in-memory, full duplex network connection like Pipe,
+// but each direction buffers up to capacity bytes, so writes return as soon as
+// the data fits in the buffer. A zero capacity means DefaultBufferSize.
+//
+// Both ends support CloseWrite: the peer reads the buffered data and then io.EOF.
+// Close also sends EOF to the peer, whose following writes fail with io.ErrClosedPipe.
+// The addresses default to a "pipe" address when nil.
+func BufferedPipe(addr1 net.Addr, addr2 net.Addr, capacity int) (net.Conn, net.Conn) {
+	if capacity <= 0 {
+		capacity = DefaultBufferSize
+	}
+	if addr1 == nil {
+		addr1 = pipeAddr{}
+	}
+	if addr2 == nil {
+		addr2 = pipeAddr{}
+	}
+	s1 := newStream(capacity)
+	s2 := newStream(capacity)
+	p1 := &bufferedPipe{
+		rd: s1, wr: s2,
+		localDone: make(chan struct{}),
+		localAddr: addr1, remoteAddr: addr2,
+		readDeadline:  MakeDeadline(),
+		writeDeadline: MakeDeadline(),
+	}
+	p2 := &bufferedPipe{
+		rd: s2, wr: s1,
+		localDone: make(chan struct{}),
+		localAddr: addr2, remoteAddr: addr1,
+		readDeadline:  MakeDeadline(),
+		writeDeadline: MakeDeadline(),
+	}
+	return p1, p2
+}
+
+func (p *bufferedPipe) LocalAddr() net.Addr  { return p.localAddr }
+func (p *bufferedPipe) RemoteAddr() net.Addr { return p.remoteAddr }
+
+func (p *bufferedPipe) Read(b []byte) (int, error) {
+	n, err := p.rd.read(b, p.localDone, p.readDeadline.Wait())
+	if err != nil && err != io.EOF && err != io.ErrClosedPipe {
+		err = &net.OpError{Op: "read", Net: "pipe", Err: err}
+	}
+	return n, err
+}
+
+func (p *bufferedPipe) Write(b []byte) (int, error) {
+	p.wrMu.Lock() // Ensure entirety of b is written together
+	defer p.wrMu.Unlock()
+	n, err := p.wr.write(b, p.localDone, p.writeDeadline.Wait())
+	if err != nil && err != io.ErrClosedPipe {
+		err = &net.OpError{Op: "write", Net: "pipe", Err: err}
+	}
+	return n, err
+}
+
+func (p *bufferedPipe) SetDeadline(t time.Time) error {
+	if isClosedChan(p.localDone) {
+		return io.ErrClosedPipe
+	}
+	p.readDeadline.Set(t)
+	p.writeDeadline.Set(t)
+	return nil
+}
+
+func (p *bufferedPipe) SetReadDeadline(t time.Time) error {
+	if isClosedChan(p.localDone) {
+		return io.ErrClosedPipe
+	}
+	p.readDeadline.Set(t)
+	return nil
+}
+
+func (p *bufferedPipe) SetWriteDeadline(t time.Time) error {
+	if isClosedChan(p.localDone) {
+		return io.ErrClosedPipe
+	}
+	p.writeDeadline.Set(t)
+	return nil
+}
+
+func (p *bufferedPipe) CloseWrite() error {
+	p.wr.closeWrite()
+	return nil
+}
+
+func (p *bufferedPipe) Close() error {
+	p.once.Do(func() {
+		close(p.localDone)
+		p.rd.closeRead()
+		p.wr.closeWrite()
+	})
+	return nil
+}
@@ -0,0 +1,174 @@
+package pipe
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultPacketQueueSize is the number of datagrams queued in each direction of PacketPipe when zero is given.
+const DefaultPacketQueueSize = 64
+
+type datagram struct {
+	data []byte
+	from net.Addr
+}
+
+type packetPipe struct {
+	rdRx <-chan datagram
+	wrTx chan<- datagram
+
+	once       sync.Once // Protects closing localDone
+	localDone  chan struct{}
+	remoteDone <-chan struct{}
+
+	localAddr net.Addr
+
+	readDeadline  Deadline
+	writeDeadline Deadline
+}
+
+// PacketPipe creates an in-memory pair of packet conns, every datagram written by one end
+// is read by the other end as a whole, with the address of the writer as its source.
+// Each direction queues up to size datagrams, a zero size means DefaultPacketQueueSize,
+// writes block while the queue is full. Datagrams longer than the read buffer are truncated.
+//
+// After one end is closed, the other end reads the queued datagrams and then io.EOF,
+// and its writes fail with io.ErrClosedPipe.
+func PacketPipe(addr1 net.Addr, addr2 net.Addr, size int) (net.PacketConn, net.PacketConn) {
+	if size <= 0 {
+		size = DefaultPacketQueueSize
+	}
+	if addr1 == nil {
+		addr1 = pipeAddr{}
+	}
+	if addr2 == nil {
+		addr2 = pipeAddr{}
+	}
+	c1 := make(chan datagram, size)
+	c2 := make(chan datagram, size)
+	done1 := make(chan struct{})
+	done2 := make(chan struct{})
+
+	p1 := &packetPipe{
+		rdRx: c1, wrTx: c2,
+		localDone: done1, remoteDone: done2,
+		localAddr:     addr1,
+		readDeadline:  MakeDeadline(),
+		writeDeadline: MakeDeadline(),
+	}
+	p2 := &packetPipe{
+		rdRx: c2, wrTx: c1,
+		localDone: done2, remoteDone: done1,
+		localAddr:     addr2,
+		readDeadline:  MakeDeadline(),
+		writeDeadline: MakeDeadline(),
+	}
+	return p1, p2
+}
+
+func (p *packetPipe) LocalAddr() net.Addr { return p.localAddr }
+
+func (p *packetPipe) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := p.readFrom(b)
+	if err != nil && err != io.EOF && err != io.ErrClosedPipe {
+		err = &net.OpError{Op: "read", Net: "pipe", Err: err}
+	}
+	return n, addr, err
+}
+
+func (p *packetPipe) readFrom(b []byte) (int, net.Addr, error) {
+	switch {
+	case isClosedChan(p.localDone):
+		return 0, nil, io.ErrClosedPipe
+	case isClosedChan(p.readDeadline.Wait()):
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+
+	select {
+	case packet := <-p.rdRx:
+		return copy(b, packet.data), packet.from, nil
+	default:
+	}
+
+	select {
+	case packet := <-p.rdRx:
+		return copy(b, packet.data), packet.from, nil
+	case <-p.localDone:
+		return 0, nil, io.ErrClosedPipe
+	case <-p.remoteDone:
+		// drain what was queued before the peer closed
+		select {
+		case packet := <-p.rdRx:
+			return copy(b, packet.data), packet.from, nil
+		default:
+			return 0, nil, io.EOF
+		}
+	case <-p.readDeadline.Wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo queues b for the other end, addr is ignored as a pipe has a single peer.
+func (p *packetPipe) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := p.writeTo(b)
+	if err != nil && err != io.ErrClosedPipe {
+		err = &net.OpError{Op: "write", Net: "pipe", Addr: addr, Err: err}
+	}
+	return n, err
+}
+
+func (p *packetPipe) writeTo(b []byte) (int, error) {
+	switch {
+	case isClosedChan(p.localDone):
+		return 0, io.ErrClosedPipe
+	case isClosedChan(p.remoteDone):
+		return 0, io.ErrClosedPipe
+	case isClosedChan(p.writeDeadline.Wait()):
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	packet := datagram{data: append([]byte(nil), b...), from: p.localAddr}
+	select {
+	case p.wrTx <- packet:
+		return len(b), nil
+	case <-p.localDone:
+		return 0, io.ErrClosedPipe
+	case <-p.remoteDone:
+		return 0, io.ErrClosedPipe
+	case <-p.writeDeadline.Wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *packetPipe) SetDeadline(t time.Time) error {
+	if isClosedChan(p.localDone) {
+		return io.ErrClosedPipe
+	}
+	p.readDeadline.Set(t)
+	p.writeDeadline.Set(t)
+	return nil
+}
+
+func (p *packetPipe) SetReadDeadline(t time.Time) error {
+	if isClosedChan(p.localDone) {
+		return io.ErrClosedPipe
+	}
+	p.readDeadline.Set(t)
+	return nil
+}
+
+func (p *packetPipe) SetWriteDeadline(t time.Time) error {
+	if isClosedChan(p.localDone) {
+		return io.ErrClosedPipe
+	}
+	p.writeDeadline.Set(t)
+	return nil
+}
+
+func (p *packetPipe) Close() error {
+	p.once.Do(func() { close(p.localDone) })
+	return nil
+}
@@ -0,0 +1,105 @@
+package pipe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedPipe(t *testing.T) {
+	addr1 := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	addr2 := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	c1, c2 := BufferedPipe(addr1, addr2, 8)
+	defer c1.Close()
+	defer c2.Close()
+	assert.Equal(t, addr1, c1.LocalAddr())
+	assert.Equal(t, addr2, c1.RemoteAddr())
+	assert.Equal(t, addr1, c2.RemoteAddr())
+
+	// writes within the capacity do not wait for the reader
+	n, err := c1.Write([]byte("12345678"))
+	require.NoError(t, err)
+	assert.Equal(t, 8, n)
+
+	// a full buffer blocks until the deadline
+	require.NoError(t, c1.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = c1.Write([]byte("9"))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.NoError(t, c1.SetWriteDeadline(time.Time{}))
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := c1.Write([]byte("abcdefghij"))
+		if err == nil {
+			err = c1.(interface{ CloseWrite() error }).CloseWrite()
+		}
+		written <- err
+	}()
+	data, err := io.ReadAll(c2)
+	require.NoError(t, err)
+	assert.Equal(t, "12345678abcdefghij", string(data))
+	require.NoError(t, <-written)
+
+	// the other direction is still open after the half close
+	_, err = c2.Write([]byte("reply"))
+	require.NoError(t, err)
+	buffer := make([]byte, 16)
+	n, err = c1.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buffer[:n]))
+
+	require.NoError(t, c1.Close())
+	_, err = c2.Write([]byte("closed"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+	_, err = c1.Read(buffer)
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestPacketPipe(t *testing.T) {
+	addr1 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	addr2 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	p1, p2 := PacketPipe(addr1, addr2, 2)
+	defer p2.Close()
+
+	for _, message := range []string{"first", "second"} {
+		_, err := p1.WriteTo([]byte(message), addr2)
+		require.NoError(t, err)
+	}
+	require.NoError(t, p1.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := p1.WriteTo([]byte("third"), addr2)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.NoError(t, p1.SetWriteDeadline(time.Time{}))
+
+	buffer := make([]byte, 16)
+	n, from, err := p2.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(buffer[:n]))
+	assert.Equal(t, addr1, from)
+
+	// truncated to the read buffer
+	n, _, err = p2.ReadFrom(buffer[:3])
+	require.NoError(t, err)
+	assert.Equal(t, "sec", string(buffer[:n]))
+
+	require.NoError(t, p2.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, _, err = p2.ReadFrom(buffer)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.NoError(t, p2.SetReadDeadline(time.Time{}))
+
+	_, err = p1.WriteTo([]byte("last"), nil)
+	require.NoError(t, err)
+	require.NoError(t, p1.Close())
+	n, _, err = p2.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "last", string(buffer[:n]))
+	_, _, err = p2.ReadFrom(buffer)
+	assert.Equal(t, io.EOF, err)
+	_, err = p2.WriteTo([]byte("closed"), addr1)
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
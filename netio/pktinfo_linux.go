@@ -0,0 +1,62 @@
+package netio
+
+import (
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const packetInfoOOBSize = 64
+
+// ParsePacketInfo extracts the destination address and the interface index
+// from the IP_PKTINFO or IPV6_PKTINFO control message of a received datagram.
+func ParsePacketInfo(oob []byte) (local netip.Addr, ifIndex int, ok bool) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.Addr{}, 0, false
+	}
+	for _, message := range messages {
+		switch {
+		case message.Header.Level == unix.IPPROTO_IP && message.Header.Type == unix.IP_PKTINFO &&
+			len(message.Data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&message.Data[0]))
+			return netip.AddrFrom4(info.Addr), int(info.Ifindex), true
+		case message.Header.Level == unix.IPPROTO_IPV6 && message.Header.Type == unix.IPV6_PKTINFO &&
+			len(message.Data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&message.Data[0]))
+			return netip.AddrFrom16(info.Addr).Unmap(), int(info.Ifindex), true
+		}
+	}
+	return netip.Addr{}, 0, false
+}
+
+// AppendPacketInfo appends a control message which sends the datagram from local,
+// a non-zero ifIndex also pins the outgoing interface.
+func AppendPacketInfo(oob []byte, local netip.Addr, ifIndex int) []byte {
+	if !local.IsValid() {
+		return oob
+	}
+	if local.Is4() {
+		start := len(oob)
+		oob = append(oob, make([]byte, unix.CmsgSpace(unix.SizeofInet4Pktinfo))...)
+		header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[start]))
+		header.Level = unix.IPPROTO_IP
+		header.Type = unix.IP_PKTINFO
+		header.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&oob[start+unix.CmsgLen(0)]))
+		info.Ifindex = int32(ifIndex)
+		info.Spec_dst = local.As4()
+		return oob
+	}
+	start := len(oob)
+	oob = append(oob, make([]byte, unix.CmsgSpace(unix.SizeofInet6Pktinfo))...)
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	header.Level = unix.IPPROTO_IPV6
+	header.Type = unix.IPV6_PKTINFO
+	header.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+	info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&oob[start+unix.CmsgLen(0)]))
+	info.Ifindex = uint32(ifIndex)
+	info.Addr = local.As16()
+	return oob
+}
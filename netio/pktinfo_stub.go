@@ -0,0 +1,15 @@
+//go:build !linux
+
+package netio
+
+import "net/netip"
+
+const packetInfoOOBSize = 0
+
+func ParsePacketInfo(oob []byte) (local netip.Addr, ifIndex int, ok bool) {
+	return netip.Addr{}, 0, false
+}
+
+func AppendPacketInfo(oob []byte, local netip.Addr, ifIndex int) []byte {
+	return oob
+}
@@ -0,0 +1,135 @@
+package netio
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/qtraffics/qtfra/buf"
+	"github.com/qtraffics/qtfra/enhancements/iolib"
+)
+
+var (
+	_ net.Conn          = (*PrefixConn)(nil)
+	_ iolib.CacheReader = (*PrefixConn)(nil)
+	_ syscall.Conn      = (*PrefixConn)(nil)
+)
+
+// PrefixConn returns bytes already read from a conn before reading the conn again,
+// as left by sniffing or parsing a header.
+//
+// Writes, deadlines, CloseWrite and SyscallConn go to the inner conn. A copy using the
+// raw conn directly must take the prefix with ReadCache first, as iolib.Copy does.
+type PrefixConn struct {
+	net.Conn
+	// access guards prefix, which Close may free while another goroutine reads
+	access sync.Mutex
+	prefix *buf.Buffer
+}
+
+// NewPrefixConn returns a conn reading prefix before conn, it takes the ownership of prefix.
+func NewPrefixConn(conn net.Conn, prefix *buf.Buffer) *PrefixConn {
+	if prefix != nil && prefix.Empty() {
+		prefix.Free()
+		prefix = nil
+	}
+	return &PrefixConn{Conn: conn, prefix: prefix}
+}
+
+func (c *PrefixConn) Read(p []byte) (int, error) {
+	c.access.Lock()
+	if c.prefix == nil {
+		c.access.Unlock()
+		return c.Conn.Read(p)
+	}
+	defer c.access.Unlock()
+	n, _ := c.prefix.Read(p)
+	if c.prefix.Empty() {
+		c.prefix.Free()
+		c.prefix = nil
+	}
+	return n, nil
+}
+
+// ReadCache hands the remaining prefix over to the caller, following reads go to the inner conn.
+func (c *PrefixConn) ReadCache() (io.Reader, *buf.Buffer) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	prefix := c.prefix
+	c.prefix = nil
+	return c.Conn, prefix
+}
+
+// Buffered returns the number of prefix bytes not read yet.
+func (c *PrefixConn) Buffered() int {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.prefix == nil {
+		return 0
+	}
+	return c.prefix.Len()
+}
+
+func (c *PrefixConn) CloseWrite() error {
+	if closer, ok := c.Conn.(closeWriter); ok {
+		return closer.CloseWrite()
+	}
+	return os.ErrInvalid
+}
+
+func (c *PrefixConn) SyscallConn() (syscall.RawConn, error) {
+	if conn, ok := c.Conn.(syscall.Conn); ok {
+		return conn.SyscallConn()
+	}
+	return nil, os.ErrInvalid
+}
+
+func (c *PrefixConn) Close() error {
+	c.access.Lock()
+	if c.prefix != nil {
+		c.prefix.Free()
+		c.prefix = nil
+	}
+	c.access.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *PrefixConn) UnderlayConn() net.Conn {
+	return c.Conn
+}
+
+type underlayConn interface {
+	UnderlayConn() net.Conn
+}
+
+// UnwrapConn returns the innermost conn of a chain of wrappers exposing UnderlayConn.
+func UnwrapConn(conn net.Conn) net.Conn {
+	for {
+		wrapper, ok := conn.(underlayConn)
+		if !ok {
+			return conn
+		}
+		inner := wrapper.UnderlayConn()
+		if inner == nil {
+			return conn
+		}
+		conn = inner
+	}
+}
+
+// findCloseWriter returns the outermost conn of the wrapper chain of conn supporting half close.
+func findCloseWriter(conn net.Conn) (closeWriter, bool) {
+	for conn != nil {
+		if closer, ok := conn.(closeWriter); ok {
+			return closer, true
+		}
+		wrapper, ok := conn.(underlayConn)
+		if !ok {
+			break
+		}
+		conn = wrapper.UnderlayConn()
+	}
+	return nil, false
+}
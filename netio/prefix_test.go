@@ -0,0 +1,103 @@
+package netio
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/control"
+	"github.com/qtraffics/qtfra/buf"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	server, err := listener.Accept()
+	require.NoError(t, err)
+	return client, server
+}
+
+func TestPrefixConn(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	conn := NewPrefixConn(server, buf.As([]byte("hello ")))
+	defer conn.Close()
+	assert.Equal(t, 6, conn.Buffered())
+
+	_, err := client.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	assert.Zero(t, conn.Buffered())
+
+	// the socket stays reachable for socket options
+	_, err = control.Conn0(conn, func(fd uintptr) (int, error) {
+		return syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+	})
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	// half close reaches the peer, which can still write back
+	require.NoError(t, conn.CloseWrite())
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Same(t, server, UnwrapConn(NewRateLimitedConn(conn, nil, nil)))
+}
+
+func TestCopyConnHalfClose(t *testing.T) {
+	client, source := tcpPair(t)
+	defer client.Close()
+	destination, upstream := tcpPair(t)
+	defer upstream.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- CopyConn(context.Background(), NewPrefixConn(source, buf.As([]byte("request "))), destination)
+	}()
+	_, err := client.Write([]byte("body"))
+	require.NoError(t, err)
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+	data, err := io.ReadAll(upstream)
+	require.NoError(t, err)
+	assert.Equal(t, "request body", string(data))
+
+	// the response still flows after the request direction is closed
+	_, err = upstream.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, upstream.(*net.TCPConn).CloseWrite())
+	data, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "response", string(data))
+	require.NoError(t, <-done)
+}
+
+func TestPrefixConnCloseWhileReading(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	conn := NewPrefixConn(server, buf.As(make([]byte, 4096)))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b := make([]byte, 1)
+		for {
+			if _, err := conn.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	require.NoError(t, conn.Close())
+	<-done
+	assert.Zero(t, conn.Buffered())
+}
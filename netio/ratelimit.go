@@ -0,0 +1,312 @@
+package netio
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netio/pipe"
+)
+
+// Limiter is a token bucket counted in bytes.
+// A Limiter can be shared by any number of conns, so that all of them are capped in aggregate.
+// A nil Limiter never blocks.
+type Limiter struct {
+	access sync.Mutex
+	rate   float64 // bytes per second, zero means unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a Limiter which refills bytesPerSecond tokens per second
+// and holds at most burst tokens. The bucket starts full.
+func NewLimiter(bytesPerSecond uint64, burst int) *Limiter {
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(max(burst, 0)),
+		tokens: float64(max(burst, 0)),
+		last:   time.Now(),
+	}
+}
+
+// SetLimit changes the refill rate, zero removes the limit.
+func (l *Limiter) SetLimit(bytesPerSecond uint64) {
+	if l == nil {
+		return
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.advance(time.Now())
+	l.rate = float64(bytesPerSecond)
+}
+
+// SetBurst changes the bucket size.
+func (l *Limiter) SetBurst(burst int) {
+	if l == nil {
+		return
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.advance(time.Now())
+	l.burst = float64(max(burst, 0))
+	l.tokens = min(l.tokens, l.burst)
+}
+
+func (l *Limiter) Limit() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	return uint64(l.rate)
+}
+
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	return int(l.burst)
+}
+
+// WaitN blocks until n bytes may pass or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller must wait before using them.
+// The bucket is allowed to go into debt, so a reservation larger than burst still succeeds.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.advance(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *Limiter) advance(now time.Time) {
+	if l.rate <= 0 {
+		l.tokens = l.burst
+		l.last = now
+		return
+	}
+	elapsed := now.Sub(l.last)
+	if elapsed <= 0 {
+		return
+	}
+	l.tokens = min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+	l.last = now
+}
+
+// chunk returns the largest write that should be reserved at once.
+func (l *Limiter) chunk(n int) int {
+	if l == nil {
+		return n
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.rate <= 0 || l.burst < 1 {
+		return n
+	}
+	return min(n, int(l.burst))
+}
+
+func waitLimiter(l *Limiter, n int, done chan struct{}, deadline *pipe.Deadline) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return net.ErrClosed
+	case <-deadline.Wait():
+		return os.ErrDeadlineExceeded
+	}
+}
+
+var _ net.Conn = (*RateLimitedConn)(nil)
+
+// RateLimitedConn throttles reads and writes of a net.Conn with two independent limiters.
+// It intentionally does not expose syscall.Conn, so that copies can not bypass the limiters by splice.
+type RateLimitedConn struct {
+	net.Conn
+
+	readLimiter   *Limiter
+	writeLimiter  *Limiter
+	readDeadline  pipe.Deadline
+	writeDeadline pipe.Deadline
+	closeOnce     sync.Once
+	done          chan struct{}
+}
+
+func NewRateLimitedConn(conn net.Conn, readLimiter *Limiter, writeLimiter *Limiter) *RateLimitedConn {
+	return &RateLimitedConn{
+		Conn:          conn,
+		readLimiter:   readLimiter,
+		writeLimiter:  writeLimiter,
+		readDeadline:  pipe.MakeDeadline(),
+		writeDeadline: pipe.MakeDeadline(),
+		done:          make(chan struct{}),
+	}
+}
+
+func (c *RateLimitedConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p[:c.readLimiter.chunk(len(p))])
+	if n > 0 {
+		if waitErr := waitLimiter(c.readLimiter, n, c.done, &c.readDeadline); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *RateLimitedConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := c.writeLimiter.chunk(len(p))
+		err = waitLimiter(c.writeLimiter, chunk, c.done, &c.writeDeadline)
+		if err != nil {
+			return n, err
+		}
+		var nn int
+		nn, err = c.Conn.Write(p[:chunk])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+func (c *RateLimitedConn) CloseWrite() error {
+	if closer, ok := c.Conn.(closeWriter); ok {
+		return closer.CloseWrite()
+	}
+	return os.ErrInvalid
+}
+
+func (c *RateLimitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+func (c *RateLimitedConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *RateLimitedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *RateLimitedConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *RateLimitedConn) UnderlayConn() net.Conn {
+	return c.Conn
+}
+
+var _ net.PacketConn = (*RateLimitedPacketConn)(nil)
+
+// RateLimitedPacketConn throttles a net.PacketConn. Datagrams are never split,
+// a datagram larger than the burst puts the limiter into debt instead.
+type RateLimitedPacketConn struct {
+	net.PacketConn
+
+	readLimiter   *Limiter
+	writeLimiter  *Limiter
+	readDeadline  pipe.Deadline
+	writeDeadline pipe.Deadline
+	closeOnce     sync.Once
+	done          chan struct{}
+}
+
+func NewRateLimitedPacketConn(conn net.PacketConn, readLimiter *Limiter, writeLimiter *Limiter) *RateLimitedPacketConn {
+	return &RateLimitedPacketConn{
+		PacketConn:    conn,
+		readLimiter:   readLimiter,
+		writeLimiter:  writeLimiter,
+		readDeadline:  pipe.MakeDeadline(),
+		writeDeadline: pipe.MakeDeadline(),
+		done:          make(chan struct{}),
+	}
+}
+
+func (c *RateLimitedPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if n > 0 {
+		if waitErr := waitLimiter(c.readLimiter, n, c.done, &c.readDeadline); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, addr, err
+}
+
+func (c *RateLimitedPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	err = waitLimiter(c.writeLimiter, len(p), c.done, &c.writeDeadline)
+	if err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *RateLimitedPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.PacketConn.Close()
+}
+
+func (c *RateLimitedPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return c.PacketConn.SetDeadline(t)
+}
+
+func (c *RateLimitedPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func (c *RateLimitedPacketConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return c.PacketConn.SetWriteDeadline(t)
+}
+
+func (c *RateLimitedPacketConn) UnderlayPacketConn() net.PacketConn {
+	return c.PacketConn
+}
@@ -0,0 +1,88 @@
+package netio
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netio/pipe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterWait(t *testing.T) {
+	limiter := NewLimiter(10_000, 1000)
+	start := time.Now()
+	require.NoError(t, limiter.WaitN(context.Background(), 1000))
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "burst should pass immediately")
+
+	start = time.Now()
+	require.NoError(t, limiter.WaitN(context.Background(), 2000))
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	limiter.SetLimit(0)
+	start = time.Now()
+	require.NoError(t, limiter.WaitN(context.Background(), 1<<20))
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "unlimited limiter should not block")
+
+	// a nil limiter is unlimited and ignores the changes
+	var unlimited *Limiter
+	unlimited.SetLimit(1)
+	unlimited.SetBurst(1)
+	assert.Zero(t, unlimited.Limit())
+	assert.Zero(t, unlimited.Burst())
+	require.NoError(t, unlimited.WaitN(context.Background(), 1<<20))
+}
+
+func TestLimiterShared(t *testing.T) {
+	limiter := NewLimiter(20_000, 1000)
+	payload := make([]byte, 2000)
+
+	start := time.Now()
+	done := make(chan struct{})
+	for range 2 {
+		client, server := pipe.Pipe()
+		go func() {
+			_, _ = io.Copy(io.Discard, server)
+		}()
+		limited := NewRateLimitedConn(client, nil, limiter)
+		go func() {
+			defer limited.Close()
+			_, err := limited.Write(payload)
+			assert.NoError(t, err)
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	// 4000 bytes in total with 1000 bytes burst at 20KB/s.
+	assert.GreaterOrEqual(t, time.Since(start), 120*time.Millisecond)
+}
+
+func TestRateLimitedConnClose(t *testing.T) {
+	client, server := pipe.Pipe()
+	defer server.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, server)
+	}()
+
+	limited := NewRateLimitedConn(client, nil, NewLimiter(1, 1))
+	_, err := limited.Write([]byte{0})
+	require.NoError(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := limited.Write([]byte{0})
+		errChan <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, limited.Close())
+	select {
+	case err = <-errChan:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write not interrupted by close")
+	}
+}
@@ -0,0 +1,36 @@
+package sniff
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dnsHeaderLength = 12
+
+// DNS matches a DNS query with a single question, the domain is the name of the question.
+func DNS(packet []byte) (Result, error) {
+	if len(packet) < dnsHeaderLength || !isDNSQueryHeader(packet) {
+		return Result{}, ErrNoMatch
+	}
+	var message dns.Msg
+	// Unpack accepts a header announcing a question without its bytes
+	if message.Unpack(packet) != nil || len(message.Question) != 1 {
+		return Result{}, ErrNoMatch
+	}
+	return Result{
+		Protocol: ProtocolDNS,
+		Domain:   strings.TrimSuffix(message.Question[0].Name, "."),
+	}, nil
+}
+
+// isDNSQueryHeader checks the header is a standard query with one question and no answer.
+func isDNSQueryHeader(header []byte) bool {
+	flags := binary.BigEndian.Uint16(header[2:])
+	return flags&(1<<15) == 0 && // QR
+		(flags>>11)&0xf == dns.OpcodeQuery &&
+		binary.BigEndian.Uint16(header[4:]) == 1 && // QDCOUNT
+		binary.BigEndian.Uint16(header[6:]) == 0 && // ANCOUNT
+		binary.BigEndian.Uint16(header[8:]) == 0 // NSCOUNT
+}
@@ -0,0 +1,87 @@
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// HTTPHost extracts the host of an HTTP/1 request, the target of a CONNECT request
+// or the Host header of the others, without the port.
+func HTTPHost(data []byte) (Result, error) {
+	line, rest, complete := cutLine(data)
+	method, _, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		if complete || !isMethodPrefix(line) {
+			return Result{}, ErrNoMatch
+		}
+		return Result{}, ErrNeedMore
+	}
+	if !isMethod(method) {
+		return Result{}, ErrNoMatch
+	}
+	if !complete {
+		return Result{}, ErrNeedMore
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/1.") {
+		return Result{}, ErrNoMatch
+	}
+	result := Result{Protocol: ProtocolHTTP}
+	if fields[0] == "CONNECT" {
+		result.Domain = hostname(fields[1])
+		return result, nil
+	}
+	for {
+		line, rest, complete = cutLine(rest)
+		if !complete {
+			return Result{}, ErrNeedMore
+		}
+		if len(line) == 0 {
+			// end of the header without a Host
+			return result, nil
+		}
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if !found {
+			return Result{}, ErrNoMatch
+		}
+		if strings.EqualFold(string(name), "Host") {
+			result.Domain = hostname(string(bytes.TrimSpace(value)))
+			return result, nil
+		}
+	}
+}
+
+// cutLine cuts data at the first line end, complete reports if one was found.
+func cutLine(data []byte) (line []byte, rest []byte, complete bool) {
+	line, rest, complete = bytes.Cut(data, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), rest, complete
+}
+
+func isMethod(method []byte) bool {
+	for _, known := range httpMethods {
+		if string(method) == known {
+			return true
+		}
+	}
+	return false
+}
+
+func isMethodPrefix(data []byte) bool {
+	for _, known := range httpMethods {
+		if strings.HasPrefix(known, string(data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostname strips the port and the brackets of an IPv6 address from host.
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
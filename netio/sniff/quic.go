@@ -0,0 +1,241 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+
+	quicFramePadding  = 0x00
+	quicFramePing     = 0x01
+	quicFrameACK      = 0x02
+	quicFrameACKECN   = 0x03
+	quicFrameCrypto   = 0x06
+	quicMaxCIDLength  = 20
+	quicSampleLength  = 16
+	quicMaxCryptoSize = 1 << 16
+)
+
+// quicVersion holds the parameters protecting the Initial packets of a QUIC version.
+type quicVersion struct {
+	initialType uint8
+	salt        []byte
+	keyLabel    string
+	ivLabel     string
+	hpLabel     string
+}
+
+var quicVersions = map[uint32]quicVersion{
+	quicVersion1: {
+		initialType: 0,
+		salt:        []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		keyLabel:    "quic key",
+		ivLabel:     "quic iv",
+		hpLabel:     "quic hp",
+	},
+	quicVersion2: {
+		initialType: 1,
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		keyLabel:    "quicv2 key",
+		ivLabel:     "quicv2 iv",
+		hpLabel:     "quicv2 hp",
+	},
+}
+
+// clientKeys derives the packet key, IV and header protection key of the client
+// Initial packets from the destination connection ID chosen by the client.
+func (v quicVersion) clientKeys(dcid []byte) (key []byte, iv []byte, hp []byte) {
+	secret, err := hkdf.Extract(sha256.New, dcid, v.salt)
+	if err != nil {
+		panic(err)
+	}
+	clientSecret := expandLabel(secret, "client in", sha256.Size)
+	return expandLabel(clientSecret, v.keyLabel, 16), expandLabel(clientSecret, v.ivLabel, 12), expandLabel(clientSecret, v.hpLabel, 16)
+}
+
+// expandLabel is the HKDF-Expand-Label function of TLS 1.3 with an empty context.
+func expandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	key, err := hkdf.Expand(sha256.New, secret, string(info), length)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// QUICClientHello extracts the server name and ALPN from the Initial packets of a QUIC
+// client datagram. When the ClientHello continues in the next datagrams it returns
+// ErrNeedMore, use a QUICSession to sniff all of them.
+func QUICClientHello(packet []byte) (Result, error) {
+	return new(QUICSession).Sniff(packet)
+}
+
+// QUICSession reassembles the CRYPTO frames of the Initial packets a QUIC client
+// sends in its first datagrams. It is safe for concurrent use.
+type QUICSession struct {
+	access sync.Mutex
+	frames map[uint64][]byte
+}
+
+// Sniff decrypts the Initial packets of packet and sniffs the ClientHello received so far.
+func (s *QUICSession) Sniff(packet []byte) (Result, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.frames == nil {
+		s.frames = make(map[uint64][]byte)
+	}
+	var found bool
+	for len(packet) > 0 {
+		payload, rest, err := openInitial(packet)
+		if err != nil {
+			if found {
+				// the remaining coalesced packets are not Initial packets
+				break
+			}
+			return Result{}, err
+		}
+		found = true
+		if err = s.collect(payload); err != nil {
+			return Result{}, err
+		}
+		packet = rest
+	}
+	var stream []byte
+	for {
+		frame, loaded := s.frames[uint64(len(stream))]
+		if !loaded {
+			break
+		}
+		stream = append(stream, frame...)
+	}
+	if len(stream) == 0 {
+		return Result{}, ErrNeedMore
+	}
+	result, err := parseClientHello(stream)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Protocol = ProtocolQUIC
+	return result, nil
+}
+
+// collect stores the CRYPTO frames of a decrypted Initial payload.
+func (s *QUICSession) collect(payload reader) error {
+	for !payload.empty() {
+		var frameType uint64
+		if !payload.readVarint(&frameType) {
+			return ErrNoMatch
+		}
+		switch frameType {
+		case quicFramePadding, quicFramePing:
+		case quicFrameACK, quicFrameACKECN:
+			var largest, delay, count, first, value uint64
+			if !payload.readVarint(&largest) || !payload.readVarint(&delay) ||
+				!payload.readVarint(&count) || !payload.readVarint(&first) {
+				return ErrNoMatch
+			}
+			fields := count * 2
+			if frameType == quicFrameACKECN {
+				fields += 3
+			}
+			for range fields {
+				if !payload.readVarint(&value) {
+					return ErrNoMatch
+				}
+			}
+		case quicFrameCrypto:
+			var (
+				offset, length uint64
+				data           reader
+			)
+			if !payload.readVarint(&offset) || !payload.readVarint(&length) ||
+				offset+length > quicMaxCryptoSize || !payload.readBytes(int(length), &data) {
+				return ErrNoMatch
+			}
+			if len(data) > 0 && len(s.frames[offset]) < len(data) {
+				s.frames[offset] = append([]byte(nil), data...)
+			}
+		default:
+			// a client sends no other frames in its Initial packets before the ClientHello
+			return nil
+		}
+	}
+	return nil
+}
+
+// openInitial decrypts the first packet of datagram if it is a client Initial packet,
+// it returns the payload and the coalesced packets following it.
+func openInitial(datagram []byte) (payload []byte, rest []byte, err error) {
+	packet := reader(datagram)
+	var (
+		firstByte, dcidLength, scidLength uint8
+		dcid, scid, token                 reader
+		tokenLength, length               uint64
+	)
+	if !packet.readU8(&firstByte) || firstByte&0xc0 != 0xc0 || len(packet) < 4 {
+		return nil, nil, ErrNoMatch
+	}
+	version, supported := quicVersions[binary.BigEndian.Uint32(packet)]
+	if !supported || (firstByte>>4)&0x3 != version.initialType {
+		return nil, nil, ErrNoMatch
+	}
+	packet = packet[4:]
+	if !packet.readU8(&dcidLength) || dcidLength > quicMaxCIDLength || !packet.readBytes(int(dcidLength), &dcid) ||
+		!packet.readU8(&scidLength) || scidLength > quicMaxCIDLength || !packet.readBytes(int(scidLength), &scid) ||
+		!packet.readVarint(&tokenLength) || tokenLength > uint64(len(packet)) || !packet.readBytes(int(tokenLength), &token) ||
+		!packet.readVarint(&length) {
+		return nil, nil, ErrNoMatch
+	}
+	pnOffset := len(datagram) - len(packet)
+	if length < 4+quicSampleLength || uint64(len(packet)) < length {
+		return nil, nil, ErrNoMatch
+	}
+
+	key, iv, hpKey := version.clientKeys(dcid)
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// remove the header protection on a copy, the datagram belongs to the caller
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], datagram[pnOffset+4:pnOffset+4+quicSampleLength])
+	header := append([]byte(nil), datagram[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLength := int(header[0]&0x3) + 1
+	header = header[:pnOffset+pnLength]
+	var packetNumber uint64
+	for i := range pnLength {
+		header[pnOffset+i] ^= mask[1+i]
+		packetNumber = packetNumber<<8 | uint64(header[pnOffset+i])
+	}
+	for i := range 8 {
+		iv[len(iv)-1-i] ^= byte(packetNumber >> (8 * i))
+	}
+	end := pnOffset + int(length)
+	payload, err = aead.Open(nil, iv, datagram[pnOffset+pnLength:end], header)
+	if err != nil {
+		return nil, nil, ErrNoMatch
+	}
+	return payload, datagram[end:], nil
+}
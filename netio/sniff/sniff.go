@@ -0,0 +1,138 @@
+// Package sniff classifies streams and packets by the first bytes they carry.
+//
+// Stream peeks a conn until a sniffer recognizes the data, and returns a conn replaying
+// the peeked bytes, so the caller can forward the stream as if nothing was read.
+// Packet sniffs a single datagram, it does not consume anything.
+package sniff
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netio"
+	"github.com/qtraffics/qtfra/buf"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+const (
+	ProtocolTLS        = "tls"
+	ProtocolHTTP       = "http"
+	ProtocolSSH        = "ssh"
+	ProtocolBitTorrent = "bittorrent"
+	ProtocolDNS        = "dns"
+	ProtocolQUIC       = "quic"
+)
+
+// MaxPeekSize is the most bytes Stream reads before giving up.
+const MaxPeekSize = 16 << 10
+
+var (
+	// ErrNeedMore is returned by a sniffer when the data is a valid prefix of its protocol.
+	ErrNeedMore = ex.New("sniff: need more data")
+	// ErrNoMatch is returned when the data does not belong to the protocol of a sniffer.
+	ErrNoMatch = ex.New("sniff: no match")
+)
+
+// Result is what a sniffer learned, Domain and ALPN are empty when the protocol
+// does not carry them.
+type Result struct {
+	Protocol string
+	Domain   string
+	ALPN     []string
+}
+
+// StreamSniffer inspects the first bytes of a stream, it returns ErrNeedMore until
+// it can decide and ErrNoMatch once the data can not be its protocol.
+type StreamSniffer func(data []byte) (Result, error)
+
+// PacketSniffer inspects a single datagram.
+type PacketSniffer func(packet []byte) (Result, error)
+
+// StreamSniffers are the sniffers used by Stream when none are given.
+var StreamSniffers = []StreamSniffer{TLSClientHello, HTTPHost, SSH, BitTorrent, StreamDNS}
+
+// PacketSniffers are the sniffers used by Packet when none are given.
+var PacketSniffers = []PacketSniffer{QUICClientHello, DNS}
+
+// Stream reads from conn until one of sniffers matches, all of them fail, MaxPeekSize
+// bytes have been read, timeout elapses or ctx is done. A zero timeout waits for ctx only.
+//
+// The returned conn replays the peeked bytes and must be used in place of conn, also when
+// an error is returned. The read deadline of conn is cleared before Stream returns.
+func Stream(ctx context.Context, conn net.Conn, timeout time.Duration, sniffers ...StreamSniffer) (Result, net.Conn, error) {
+	if len(sniffers) == 0 {
+		sniffers = StreamSniffers
+	}
+	if timeout > 0 {
+		err := conn.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return Result{}, conn, err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		stop()
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	buffer := buf.NewSize(MaxPeekSize)
+	pending := slices.Clone(sniffers)
+	for {
+		_, readErr := buffer.ReadFromOnce(conn)
+		if buffer.Len() > 0 {
+			for i := 0; i < len(pending); {
+				result, err := pending[i](buffer.Bytes())
+				switch {
+				case err == nil:
+					return result, replay(conn, buffer), nil
+				case errors.Is(err, ErrNeedMore):
+					i++
+				default:
+					pending = slices.Delete(pending, i, i+1)
+				}
+			}
+		}
+		switch {
+		case len(pending) == 0 || buffer.Full():
+			return Result{}, replay(conn, buffer), ErrNoMatch
+		case readErr != nil:
+			if ctx.Err() != nil {
+				readErr = ctx.Err()
+			}
+			return Result{}, replay(conn, buffer), readErr
+		}
+	}
+}
+
+// Packet sniffs packet with sniffers, it returns ErrNeedMore when a sniffer needs the
+// following datagrams of the flow, see QUICSession.
+func Packet(packet []byte, sniffers ...PacketSniffer) (Result, error) {
+	if len(sniffers) == 0 {
+		sniffers = PacketSniffers
+	}
+	err := ErrNoMatch
+	for _, sniffer := range sniffers {
+		result, sniffErr := sniffer(packet)
+		if sniffErr == nil {
+			return result, nil
+		}
+		if errors.Is(sniffErr, ErrNeedMore) {
+			err = sniffErr
+		}
+	}
+	return Result{}, err
+}
+
+// replay returns conn reading the peeked bytes first.
+func replay(conn net.Conn, peeked *buf.Buffer) net.Conn {
+	if peeked.Empty() {
+		peeked.Free()
+		return conn
+	}
+	return netio.NewPrefixConn(conn, peeked)
+}
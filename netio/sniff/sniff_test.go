@@ -0,0 +1,294 @@
+package sniff
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netio/pipe"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientHello returns the first flight of a TLS client as written to the wire.
+func clientHello(t *testing.T, serverName string, alpn ...string) []byte {
+	client, server := pipe.BufferedPipe(nil, nil, 0)
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn}).Handshake()
+		client.Close()
+	}()
+	var header [recordHeaderLength]byte
+	_, err := io.ReadFull(server, header[:])
+	require.NoError(t, err)
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err = io.ReadFull(server, record)
+	require.NoError(t, err)
+	return append(header[:], record...)
+}
+
+func TestTLSClientHello(t *testing.T) {
+	hello := clientHello(t, "example.com", "h2", "http/1.1")
+	result, err := TLSClientHello(hello)
+	require.NoError(t, err)
+	assert.Equal(t, Result{Protocol: ProtocolTLS, Domain: "example.com", ALPN: []string{"h2", "http/1.1"}}, result)
+
+	_, err = TLSClientHello(hello[:len(hello)/2])
+	assert.Equal(t, ErrNeedMore, err)
+
+	// the handshake message split over two records
+	handshake := hello[recordHeaderLength:]
+	var fragmented []byte
+	for _, fragment := range [][]byte{handshake[:100], handshake[100:]} {
+		fragmented = append(fragmented, recordTypeHandshake, 0x03, 0x01)
+		fragmented = binary.BigEndian.AppendUint16(fragmented, uint16(len(fragment)))
+		fragmented = append(fragmented, fragment...)
+	}
+	result, err = TLSClientHello(fragmented)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", result.Domain)
+
+	_, err = TLSClientHello([]byte("GET / HTTP/1.1\r\n"))
+	assert.Equal(t, ErrNoMatch, err)
+}
+
+func TestHTTPHost(t *testing.T) {
+	for data, domain := range map[string]string{
+		"GET / HTTP/1.1\r\nUser-Agent: test\r\nHost: example.com:8080\r\n":  "example.com",
+		"POST /api HTTP/1.0\r\nhost: [2001:db8::1]\r\n\r\n":                 "2001:db8::1",
+		"CONNECT example.org:443 HTTP/1.1\r\n":                              "example.org",
+		"OPTIONS * HTTP/1.1\r\n\r\n":                                        "",
+		"GET / HTTP/1.1\nHost: example.net\n":                               "example.net",
+		"DELETE /resource HTTP/1.1\r\nAccept: */*\r\nHost: example.com\r\n": "example.com",
+	} {
+		result, err := HTTPHost([]byte(data))
+		require.NoError(t, err, data)
+		assert.Equal(t, Result{Protocol: ProtocolHTTP, Domain: domain}, result, data)
+	}
+	for data, expected := range map[string]error{
+		"GE":                            ErrNeedMore,
+		"GET / HTTP/1.1\r\nAccept: */*": ErrNeedMore,
+		"GET / HTTP/1.1\r\n":            ErrNeedMore,
+		"FOO / HTTP/1.1\r\n":            ErrNoMatch,
+		"GET / HTTP/2\r\n":              ErrNoMatch,
+		"SSH-2.0-OpenSSH\r\n":           ErrNoMatch,
+	} {
+		_, err := HTTPHost([]byte(data))
+		assert.Equal(t, expected, err, data)
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	result, err := SSH([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolSSH, result.Protocol)
+	_, err = SSH([]byte("SS"))
+	assert.Equal(t, ErrNeedMore, err)
+	_, err = SSH([]byte("GET"))
+	assert.Equal(t, ErrNoMatch, err)
+
+	handshake := append(append([]byte{}, bitTorrentPrefix...), make([]byte, 48)...)
+	result, err = BitTorrent(handshake)
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolBitTorrent, result.Protocol)
+	_, err = BitTorrent(handshake[:10])
+	assert.Equal(t, ErrNeedMore, err)
+
+	query := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	packet, err := query.Pack()
+	require.NoError(t, err)
+	result, err = DNS(packet)
+	require.NoError(t, err)
+	assert.Equal(t, Result{Protocol: ProtocolDNS, Domain: "example.com"}, result)
+	_, err = DNS(append(packet[:2:2], make([]byte, 20)...))
+	assert.Equal(t, ErrNoMatch, err)
+
+	stream := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+	stream = append(stream, packet...)
+	result, err = StreamDNS(stream)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", result.Domain)
+	_, err = StreamDNS(stream[:len(stream)-1])
+	assert.Equal(t, ErrNeedMore, err)
+	_, err = StreamDNS([]byte("GET / HTTP/1.1\r\n"))
+	assert.Equal(t, ErrNoMatch, err)
+
+	response := new(dns.Msg).SetReply(query)
+	packet, err = response.Pack()
+	require.NoError(t, err)
+	_, err = DNS(packet)
+	assert.Equal(t, ErrNoMatch, err)
+
+	// a header with QDCOUNT=1 and no question
+	header := []byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	_, err = DNS(header)
+	assert.Equal(t, ErrNoMatch, err)
+	_, err = StreamDNS(append([]byte{0, dnsHeaderLength}, header...))
+	assert.Equal(t, ErrNoMatch, err)
+	_, err = Packet(header)
+	assert.Equal(t, ErrNoMatch, err)
+}
+
+func TestStream(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	client, server := pipe.BufferedPipe(nil, nil, 0)
+	defer client.Close()
+	go func() {
+		// the ClientHello arrives in pieces
+		for _, piece := range [][]byte{hello[:3], hello[3:64], hello[64:]} {
+			_, _ = client.Write(piece)
+			time.Sleep(5 * time.Millisecond)
+		}
+		_, _ = client.Write([]byte("after"))
+		_ = client.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	result, conn, err := Stream(context.Background(), server, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "example.com", result.Domain)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]byte{}, hello...), "after"...), data)
+}
+
+func TestStreamTimeout(t *testing.T) {
+	client, server := pipe.BufferedPipe(nil, nil, 0)
+	defer client.Close()
+	_, err := client.Write([]byte("GE"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, conn, err := Stream(context.Background(), server, 20*time.Millisecond)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the deadline is cleared and the peeked bytes are replayed
+	_, err = client.Write([]byte("T"))
+	require.NoError(t, err)
+	buffer := make([]byte, 3)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", string(buffer))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, _, err = Stream(ctx, conn, 0)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestStreamNoMatch(t *testing.T) {
+	client, server := pipe.BufferedPipe(nil, nil, 0)
+	defer client.Close()
+	_, err := client.Write([]byte("\x00\x00unknown"))
+	require.NoError(t, err)
+	_, conn, err := Stream(context.Background(), server, time.Second)
+	assert.Equal(t, ErrNoMatch, err)
+	buffer := make([]byte, 9)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "\x00\x00unknown", string(buffer))
+}
+
+func TestQUICClientKeys(t *testing.T) {
+	// RFC 9001, Appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp := quicVersions[quicVersion1].clientKeys(dcid)
+	assert.Equal(t, "1f369613dd76d5467730efcbe3b1a22d", hex.EncodeToString(key))
+	assert.Equal(t, "fa044b2f42a3fd3b46fb255c", hex.EncodeToString(iv))
+	assert.Equal(t, "9f50449e04a0e810283a1e9933adedd2", hex.EncodeToString(hp))
+}
+
+// quicClientHello returns the ClientHello handshake message of a QUIC client.
+func quicClientHello(t *testing.T, serverName string) []byte {
+	conn := tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{"h3"},
+		MinVersion: tls.VersionTLS13,
+	}})
+	conn.SetTransportParameters(nil)
+	require.NoError(t, conn.Start(context.Background()))
+	defer conn.Close()
+	for {
+		event := conn.NextEvent()
+		require.NotEqual(t, tls.QUICNoEvent, event.Kind)
+		if event.Kind == tls.QUICWriteData && event.Level == tls.QUICEncryptionLevelInitial {
+			return event.Data
+		}
+	}
+}
+
+// sealInitial builds a protected client Initial packet carrying frames.
+func sealInitial(t *testing.T, version uint32, dcid []byte, packetNumber uint16, frames []byte) []byte {
+	// pad to the minimum size of a client Initial datagram
+	frames = append(frames, make([]byte, max(1200-len(frames), 0))...)
+	key, iv, hpKey := quicVersions[version].clientKeys(dcid)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	hp, err := aes.NewCipher(hpKey)
+	require.NoError(t, err)
+
+	header := []byte{0xc0 | quicVersions[version].initialType<<4 | 0x01}
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0, 0) // no source connection ID and token
+	header = binary.BigEndian.AppendUint16(header, 0x4000|uint16(2+len(frames)+aead.Overhead()))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint16(header, packetNumber)
+
+	binary.BigEndian.PutUint16(iv[len(iv)-2:], binary.BigEndian.Uint16(iv[len(iv)-2:])^packetNumber)
+	packet := aead.Seal(header, iv, frames, header)
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], packet[pnOffset+4:pnOffset+4+quicSampleLength])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
+
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := []byte{quicFrameCrypto, 0x80, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], 0x80000000|uint32(offset))
+	frame = append(frame, 0x40|byte(len(data)>>8), byte(len(data)))
+	return append(frame, data...)
+}
+
+func TestQUICClientHello(t *testing.T) {
+	hello := quicClientHello(t, "example.com")
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, version := range []uint32{quicVersion1, quicVersion2} {
+		packet := sealInitial(t, version, dcid, 0, append([]byte{quicFramePing}, cryptoFrame(0, hello)...))
+		result, err := Packet(packet)
+		require.NoError(t, err)
+		assert.Equal(t, Result{Protocol: ProtocolQUIC, Domain: "example.com", ALPN: []string{"h3"}}, result)
+	}
+
+	// the ClientHello split over two datagrams, the second one sent first
+	first := sealInitial(t, quicVersion1, dcid, 0, cryptoFrame(0, hello[:100]))
+	second := sealInitial(t, quicVersion1, dcid, 1, cryptoFrame(100, hello[100:]))
+	_, err := QUICClientHello(first)
+	assert.Equal(t, ErrNeedMore, err)
+	var session QUICSession
+	_, err = session.Sniff(second)
+	assert.Equal(t, ErrNeedMore, err)
+	result, err := session.Sniff(first)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", result.Domain)
+
+	// a damaged packet does not decrypt
+	first[len(first)-1] ^= 0xff
+	_, err = QUICClientHello(first)
+	assert.Equal(t, ErrNoMatch, err)
+}
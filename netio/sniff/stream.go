@@ -0,0 +1,53 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var (
+	sshPrefix        = []byte("SSH-")
+	bitTorrentPrefix = append([]byte{19}, "BitTorrent protocol"...)
+)
+
+// SSH matches the identification string of an SSH client.
+func SSH(data []byte) (Result, error) {
+	return matchPrefix(data, sshPrefix, ProtocolSSH)
+}
+
+// BitTorrent matches the handshake of the BitTorrent peer protocol.
+func BitTorrent(data []byte) (Result, error) {
+	return matchPrefix(data, bitTorrentPrefix, ProtocolBitTorrent)
+}
+
+func matchPrefix(data []byte, prefix []byte, protocol string) (Result, error) {
+	if len(data) < len(prefix) {
+		if !bytes.HasPrefix(prefix, data) {
+			return Result{}, ErrNoMatch
+		}
+		return Result{}, ErrNeedMore
+	}
+	if !bytes.HasPrefix(data, prefix) {
+		return Result{}, ErrNoMatch
+	}
+	return Result{Protocol: protocol}, nil
+}
+
+// StreamDNS matches a DNS query over TCP, the domain is the name of the question.
+func StreamDNS(data []byte) (Result, error) {
+	if len(data) < 2 {
+		return Result{}, ErrNeedMore
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if length < dnsHeaderLength {
+		return Result{}, ErrNoMatch
+	}
+	message := data[2:]
+	if len(message) >= dnsHeaderLength && !isDNSQueryHeader(message) {
+		return Result{}, ErrNoMatch
+	}
+	if len(message) < length {
+		return Result{}, ErrNeedMore
+	}
+	return DNS(message[:length])
+}
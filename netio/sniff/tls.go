@@ -0,0 +1,205 @@
+package sniff
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeClientHello     = 0x01
+	extensionServerName      = 0x00
+	extensionALPN            = 0x10
+	serverNameTypeHostName   = 0x00
+	recordHeaderLength       = 5
+	handshakeHeaderLength    = 4
+	maxClientHelloLength     = 1 << 16
+	maxPlaintextRecordLength = 1<<14 + 256
+)
+
+// TLSClientHello extracts the server name and ALPN from a ClientHello, which may be
+// split over several records.
+func TLSClientHello(data []byte) (Result, error) {
+	var handshake []byte
+	for {
+		if len(data) < recordHeaderLength {
+			break
+		}
+		if data[0] != recordTypeHandshake || data[1] != 0x03 || data[2] > 0x04 {
+			return Result{}, ErrNoMatch
+		}
+		length := int(binary.BigEndian.Uint16(data[3:]))
+		if length == 0 || length > maxPlaintextRecordLength {
+			return Result{}, ErrNoMatch
+		}
+		if len(data) < recordHeaderLength+length {
+			handshake = append(handshake, data[recordHeaderLength:]...)
+			break
+		}
+		handshake = append(handshake, data[recordHeaderLength:recordHeaderLength+length]...)
+		data = data[recordHeaderLength+length:]
+		if len(handshake) >= handshakeHeaderLength && len(handshake) >= handshakeHeaderLength+int(uint24(handshake[1:])) {
+			break
+		}
+	}
+	if len(handshake) == 0 {
+		if len(data) > 0 && data[0] != recordTypeHandshake {
+			return Result{}, ErrNoMatch
+		}
+		return Result{}, ErrNeedMore
+	}
+	result, err := parseClientHello(handshake)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Protocol = ProtocolTLS
+	return result, nil
+}
+
+// parseClientHello parses a ClientHello handshake message without the record layer.
+func parseClientHello(handshake []byte) (Result, error) {
+	if len(handshake) > 0 && handshake[0] != handshakeClientHello {
+		return Result{}, ErrNoMatch
+	}
+	if len(handshake) < handshakeHeaderLength {
+		return Result{}, ErrNeedMore
+	}
+	length := int(uint24(handshake[1:]))
+	if length > maxClientHelloLength {
+		return Result{}, ErrNoMatch
+	}
+	if len(handshake) < handshakeHeaderLength+length {
+		return Result{}, ErrNeedMore
+	}
+	message := reader(handshake[handshakeHeaderLength : handshakeHeaderLength+length])
+	var sessionID, cipherSuites, compressionMethods, extensions reader
+	if !message.skip(2+32) ||
+		!message.readU8Prefixed(&sessionID) ||
+		!message.readU16Prefixed(&cipherSuites) ||
+		!message.readU8Prefixed(&compressionMethods) {
+		return Result{}, ErrNoMatch
+	}
+	if message.empty() {
+		// no extensions, no server name
+		return Result{}, nil
+	}
+	if !message.readU16Prefixed(&extensions) {
+		return Result{}, ErrNoMatch
+	}
+	var result Result
+	for !extensions.empty() {
+		var (
+			extensionType uint16
+			extension     reader
+		)
+		if !extensions.readU16(&extensionType) || !extensions.readU16Prefixed(&extension) {
+			return Result{}, ErrNoMatch
+		}
+		switch extensionType {
+		case extensionServerName:
+			var names reader
+			if !extension.readU16Prefixed(&names) {
+				return Result{}, ErrNoMatch
+			}
+			for !names.empty() {
+				var (
+					nameType uint8
+					name     reader
+				)
+				if !names.readU8(&nameType) || !names.readU16Prefixed(&name) {
+					return Result{}, ErrNoMatch
+				}
+				if nameType == serverNameTypeHostName {
+					result.Domain = strings.TrimSuffix(string(name), ".")
+				}
+			}
+		case extensionALPN:
+			var protocols reader
+			if !extension.readU16Prefixed(&protocols) {
+				return Result{}, ErrNoMatch
+			}
+			for !protocols.empty() {
+				var protocol reader
+				if !protocols.readU8Prefixed(&protocol) {
+					return Result{}, ErrNoMatch
+				}
+				result.ALPN = append(result.ALPN, string(protocol))
+			}
+		}
+	}
+	return result, nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// reader reads length prefixed fields, every method reports false when the data is too short.
+type reader []byte
+
+func (r *reader) empty() bool {
+	return len(*r) == 0
+}
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) readU8(out *uint8) bool {
+	if len(*r) < 1 {
+		return false
+	}
+	*out = (*r)[0]
+	*r = (*r)[1:]
+	return true
+}
+
+func (r *reader) readU16(out *uint16) bool {
+	if len(*r) < 2 {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return true
+}
+
+func (r *reader) readBytes(n int, out *reader) bool {
+	if n < 0 || len(*r) < n {
+		return false
+	}
+	*out = (*r)[:n]
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) readU8Prefixed(out *reader) bool {
+	var length uint8
+	return r.readU8(&length) && r.readBytes(int(length), out)
+}
+
+func (r *reader) readU16Prefixed(out *reader) bool {
+	var length uint16
+	return r.readU16(&length) && r.readBytes(int(length), out)
+}
+
+// readVarint reads a QUIC variable length integer.
+func (r *reader) readVarint(out *uint64) bool {
+	if len(*r) < 1 {
+		return false
+	}
+	length := 1 << ((*r)[0] >> 6)
+	if len(*r) < length {
+		return false
+	}
+	value := uint64((*r)[0] & 0x3f)
+	for _, b := range (*r)[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	*out = value
+	*r = (*r)[length:]
+	return true
+}
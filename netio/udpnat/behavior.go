@@ -0,0 +1,94 @@
+package udpnat
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/qtraffics/qnetwork/addrs"
+)
+
+// Behavior is a NAT mapping or filtering behavior as described in RFC 4787.
+type Behavior uint8
+
+const (
+	// EndpointIndependent shares one session between all destinations of a source,
+	// and accepts inbound packets from any remote endpoint (full cone).
+	EndpointIndependent Behavior = iota
+	// AddressDependent keys sessions by the destination address,
+	// and accepts inbound packets only from addresses the session has sent to.
+	AddressDependent
+	// AddressAndPortDependent keys sessions by the destination address and port,
+	// and accepts inbound packets only from endpoints the session has sent to (symmetric).
+	AddressAndPortDependent
+)
+
+func (b Behavior) String() string {
+	switch b {
+	case EndpointIndependent:
+		return "endpoint-independent"
+	case AddressDependent:
+		return "address-dependent"
+	case AddressAndPortDependent:
+		return "address-and-port-dependent"
+	default:
+		return "unknown"
+	}
+}
+
+// mask strips the parts of addr the behavior does not depend on.
+func (b Behavior) mask(addr addrs.Socksaddr) addrs.Socksaddr {
+	switch b {
+	case EndpointIndependent:
+		return addrs.Socksaddr{}
+	case AddressDependent:
+		addr.Port = 0
+	}
+	addr.Addr = addr.Addr.Unmap()
+	return addr
+}
+
+type natKey struct {
+	source      netip.AddrPort
+	destination addrs.Socksaddr
+}
+
+func (u *UdpNat) natKey(source addrs.Socksaddr, destination addrs.Socksaddr) natKey {
+	return natKey{
+		source:      source.AddrPort(),
+		destination: u.opt.Mapping.mask(destination),
+	}
+}
+
+// allow reports whether a packet from remote may be sent back to the source.
+// Domain destinations only match remotes reported with the same domain.
+func (c *natConn) allow(remote net.Addr) bool {
+	if c.filtering == EndpointIndependent || remote == nil {
+		return true
+	}
+	var addr addrs.Socksaddr
+	if socksaddr, isSocksaddr := remote.(addrs.Socksaddr); isSocksaddr {
+		addr = socksaddr
+	} else {
+		addr = addrs.FromNetAddr(remote)
+	}
+	c.peersAccess.RLock()
+	defer c.peersAccess.RUnlock()
+	_, allowed := c.peers[c.filtering.mask(addr)]
+	return allowed
+}
+
+func (c *natConn) addPeer(destination addrs.Socksaddr) {
+	if c.filtering == EndpointIndependent {
+		return
+	}
+	peer := c.filtering.mask(destination)
+	c.peersAccess.RLock()
+	_, loaded := c.peers[peer]
+	c.peersAccess.RUnlock()
+	if loaded {
+		return
+	}
+	c.peersAccess.Lock()
+	c.peers[peer] = struct{}{}
+	c.peersAccess.Unlock()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -33,7 +34,10 @@ type PacketHandlerFunc func(p netio.UDPPacket)
 
 func (o PacketHandlerFunc) NewPacket(p netio.UDPPacket) { o(p) }
 
-var _ Conn = (*natConn)(nil)
+var (
+	_ Conn               = (*natConn)(nil)
+	_ netio.PacketReader = (*natConn)(nil)
+)
 
 type natConn struct {
 	source       addrs.Socksaddr
@@ -41,10 +45,28 @@ type natConn struct {
 	writer       netio.PacketWriter
 	closeOnce    sync.Once
 	closeChan    chan struct{}
-	onClose      func(c Conn)
+	onClose      func(c Conn, reason CloseReason)
 	readDeadline pipe.Deadline
 
-	packets chan netio.UDPPacket
+	// local address and interface the session was received on, see control.PacketInfo.
+	local   netip.Addr
+	ifIndex int
+
+	// peers are the destinations the source has sent to, masked by the filtering behavior.
+	filtering   Behavior
+	peersAccess sync.RWMutex
+	peers       map[addrs.Socksaddr]struct{}
+
+	created    time.Time
+	lastActive atomic.Int64
+	lastUpload atomic.Int64
+	counters
+	stats *natStats
+
+	packets   chan netio.UDPPacket
+	overflow  OverflowPolicy
+	queueWait time.Duration
+	buffered  atomic.Int64
 
 	handler atomic.Pointer[PacketHandler]
 }
@@ -58,6 +80,7 @@ fetch:
 	for {
 		select {
 		case pack := <-c.packets:
+			c.dequeue(pack)
 			h.NewPacket(pack)
 			netio.PutPacket(pack)
 		default:
@@ -71,18 +94,49 @@ func (c *natConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	return n, c.source.UDPAddr(), err
 }
 
+// WriteTo sends p back to the source as a packet from destination.
+// Packets from a remote rejected by the filtering behavior are silently dropped.
 func (c *natConn) WriteTo(p []byte, destination net.Addr) (n int, err error) {
-	return c.writer.WriteTo(p, destination)
+	if !c.allow(destination) {
+		c.drop(dropFilter)
+		return len(p), nil
+	}
+	return c.writeTo(p, destination)
+}
+
+func (c *natConn) writeTo(p []byte, destination net.Addr) (n int, err error) {
+	if c.local.IsValid() {
+		if writer, ok := c.writer.(netio.PacketInfoWriter); ok {
+			n, err = writer.WriteToFrom(p, destination, c.local, c.ifIndex)
+			c.written(n, err)
+			return n, err
+		}
+	}
+	n, err = c.writer.WriteTo(p, destination)
+	c.written(n, err)
+	return n, err
+}
+
+func (c *natConn) written(n int, err error) {
+	if err == nil {
+		c.download(n)
+	}
 }
 
 func (c *natConn) Close() error {
+	c.close(CloseExplicit)
+	return nil
+}
+
+func (c *natConn) close(reason CloseReason) {
 	c.closeOnce.Do(func() {
 		close(c.closeChan)
+		c.discard()
+		c.stats.closed.Add(1)
 		if c.onClose != nil {
-			c.onClose(c)
+			c.onClose(c, reason)
 		}
 	})
-	return nil
 }
 
 func (c *natConn) RemoteAddr() net.Addr {
@@ -107,24 +161,32 @@ func (c *natConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (c *natConn) Read(p []byte) (n int, err error) {
+	pack, err := c.ReadPacket()
+	if err != nil {
+		return 0, err
+	}
+	defer netio.PutPacket(pack)
+	// _ = pack.oob // discard oob
+	// the caller should make sure the p is bigger enough that it can accept all the message.
+	return pack.Buf.Read(p[:])
+}
+
+// ReadPacket returns the next queued packet, the packet Addr holds its original destination.
+func (c *natConn) ReadPacket() (netio.UDPPacket, error) {
 	select {
 	case pack := <-c.packets:
-		defer netio.PutPacket(pack)
-		// _ = pack.oob // discard oob
-		// the caller should make sure the p is bigger enough that it can accept all the message.
-		n, err = pack.Buf.Read(p[:])
-
-		return n, err
+		c.dequeue(pack)
+		return pack, nil
 	case <-c.closeChan:
-		return 0, io.ErrClosedPipe
+		return netio.UDPPacket{}, io.ErrClosedPipe
 	case <-c.readDeadline.Wait():
 		// https://go-review.googlesource.com/c/go/+/546275
-		return 0, context.DeadlineExceeded
+		return netio.UDPPacket{}, context.DeadlineExceeded
 	}
 }
 
 func (c *natConn) Write(p []byte) (n int, err error) {
-	return c.writer.WriteTo(p, c.source.UDPAddr())
+	return c.writeTo(p, c.source.UDPAddr())
 }
 
 func (c *natConn) isClose() bool {
@@ -2,7 +2,6 @@ package udpnat
 
 import (
 	"hash/maphash"
-	"net/netip"
 	"time"
 
 	"github.com/qtraffics/qnetwork/addrs"
@@ -18,12 +17,29 @@ import (
 type Option struct {
 	Size    uint32
 	Timeout time.Duration
+
+	// Mapping decides which destinations of a source share a session,
+	// Filtering decides which remotes may send packets back through a session.
+	// Both default to EndpointIndependent.
+	Mapping   Behavior
+	Filtering Behavior
+
+	// QueueSize is the number of packets queued for a session without handler,
+	// default to netvars.DefaultUDPQueueSize. Overflow decides what happens when the queue is full,
+	// QueueWait bounds the wait of the Block policy, default to netvars.DefaultUDPQueueWait.
+	QueueSize int
+	Overflow  OverflowPolicy
+	QueueWait time.Duration
+
+	// MemoryBudget limits the bytes queued in all sessions, the least recently used sessions
+	// holding queued packets are closed with CloseMemory once it is exceeded. Zero means unlimited.
+	MemoryBudget int64
 }
 
 type PrepareResult struct {
 	Success bool
 
-	OnClose      func(conn Conn)
+	OnClose      func(conn Conn, reason CloseReason)
 	Handler      PacketHandler
 	PacketWriter netio.PacketWriter
 }
@@ -31,15 +47,38 @@ type PrepareResult struct {
 type PrepareFunc func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult
 
 type UdpNat struct {
-	cache freelru.Cache[netip.AddrPort, *natConn]
+	cache freelru.Cache[natKey, *natConn]
 
 	prepare PrepareFunc
 	opt     Option
+	stats   natStats
 }
 
 func (u *UdpNat) NewPacket(buffers *buf.Buffer, source addrs.Socksaddr, destination addrs.Socksaddr) (Conn, bool) {
 	pack := netio.NewPacket(buffers, nil)
-	conn, exist := u.cache.GetAndRefresh(source.AddrPort(), u.opt.Timeout)
+	pack.Addr = destination
+	return u.newPacket(pack, source, destination)
+}
+
+// NewPacketBatch dispatches packets read by netio.BatchPacketConn.ReadBatch,
+// the source of each packet is its Addr. Coalesced packets are split into datagrams first.
+// When a packet carries its LocalAddr, the session replies from that address.
+// The nat takes the ownership of all packets, so the caller must refill the slice before reading again.
+func (u *UdpNat) NewPacketBatch(packets []netio.UDPPacket, destination addrs.Socksaddr) {
+	for _, pack := range packets {
+		source := pack.Addr
+		for _, segment := range netio.SplitPacket(pack) {
+			segment.Addr = destination
+			if conn, _ := u.newPacket(segment, source, destination); conn == nil {
+				netio.PutPacket(segment)
+			}
+		}
+	}
+}
+
+func (u *UdpNat) newPacket(pack netio.UDPPacket, source addrs.Socksaddr, destination addrs.Socksaddr) (Conn, bool) {
+	key := u.natKey(source, destination)
+	conn, exist := u.cache.GetAndRefresh(key, u.opt.Timeout)
 	if !exist || conn.isClose() {
 		prepare := u.prepare(source, destination, pack)
 		if !prepare.Success {
@@ -53,23 +92,35 @@ func (u *UdpNat) NewPacket(buffers *buf.Buffer, source addrs.Socksaddr, destinat
 			onClose:      prepare.OnClose,
 			closeChan:    make(chan struct{}),
 			readDeadline: pipe.MakeDeadline(),
+			local:        pack.LocalAddr,
+			ifIndex:      pack.IfIndex,
+			filtering:    u.opt.Filtering,
+			created:      time.Now(),
+			stats:        &u.stats,
+		}
+		if conn.filtering != EndpointIndependent {
+			conn.peers = make(map[addrs.Socksaddr]struct{})
 		}
 		if prepare.Handler != nil {
 			conn.SetHandler(prepare.Handler)
 		} else {
-			conn.packets = make(chan netio.UDPPacket, 64)
+			conn.packets = make(chan netio.UDPPacket, u.opt.QueueSize)
+			conn.overflow = u.opt.Overflow
+			conn.queueWait = u.opt.QueueWait
 		}
-		u.cache.Add(source.AddrPort(), conn)
+		conn.lastActive.Store(conn.created.UnixNano())
+		conn.lastUpload.Store(conn.created.UnixNano())
+		u.stats.created.Add(1)
+		u.cache.Add(key, conn)
 	}
+	conn.addPeer(destination)
+	n := pack.Buf.Len()
 	if h := conn.handler.Load(); h != nil {
+		conn.upload(n)
 		(*h).NewPacket(pack)
-	} else {
-		select {
-		case conn.packets <- pack:
-		default:
-			pack.Buf.Free()
-			netio.PutPacket(pack)
-		}
+	} else if conn.enqueue(pack) {
+		conn.upload(n)
+		u.enforceBudget()
 	}
 
 	return conn, !exist
@@ -93,18 +144,33 @@ func New(prepare PrepareFunc, opt *Option) (*UdpNat, error) {
 		opt = &Option{}
 	}
 
+	if opt.Mapping > AddressAndPortDependent || opt.Filtering > AddressAndPortDependent {
+		return nil, ex.New("unknown nat behavior: ", opt.Mapping, ", ", opt.Filtering)
+	}
+	if opt.Overflow > Block {
+		return nil, ex.New("unknown overflow policy: ", opt.Overflow)
+	}
+	if opt.QueueSize < 0 {
+		return nil, ex.New("negative queue size")
+	}
 	if opt.Timeout == 0 {
 		opt.Timeout = netvars.DefaultUDPKeepAlive
 	}
 	if opt.Size == 0 {
 		opt.Size = netvars.DefaultUDPConnSize
 	}
+	if opt.QueueSize == 0 {
+		opt.QueueSize = netvars.DefaultUDPQueueSize
+	}
+	if opt.QueueWait <= 0 {
+		opt.QueueWait = netvars.DefaultUDPQueueWait
+	}
 
 	udpnat := &UdpNat{}
-	udpnat.cache = ex.Must0(freelru.NewSharded[netip.AddrPort, *natConn](opt.Size, hashNetipAddrPort))
+	udpnat.cache = ex.Must0(freelru.NewSharded[natKey, *natConn](opt.Size, hashNatKey))
 	udpnat.cache.SetLifetime(opt.Timeout)
-	udpnat.cache.SetOnEvict(func(port netip.AddrPort, conn *natConn) {
-		_ = conn.Close()
+	udpnat.cache.SetOnEvict(func(_ natKey, conn *natConn) {
+		conn.close(conn.evictReason(udpnat.opt.Timeout))
 	})
 
 	udpnat.prepare = prepare
@@ -114,6 +180,6 @@ func New(prepare PrepareFunc, opt *Option) (*UdpNat, error) {
 
 var hashSeed = maphash.MakeSeed()
 
-func hashNetipAddrPort(ap netip.AddrPort) uint32 {
-	return uint32(maphash.Comparable(hashSeed, ap))
+func hashNatKey(key natKey) uint32 {
+	return uint32(maphash.Comparable(hashSeed, key))
 }
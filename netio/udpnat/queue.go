@@ -0,0 +1,145 @@
+package udpnat
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netio"
+)
+
+// OverflowPolicy decides what happens to a packet arriving at a full session queue.
+type OverflowPolicy uint8
+
+const (
+	// DropNewest drops the arriving packet.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the oldest queued packet to make room for the arriving one.
+	DropOldest
+	// Block waits up to Option.QueueWait for room and drops the arriving packet after that.
+	// The wait holds up the caller of NewPacket, which pushes the backpressure to the reader of the socket.
+	Block
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// enqueue queues pack by the overflow policy, it reports false when pack has been dropped and released.
+func (c *natConn) enqueue(pack netio.UDPPacket) bool {
+	n := int64(pack.Buf.Len())
+	// account before sending, the reader may release it as soon as it is queued.
+	c.buffer(n)
+	queued := false
+	select {
+	case c.packets <- pack:
+		queued = true
+	default:
+		switch c.overflow {
+		case DropOldest:
+			queued = c.replaceOldest(pack)
+		case Block:
+			timer := time.NewTimer(c.queueWait)
+			select {
+			case c.packets <- pack:
+				queued = true
+			case <-timer.C:
+			case <-c.closeChan:
+			}
+			timer.Stop()
+		}
+	}
+	if !queued {
+		c.buffer(-n)
+		c.drop(dropOverflow)
+		netio.PutPacket(pack)
+		return false
+	}
+	if c.isClose() {
+		// raced with close, which may have drained the queue already.
+		c.discard()
+	}
+	return true
+}
+
+func (c *natConn) replaceOldest(pack netio.UDPPacket) bool {
+	for {
+		select {
+		case c.packets <- pack:
+			return true
+		default:
+		}
+		select {
+		case oldest := <-c.packets:
+			c.dequeue(oldest)
+			c.drop(dropOverflow)
+			netio.PutPacket(oldest)
+		case <-c.closeChan:
+			return false
+		}
+	}
+}
+
+// dequeue releases the accounting of a packet taken from the queue.
+func (c *natConn) dequeue(pack netio.UDPPacket) {
+	c.buffer(-int64(pack.Buf.Len()))
+}
+
+func (c *natConn) buffer(n int64) {
+	c.buffered.Add(n)
+	c.stats.buffered.Add(n)
+}
+
+// discard releases all queued packets of a closed session.
+func (c *natConn) discard() {
+	for {
+		select {
+		case pack := <-c.packets:
+			c.dequeue(pack)
+			c.drop(dropDiscard)
+			netio.PutPacket(pack)
+		default:
+			return
+		}
+	}
+}
+
+// enforceBudget closes the least recently active sessions holding queued packets
+// until the buffered bytes of all sessions fit in Option.MemoryBudget.
+func (u *UdpNat) enforceBudget() {
+	if u.opt.MemoryBudget <= 0 || u.stats.buffered.Load() <= u.opt.MemoryBudget {
+		return
+	}
+	type candidate struct {
+		key        natKey
+		conn       *natConn
+		lastActive int64
+	}
+	var candidates []candidate
+	for _, key := range u.cache.Keys() {
+		conn, ok := u.cache.Peek(key)
+		if ok && conn.buffered.Load() > 0 {
+			candidates = append(candidates, candidate{key, conn, conn.lastActive.Load()})
+		}
+	}
+	// the keys are only ordered within a shard.
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(a.lastActive, b.lastActive)
+	})
+	for _, c := range candidates {
+		c.conn.close(CloseMemory)
+		u.cache.Remove(c.key)
+		if u.stats.buffered.Load() <= u.opt.MemoryBudget {
+			return
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package udpnat
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netio"
+)
+
+// CloseReason tells why a session was closed.
+type CloseReason uint8
+
+const (
+	// CloseExplicit is a session closed by Conn.Close, the admin APIs or UdpNat.Close.
+	CloseExplicit CloseReason = iota
+	// CloseTimeout is a session which has not received packets from its source for Option.Timeout.
+	CloseTimeout
+	// CloseCapacity is a session evicted as the least recently used one when the nat is full.
+	CloseCapacity
+	// CloseMemory is a session evicted to keep the buffered bytes within Option.MemoryBudget.
+	CloseMemory
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseExplicit:
+		return "explicit"
+	case CloseTimeout:
+		return "timeout"
+	case CloseCapacity:
+		return "capacity"
+	case CloseMemory:
+		return "memory"
+	default:
+		return "unknown"
+	}
+}
+
+// Counters is a snapshot of packet counters.
+// Upload is from the source to the destination, download is back to the source.
+// Dropped is the sum of the packets lost for any reason:
+// Overflowed by the overflow policy of a full queue, Filtered by the filtering behavior,
+// and Discarded while still queued when the session was closed.
+type Counters struct {
+	UploadPackets   uint64
+	UploadBytes     uint64
+	DownloadPackets uint64
+	DownloadBytes   uint64
+
+	Dropped    uint64
+	Overflowed uint64
+	Filtered   uint64
+	Discarded  uint64
+}
+
+// Session is a snapshot of an active session.
+type Session struct {
+	Source      addrs.Socksaddr
+	Destination addrs.Socksaddr
+	Created     time.Time
+	LastActive  time.Time
+
+	// Queued and BufferedBytes are the packets waiting to be read from the session.
+	Queued        int
+	BufferedBytes int64
+
+	Counters
+}
+
+// Stats is a snapshot of the aggregate counters of a nat, including closed sessions.
+type Stats struct {
+	Active  uint64
+	Created uint64
+	Closed  uint64
+
+	// BufferedBytes is the size of the packets queued in all sessions, see Option.MemoryBudget.
+	BufferedBytes int64
+
+	Counters
+}
+
+type counters struct {
+	netio.PacketCounters
+	overflowed atomic.Uint64
+	filtered   atomic.Uint64
+	discarded  atomic.Uint64
+}
+
+func (c *counters) load() Counters {
+	counters := Counters{
+		UploadPackets:   c.UploadPackets.Load(),
+		UploadBytes:     c.UploadBytes.Load(),
+		DownloadPackets: c.DownloadPackets.Load(),
+		DownloadBytes:   c.DownloadBytes.Load(),
+		Overflowed:      c.overflowed.Load(),
+		Filtered:        c.filtered.Load(),
+		Discarded:       c.discarded.Load(),
+	}
+	counters.Dropped = counters.Overflowed + counters.Filtered + counters.Discarded
+	return counters
+}
+
+type natStats struct {
+	counters
+	created  atomic.Uint64
+	closed   atomic.Uint64
+	buffered atomic.Int64
+}
+
+func (c *natConn) upload(n int) {
+	now := time.Now().UnixNano()
+	c.lastActive.Store(now)
+	c.lastUpload.Store(now)
+	for _, counter := range [...]*counters{&c.counters, &c.stats.counters} {
+		counter.UploadPackets.Add(1)
+		counter.UploadBytes.Add(uint64(n))
+	}
+}
+
+func (c *natConn) download(n int) {
+	c.lastActive.Store(time.Now().UnixNano())
+	for _, counter := range [...]*counters{&c.counters, &c.stats.counters} {
+		counter.DownloadPackets.Add(1)
+		counter.DownloadBytes.Add(uint64(n))
+	}
+}
+
+type dropReason uint8
+
+const (
+	dropOverflow dropReason = iota
+	dropFilter
+	dropDiscard
+)
+
+func (c *counters) dropped(reason dropReason) *atomic.Uint64 {
+	switch reason {
+	case dropOverflow:
+		return &c.overflowed
+	case dropFilter:
+		return &c.filtered
+	default:
+		return &c.discarded
+	}
+}
+
+func (c *natConn) drop(reason dropReason) {
+	c.counters.dropped(reason).Add(1)
+	c.stats.counters.dropped(reason).Add(1)
+}
+
+// evictReason tells a timeout from a capacity eviction by the last upload of the session.
+func (c *natConn) evictReason(timeout time.Duration) CloseReason {
+	if time.Since(time.Unix(0, c.lastUpload.Load())) >= timeout {
+		return CloseTimeout
+	}
+	return CloseCapacity
+}
+
+func (c *natConn) session() Session {
+	return Session{
+		Source:      c.source,
+		Destination: c.destination,
+		Created:     c.created,
+		LastActive:  time.Unix(0, c.lastActive.Load()),
+
+		Queued:        len(c.packets),
+		BufferedBytes: c.buffered.Load(),
+		Counters:      c.counters.load(),
+	}
+}
+
+// Sessions returns a snapshot of all active sessions.
+func (u *UdpNat) Sessions() []Session {
+	keys := u.cache.Keys()
+	sessions := make([]Session, 0, len(keys))
+	for _, key := range keys {
+		conn, ok := u.cache.Peek(key)
+		if ok && !conn.isClose() {
+			sessions = append(sessions, conn.session())
+		}
+	}
+	return sessions
+}
+
+// CloseSession closes all sessions of source and returns how many were closed.
+func (u *UdpNat) CloseSession(source netip.AddrPort) int {
+	return u.closeIf(func(key natKey) bool {
+		return key.source == source
+	})
+}
+
+// ClosePrefix closes all sessions whose source address is within prefix and returns how many were closed.
+func (u *UdpNat) ClosePrefix(prefix netip.Prefix) int {
+	return u.closeIf(func(key natKey) bool {
+		return prefix.Contains(key.source.Addr().Unmap()) || prefix.Contains(key.source.Addr())
+	})
+}
+
+func (u *UdpNat) closeIf(match func(key natKey) bool) int {
+	var closed int
+	for _, key := range u.cache.Keys() {
+		if !match(key) {
+			continue
+		}
+		conn, ok := u.cache.Peek(key)
+		if !ok {
+			continue
+		}
+		if !conn.isClose() {
+			closed++
+		}
+		// close before removing, so the eviction callback sees an already closed session.
+		conn.close(CloseExplicit)
+		u.cache.Remove(key)
+	}
+	return closed
+}
+
+// Stats returns the aggregate counters of the nat.
+func (u *UdpNat) Stats() Stats {
+	// load closed first, a session is always created before it is closed.
+	closed := u.stats.closed.Load()
+	created := u.stats.created.Load()
+	return Stats{
+		Active:  created - closed,
+		Created: created,
+		Closed:  closed,
+
+		BufferedBytes: u.stats.buffered.Load(),
+		Counters:      u.stats.load(),
+	}
+}
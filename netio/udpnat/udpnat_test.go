@@ -5,6 +5,7 @@ import (
 	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/qtraffics/qnetwork/addrs"
 	"github.com/qtraffics/qnetwork/netio"
@@ -34,7 +35,7 @@ type natCases struct {
 	Data      []*buf.Buffer
 
 	OnConn  func(t *testing.T, c *natConn)
-	OnClose func(c Conn)
+	OnClose func(c Conn, reason CloseReason)
 }
 
 func (c natCases) Exec(t *testing.T, u *UdpNat) {
@@ -135,3 +136,292 @@ func TestMulti(t *testing.T) {
 		c.Exec(t, udpnat)
 	}
 }
+
+func TestMapping(t *testing.T) {
+	source := addrs.FromAddrPort(netip.MustParseAddrPort("10.0.0.1:5000"))
+	destinations := []addrs.Socksaddr{
+		addrs.FromAddrPort(netip.MustParseAddrPort("1.1.1.1:53")),
+		addrs.FromAddrPort(netip.MustParseAddrPort("1.1.1.1:853")),
+		addrs.FromAddrPort(netip.MustParseAddrPort("8.8.8.8:53")),
+		addrs.FromAddrPort(netip.MustParseAddrPort("[::ffff:8.8.8.8]:53")),
+	}
+	cases := map[Behavior]int{
+		EndpointIndependent:     1,
+		AddressDependent:        2,
+		AddressAndPortDependent: 3,
+	}
+	for mapping, sessions := range cases {
+		t.Run(mapping.String(), func(t *testing.T) {
+			var prepared int
+			nat, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+				prepared++
+				return PrepareResult{Success: true, PacketWriter: &mockPacketWriter{}}
+			}, &Option{Mapping: mapping})
+			require.NoError(t, err)
+			defer nat.Close()
+
+			conns := make(map[Conn]struct{})
+			for _, destination := range destinations {
+				conn, _ := nat.NewPacket(buf.As([]byte(test)), source, destination)
+				require.NotNil(t, conn)
+				conns[conn] = struct{}{}
+			}
+			assert.Equal(t, sessions, prepared)
+			assert.Len(t, conns, sessions)
+		})
+	}
+}
+
+func TestFiltering(t *testing.T) {
+	source := addrs.FromAddrPort(netip.MustParseAddrPort("10.0.0.1:5000"))
+	contacted := addrs.FromAddrPort(netip.MustParseAddrPort("1.1.1.1:53"))
+	remotes := []net.Addr{
+		contacted.UDPAddr(),
+		addrs.FromAddrPort(netip.MustParseAddrPort("1.1.1.1:853")).UDPAddr(),
+		addrs.FromAddrPort(netip.MustParseAddrPort("8.8.8.8:53")).UDPAddr(),
+	}
+	cases := map[Behavior]int{
+		EndpointIndependent:     3,
+		AddressDependent:        2,
+		AddressAndPortDependent: 1,
+	}
+	for filtering, accepted := range cases {
+		t.Run(filtering.String(), func(t *testing.T) {
+			writer := &mockPacketWriter{}
+			nat, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+				return PrepareResult{Success: true, PacketWriter: writer}
+			}, &Option{Filtering: filtering})
+			require.NoError(t, err)
+			defer nat.Close()
+
+			conn, _ := nat.NewPacket(buf.As([]byte(test)), source, contacted)
+			require.NotNil(t, conn)
+			for _, remote := range remotes {
+				n, err := conn.WriteTo([]byte(test), remote)
+				require.NoError(t, err)
+				assert.Equal(t, len(test), n)
+			}
+			assert.Equal(t, accepted*len(test), writer.size)
+		})
+	}
+}
+
+func TestInvalidBehavior(t *testing.T) {
+	_, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+		return PrepareResult{}
+	}, &Option{Mapping: AddressAndPortDependent + 1})
+	require.Error(t, err)
+}
+
+func TestSessions(t *testing.T) {
+	writer := &mockPacketWriter{}
+	reasons := make(map[netip.AddrPort]CloseReason)
+	nat, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+		return PrepareResult{
+			Success:      true,
+			PacketWriter: writer,
+			OnClose: func(conn Conn, reason CloseReason) {
+				reasons[addrs.FromNetAddr(conn.RemoteAddr()).AddrPort()] = reason
+			},
+		}
+	}, nil)
+	require.NoError(t, err)
+	defer nat.Close()
+
+	destination := addrs.FromAddrPort(netip.MustParseAddrPort("1.1.1.1:53"))
+	sources := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.1:5000"),
+		netip.MustParseAddrPort("10.0.0.2:5000"),
+		netip.MustParseAddrPort("10.0.1.1:5000"),
+	}
+	for _, source := range sources {
+		conn, _ := nat.NewPacket(buf.As([]byte(test)), addrs.FromAddrPort(source), destination)
+		require.NotNil(t, conn)
+		_, err = conn.Write([]byte(test))
+		require.NoError(t, err)
+	}
+	// overflow the queue of the first session
+	for range 70 {
+		nat.NewPacket(buf.As([]byte(test)), addrs.FromAddrPort(sources[0]), destination)
+	}
+
+	sessions := nat.Sessions()
+	require.Len(t, sessions, len(sources))
+	for _, session := range sessions {
+		assert.Equal(t, destination, session.Destination)
+		assert.False(t, session.Created.IsZero())
+		assert.False(t, session.LastActive.Before(session.Created))
+		assert.Equal(t, uint64(1), session.DownloadPackets)
+		assert.Equal(t, uint64(len(test)), session.DownloadBytes)
+		if session.Source.AddrPort() == sources[0] {
+			assert.Equal(t, uint64(64), session.UploadPackets)
+			assert.Equal(t, uint64(7), session.Dropped)
+		} else {
+			assert.Equal(t, uint64(1), session.UploadPackets)
+			assert.Zero(t, session.Dropped)
+		}
+	}
+
+	assert.Equal(t, 1, nat.CloseSession(sources[0]))
+	assert.Equal(t, 1, nat.ClosePrefix(netip.MustParsePrefix("10.0.0.0/24")))
+	assert.Zero(t, nat.ClosePrefix(netip.MustParsePrefix("10.0.0.0/24")))
+	assert.Equal(t, map[netip.AddrPort]CloseReason{sources[0]: CloseExplicit, sources[1]: CloseExplicit}, reasons)
+	require.Len(t, nat.Sessions(), 1)
+
+	stats := nat.Stats()
+	assert.Equal(t, uint64(3), stats.Created)
+	assert.Equal(t, uint64(2), stats.Closed)
+	assert.Equal(t, uint64(1), stats.Active)
+	assert.Equal(t, uint64(66), stats.UploadPackets)
+	assert.Equal(t, uint64(3), stats.DownloadPackets)
+	assert.Equal(t, uint64(7), stats.Overflowed)
+	// queued packets of the closed sessions
+	assert.Equal(t, uint64(65), stats.Discarded)
+	assert.Equal(t, uint64(72), stats.Dropped)
+	assert.Equal(t, int64(len(test)), stats.BufferedBytes)
+}
+
+func TestEvictReason(t *testing.T) {
+	reasons := make(map[netip.AddrPort]CloseReason)
+	nat, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+		return PrepareResult{
+			Success:      true,
+			PacketWriter: &mockPacketWriter{},
+			Handler:      PacketHandlerFunc(netio.PutPacket),
+			OnClose: func(conn Conn, reason CloseReason) {
+				reasons[addrs.FromNetAddr(conn.RemoteAddr()).AddrPort()] = reason
+			},
+		}
+	}, &Option{Size: 1, Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer nat.Close()
+
+	first := netip.MustParseAddrPort("10.0.0.1:5000")
+	second := netip.MustParseAddrPort("10.0.0.2:5000")
+	nat.NewPacket(buf.As([]byte(test)), addrs.FromAddrPort(first), addrs.Socksaddr{})
+	nat.NewPacket(buf.As([]byte(test)), addrs.FromAddrPort(second), addrs.Socksaddr{})
+	assert.Equal(t, CloseCapacity, reasons[first])
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Empty(t, nat.Sessions())
+	assert.Equal(t, CloseTimeout, reasons[second])
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	source := addrs.FromAddrPort(netip.MustParseAddrPort("10.0.0.1:5000"))
+	newNat := func(t *testing.T, policy OverflowPolicy) *UdpNat {
+		nat, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+			return PrepareResult{Success: true, PacketWriter: &mockPacketWriter{}}
+		}, &Option{QueueSize: 2, Overflow: policy, QueueWait: 20 * time.Millisecond})
+		require.NoError(t, err)
+		return nat
+	}
+	send := func(nat *UdpNat, data ...string) Conn {
+		var conn Conn
+		for _, d := range data {
+			conn, _ = nat.NewPacket(buf.As([]byte(d)), source, addrs.Socksaddr{})
+		}
+		return conn
+	}
+	readAll := func(t *testing.T, conn Conn) []string {
+		var data []string
+		buffer := make([]byte, 64)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return data
+			}
+			data = append(data, string(buffer[:n]))
+		}
+	}
+
+	t.Run(DropNewest.String(), func(t *testing.T) {
+		nat := newNat(t, DropNewest)
+		defer nat.Close()
+		conn := send(nat, "1", "2", "3")
+		assert.Equal(t, []string{"1", "2"}, readAll(t, conn))
+		assert.Equal(t, uint64(1), nat.Stats().Overflowed)
+	})
+	t.Run(DropOldest.String(), func(t *testing.T) {
+		nat := newNat(t, DropOldest)
+		defer nat.Close()
+		conn := send(nat, "1", "2", "3")
+		assert.Equal(t, []string{"2", "3"}, readAll(t, conn))
+		assert.Equal(t, uint64(1), nat.Stats().Overflowed)
+	})
+	t.Run(Block.String(), func(t *testing.T) {
+		nat := newNat(t, Block)
+		defer nat.Close()
+		conn := send(nat, "1", "2")
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			buffer := make([]byte, 64)
+			_, _ = conn.Read(buffer)
+		}()
+		start := time.Now()
+		send(nat, "3")
+		assert.Less(t, time.Since(start), 20*time.Millisecond)
+		assert.Zero(t, nat.Stats().Overflowed)
+
+		start = time.Now()
+		send(nat, "4")
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+		assert.Equal(t, uint64(1), nat.Stats().Overflowed)
+		assert.Equal(t, []string{"2", "3"}, readAll(t, conn))
+	})
+}
+
+func TestMemoryBudget(t *testing.T) {
+	reasons := make(map[netip.AddrPort]CloseReason)
+	nat, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+		return PrepareResult{
+			Success:      true,
+			PacketWriter: &mockPacketWriter{},
+			OnClose: func(conn Conn, reason CloseReason) {
+				reasons[addrs.FromNetAddr(conn.RemoteAddr()).AddrPort()] = reason
+			},
+		}
+	}, &Option{MemoryBudget: int64(3 * len(test))})
+	require.NoError(t, err)
+	defer nat.Close()
+
+	first := netip.MustParseAddrPort("10.0.0.1:5000")
+	second := netip.MustParseAddrPort("10.0.0.2:5000")
+	for range 2 {
+		nat.NewPacket(buf.As([]byte(test)), addrs.FromAddrPort(first), addrs.Socksaddr{})
+	}
+	for range 2 {
+		nat.NewPacket(buf.As([]byte(test)), addrs.FromAddrPort(second), addrs.Socksaddr{})
+	}
+	assert.Equal(t, map[netip.AddrPort]CloseReason{first: CloseMemory}, reasons)
+	stats := nat.Stats()
+	assert.Equal(t, int64(2*len(test)), stats.BufferedBytes)
+	assert.Equal(t, uint64(2), stats.Discarded)
+	sessions := nat.Sessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, second, sessions[0].Source.AddrPort())
+	assert.Equal(t, 2, sessions[0].Queued)
+}
+
+func TestPacketBatchLocalAddr(t *testing.T) {
+	var prepared addrs.Socksaddr
+	nat, err := New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) PrepareResult {
+		prepared = destination
+		return PrepareResult{Success: true, PacketWriter: &mockPacketWriter{}}
+	}, nil)
+	require.NoError(t, err)
+	defer nat.Close()
+
+	// the local address the packet arrived on is not where it is forwarded to
+	target := addrs.FromAddrPort(netip.MustParseAddrPort("192.0.2.1:53"))
+	pack := netio.NewPacket(buf.As([]byte(test)), nil)
+	pack.Addr = addrs.FromAddrPort(netip.MustParseAddrPort("10.0.0.1:5000"))
+	pack.LocalAddr = netip.MustParseAddr("10.0.0.254")
+	nat.NewPacketBatch([]netio.UDPPacket{pack}, target)
+
+	assert.Equal(t, target, prepared)
+	sessions := nat.Sessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, target, sessions[0].Destination)
+}
@@ -0,0 +1,203 @@
+// Package uot carries datagrams over a stream conn, for networks blocking UDP.
+//
+// A stream starts with a request telling if it is connected to a single destination:
+//
+//	version(1) connected(1) [destination]
+//
+// Each datagram is then framed with its length, prefixed with its address on the
+// streams that are not connected. The address of a datagram sent by the client is
+// its destination, of a datagram sent by the server its source:
+//
+//	[address] length(2) payload
+//
+// Addresses are encoded in the SOCKS wire format.
+package uot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netio"
+	"github.com/qtraffics/qtfra/buf"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+const protocolVersion = 0
+
+// MaxPacketSize is the largest datagram a frame can carry.
+const MaxPacketSize = math.MaxUint16
+
+var (
+	_ net.PacketConn = (*Conn)(nil)
+	_ net.Conn       = (*Conn)(nil)
+)
+
+// Request is the header of a stream, a dialable Destination makes the stream connected.
+type Request struct {
+	Destination addrs.Socksaddr
+}
+
+func (r Request) connected() bool {
+	return r.Destination.Dialable()
+}
+
+// WriteRequest writes the header of a stream.
+func WriteRequest(w io.Writer, request Request) error {
+	b := []byte{protocolVersion, 0}
+	if request.connected() {
+		b[1] = 1
+		var err error
+		b, err = addrs.AppendSocksaddr(b, request.Destination)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadRequest reads the header of a stream.
+func ReadRequest(r io.Reader) (Request, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Request{}, err
+	}
+	if b[0] != protocolVersion {
+		return Request{}, ex.New("uot: unknown version ", b[0])
+	}
+	switch b[1] {
+	case 0:
+		return Request{}, nil
+	case 1:
+		destination, err := addrs.ReadSocksaddr(r)
+		if err != nil {
+			return Request{}, err
+		}
+		return Request{Destination: destination}, nil
+	default:
+		return Request{}, ex.New("uot: bad request")
+	}
+}
+
+// Conn is a packet conn over a stream conn. On a connected stream Read and Write
+// exchange datagrams with the destination, which the addresses given to WriteTo do not change.
+type Conn struct {
+	net.Conn
+	request Request
+
+	readAccess  sync.Mutex
+	reader      *bufio.Reader
+	writeAccess sync.Mutex
+}
+
+// NewConn sends request on conn, the client end of a stream to an UoT server.
+func NewConn(conn net.Conn, request Request) (*Conn, error) {
+	if err := WriteRequest(conn, request); err != nil {
+		return nil, err
+	}
+	return newConn(conn, request), nil
+}
+
+func newConn(conn net.Conn, request Request) *Conn {
+	return &Conn{
+		Conn:    conn,
+		request: request,
+		reader:  bufio.NewReader(conn),
+	}
+}
+
+// readPacket reads the next datagram into a new buffer.
+func (c *Conn) readPacket() (*buf.Buffer, addrs.Socksaddr, error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	address := c.request.Destination
+	if !c.request.connected() {
+		var err error
+		address, err = addrs.ReadSocksaddr(c.reader)
+		if err != nil {
+			return nil, addrs.Socksaddr{}, err
+		}
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(c.reader, length[:]); err != nil {
+		return nil, addrs.Socksaddr{}, err
+	}
+	buffer := buf.NewSize(int(binary.BigEndian.Uint16(length[:])))
+	if _, err := buffer.ReadFull(c.reader, buffer.Size()); err != nil {
+		buffer.Free()
+		return nil, addrs.Socksaddr{}, err
+	}
+	return buffer, address, nil
+}
+
+// ReadFrom reads a datagram, the part not fitting in p is discarded.
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buffer, address, err := c.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer buffer.Free()
+	return copy(p, buffer.Bytes()), netio.PacketAddr(address), nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+// WriteTo writes a datagram to addr, which is ignored when the stream is connected.
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > MaxPacketSize {
+		return 0, ex.New("uot: packet too large: ", len(p))
+	}
+	var (
+		frame []byte
+		err   error
+	)
+	if !c.request.connected() {
+		address, isSocksaddr := addr.(addrs.Socksaddr)
+		if !isSocksaddr {
+			address = addrs.FromNetAddr(addr)
+		}
+		frame, err = addrs.AppendSocksaddr(make([]byte, 0, addrs.SocksaddrLen(address)+2+len(p)), address)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		frame = make([]byte, 0, 2+len(p))
+	}
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(p)))
+	frame = append(frame, p...)
+
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if _, err = c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write writes a datagram to the destination of a connected stream.
+func (c *Conn) Write(p []byte) (int, error) {
+	if !c.request.connected() {
+		return 0, ex.New("uot: write on a stream not connected")
+	}
+	return c.WriteTo(p, nil)
+}
+
+// RemoteAddr returns the destination of a connected stream, or the address of the stream peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.request.connected() {
+		return netio.PacketAddr(c.request.Destination)
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) UnderlayConn() net.Conn {
+	return c.Conn
+}
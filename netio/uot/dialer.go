@@ -0,0 +1,60 @@
+package uot
+
+import (
+	"context"
+	"net"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+var _ dialer.Dialer = (*Dialer)(nil)
+
+// Dialer carries the UDP of a dialer over streams to an UoT server.
+//
+// DialContext over UDP returns a connected stream, ListenPacket a stream sending to
+// any destination. The other networks are dialed directly.
+type Dialer struct {
+	dialer.Dialer
+	server addrs.Socksaddr
+}
+
+// NewDialer creates a Dialer reaching the server at server through d.
+func NewDialer(d dialer.Dialer, server addrs.Socksaddr) (*Dialer, error) {
+	if d == nil {
+		return nil, ex.New("dialer required")
+	}
+	if !server.Dialable() {
+		return nil, ex.New("invalid server address: ", server)
+	}
+	return &Dialer{Dialer: d, server: server}, nil
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	if network.Protocol != meta.ProtocolUDP {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	if !address.Dialable() {
+		return nil, &net.OpError{Op: "dial", Net: network.String(), Addr: address, Err: ex.New("invalid address")}
+	}
+	return d.dial(ctx, Request{Destination: address})
+}
+
+func (d *Dialer) ListenPacket(ctx context.Context, _ addrs.Socksaddr) (net.PacketConn, error) {
+	return d.dial(ctx, Request{})
+}
+
+func (d *Dialer) dial(ctx context.Context, request Request) (*Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, meta.NetworkTCP, d.server)
+	if err != nil {
+		return nil, err
+	}
+	uotConn, err := NewConn(conn, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return uotConn, nil
+}
@@ -0,0 +1,101 @@
+package uot
+
+import (
+	"net"
+	"sync"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netio"
+	"github.com/qtraffics/qnetwork/netio/udpnat"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+// Server feeds the datagrams of UoT streams into a nat, the sessions of a stream
+// reply through it.
+type Server struct {
+	nat     *udpnat.UdpNat
+	handler func(conn udpnat.Conn)
+
+	access sync.RWMutex
+	conns  map[addrs.Socksaddr]*Conn
+}
+
+// NewServer creates the nat of the streams. prepare decides the sessions as usual,
+// but their PacketWriter is replaced by the stream of the source. handler, if not nil,
+// is started in a goroutine for each new session, it replies with WriteTo.
+func NewServer(prepare udpnat.PrepareFunc, handler func(conn udpnat.Conn), option *udpnat.Option) (*Server, error) {
+	if prepare == nil {
+		return nil, ex.New("prepare func required")
+	}
+	s := &Server{handler: handler, conns: make(map[addrs.Socksaddr]*Conn)}
+	nat, err := udpnat.New(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) udpnat.PrepareResult {
+		s.access.RLock()
+		conn := s.conns[source]
+		s.access.RUnlock()
+		if conn == nil {
+			return udpnat.PrepareResult{}
+		}
+		result := prepare(source, destination, p)
+		result.PacketWriter = conn
+		return result
+	}, option)
+	if err != nil {
+		return nil, err
+	}
+	s.nat = nat
+	return s, nil
+}
+
+// NAT returns the nat fed by the server.
+func (s *Server) NAT() *udpnat.UdpNat {
+	return s.nat
+}
+
+// Serve reads the request and the datagrams of conn, the server end of an UoT stream,
+// until it fails, then closes conn and the sessions of source.
+//
+// source identifies the client in the nat and must be unique among the streams served
+// at once, the remote address of conn is used when it is not valid. Give distinct sources
+// to streams sharing a remote address, like the streams of a mux.Session.
+func (s *Server) Serve(conn net.Conn, source addrs.Socksaddr) error {
+	defer conn.Close()
+	if !source.Addr.IsValid() {
+		source = addrs.FromNetAddr(conn.RemoteAddr())
+	}
+	request, err := ReadRequest(conn)
+	if err != nil {
+		return ex.Cause(err, "uot: read request")
+	}
+	serverConn := newConn(conn, request)
+
+	s.access.Lock()
+	if s.conns[source] != nil {
+		s.access.Unlock()
+		return ex.New("uot: source already served: ", source)
+	}
+	s.conns[source] = serverConn
+	s.access.Unlock()
+	defer func() {
+		s.access.Lock()
+		delete(s.conns, source)
+		s.access.Unlock()
+		s.nat.CloseSession(source.AddrPort())
+	}()
+
+	for {
+		buffer, destination, err := serverConn.readPacket()
+		if err != nil {
+			return err
+		}
+		session, isNew := s.nat.NewPacket(buffer, source, destination)
+		if session == nil {
+			buffer.Free()
+		} else if isNew && s.handler != nil {
+			go s.handler(session)
+		}
+	}
+}
+
+func (s *Server) Close() error {
+	return s.nat.Close()
+}
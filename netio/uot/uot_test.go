@@ -0,0 +1,174 @@
+package uot
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netio"
+	"github.com/qtraffics/qnetwork/netio/udpnat"
+	"github.com/qtraffics/qnetwork/resolve/transport"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// netDialer dials with the standard library, the tests only dial addresses.
+type netDialer struct{}
+
+func (netDialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network.String(), address.String())
+}
+
+func (netDialer) ListenPacket(ctx context.Context, _ addrs.Socksaddr) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp", "127.0.0.1:0")
+}
+
+// listenDNS answers every query with an A record of 192.0.2.1.
+func listenDNS(t *testing.T) addrs.Socksaddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var request dns.Msg
+			if request.Unpack(buffer[:n]) != nil || len(request.Question) != 1 {
+				continue
+			}
+			response := new(dns.Msg).SetReply(&request)
+			response.Answer = append(response.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+			raw, _ := response.Pack()
+			_, _ = conn.WriteTo(raw, addr)
+		}
+	}()
+	return addrs.FromNetAddr(conn.LocalAddr())
+}
+
+// relay forwards the packets of a session over UDP and writes the replies back.
+func relay(session udpnat.Conn) {
+	defer session.Close()
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go func() {
+		buffer := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if _, err = session.WriteTo(buffer[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+	reader := session.(netio.PacketReader)
+	for {
+		packet, err := reader.ReadPacket()
+		if err != nil {
+			return
+		}
+		_, err = conn.WriteTo(packet.Buf.Bytes(), packet.Addr.UDPAddr())
+		netio.PutPacket(packet)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func listenServer(t *testing.T) addrs.Socksaddr {
+	server, err := NewServer(func(source addrs.Socksaddr, destination addrs.Socksaddr, p netio.UDPPacket) udpnat.PrepareResult {
+		return udpnat.PrepareResult{Success: true}
+	}, relay, nil)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+		server.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.Serve(conn, addrs.Socksaddr{})
+		}
+	}()
+	return addrs.FromNetAddr(listener.Addr())
+}
+
+func TestRequest(t *testing.T) {
+	for _, request := range []Request{
+		{},
+		{Destination: addrs.FromParseSocksaddr("127.0.0.1:53")},
+		{Destination: addrs.FromParseSocksaddr("[2001:db8::1]:443")},
+		{Destination: addrs.FromParseSocksaddr("example.com:443")},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			assert.NoError(t, WriteRequest(client, request))
+		}()
+		read, err := ReadRequest(server)
+		require.NoError(t, err)
+		assert.Equal(t, request, read)
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	dnsServer := listenDNS(t)
+	d, err := NewDialer(netDialer{}, listenServer(t))
+	require.NoError(t, err)
+	conn, err := d.ListenPacket(context.Background(), addrs.Socksaddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	query, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+	require.NoError(t, err)
+	_, err = conn.WriteTo(query, dnsServer.UDPAddr())
+	require.NoError(t, err)
+	buffer := make([]byte, MaxPacketSize)
+	n, addr, err := conn.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, dnsServer.AddrPort(), netip.MustParseAddrPort(addr.String()))
+	var response dns.Msg
+	require.NoError(t, response.Unpack(buffer[:n]))
+	require.Len(t, response.Answer, 1)
+}
+
+func TestDNS(t *testing.T) {
+	d, err := NewDialer(netDialer{}, listenServer(t))
+	require.NoError(t, err)
+	dnsTransport := transport.NewUDP(listenDNS(t), transport.UDPTransportOptions{Dialer: d})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for range 3 {
+		response, err := dnsTransport.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, response.Answer, 1)
+		assert.Equal(t, "192.0.2.1", response.Answer[0].(*dns.A).A.String())
+	}
+
+	_, err = d.DialContext(ctx, meta.NetworkUDP, addrs.Socksaddr{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,11 @@
+package netvars
+
+import "time"
+
+const (
+	DefaultMuxMaxStreams        = 1024
+	DefaultMuxStreamWindow      = 256 << 10
+	DefaultMuxAcceptBacklog     = 256
+	DefaultMuxKeepAliveInterval = 30 * time.Second
+	DefaultMuxKeepAliveTimeout  = 15 * time.Second
+)
@@ -0,0 +1,11 @@
+package netvars
+
+import "time"
+
+const (
+	DefaultProxyHandshakeTimeout = 10 * time.Second
+	DefaultSocksBindTimeout      = 2 * time.Minute
+
+	DefaultProxyIdleTimeout         = 90 * time.Second
+	DefaultProxyMaxIdleConnsPerHost = 16
+)
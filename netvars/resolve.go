@@ -6,6 +6,11 @@ const (
 	DefaultResolverReadTimeout = 5 * time.Second
 	DefaultResolverTTL         = 600 // seconds
 	DefaultResolverCacheSize   = 1024
+	DefaultResolverIdleTimeout = 30 * time.Second
+	DefaultResolverMaxConns    = 4
+
+	// DNSPaddingBlockSize pads the queries over encrypted transports, as recommended by RFC 8467.
+	DNSPaddingBlockSize = 128
 
 	MaxDNSUDPSize = 1232
 )
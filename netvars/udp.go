@@ -6,4 +6,6 @@ const (
 	DefaultUDPReadBufferSize = 65507
 	DefaultUDPKeepAlive      = 60 * time.Second
 	DefaultUDPConnSize       = 1024
+	DefaultUDPQueueSize      = 64
+	DefaultUDPQueueWait      = 100 * time.Millisecond
 )
@@ -0,0 +1,277 @@
+package transport
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/ex"
+	"github.com/qtraffics/qtfra/values"
+
+	"github.com/miekg/dns"
+)
+
+var ErrInvalidGroupStrategy = ex.New("invalid group strategy")
+
+type GroupStrategy uint8
+
+const (
+	GroupParallel   GroupStrategy = iota // "parallel"
+	GroupFailover                        // "failover"
+	GroupFastest                         // "fastest"
+	GroupRandom                          // "random"
+	GroupRoundRobin                      // "round_robin"
+
+	groupStrategyMax
+)
+
+func (s GroupStrategy) String() string {
+	switch s {
+	case GroupParallel:
+		return "parallel"
+	case GroupFailover:
+		return "failover"
+	case GroupFastest:
+		return "fastest"
+	case GroupRandom:
+		return "random"
+	case GroupRoundRobin:
+		return "round_robin"
+	default:
+		return fmt.Sprintf("group strategy: %d", uint8(s))
+	}
+}
+
+func (s GroupStrategy) IsValid() bool {
+	return s < groupStrategyMax
+}
+
+func ParseGroupStrategy(s string) (GroupStrategy, error) {
+	switch s {
+	case "parallel", "":
+		return GroupParallel, nil
+	case "failover":
+		return GroupFailover, nil
+	case "fastest":
+		return GroupFastest, nil
+	case "random":
+		return GroupRandom, nil
+	case "round_robin":
+		return GroupRoundRobin, nil
+	default:
+		return 0, ex.Cause(ErrInvalidGroupStrategy, s)
+	}
+}
+
+type GroupTransportOptions struct {
+	// Strategy selects the upstreams of each query. GroupParallel queries all of them and
+	// takes the first success, the others query one upstream at a time and fall back to
+	// the next ones in order on failure.
+	Strategy GroupStrategy
+	// Timeout bounds the exchange with each upstream. Default to
+	// netvars.DefaultResolverReadTimeout.
+	Timeout time.Duration
+}
+
+// UpstreamStats are the statistics of an upstream of a GroupTransport.
+type UpstreamStats struct {
+	Queries  uint64
+	Failures uint64
+	// RTT is the moving average of the round trip time, where a failure counts as the
+	// timeout. Zero before the first exchange.
+	RTT time.Duration
+}
+
+var _ Transport = (*GroupTransport)(nil)
+
+// GroupTransport queries a group of upstreams. An error, a timeout, or a SERVFAIL or
+// REFUSED response is a failure of the upstream, the query is then retried on the others.
+type GroupTransport struct {
+	upstreams []*groupUpstream
+	strategy  GroupStrategy
+	timeout   time.Duration
+	next      atomic.Uint32
+}
+
+type groupUpstream struct {
+	Transport
+
+	access sync.Mutex
+	stats  UpstreamStats
+}
+
+// record updates the statistics with an exchange, with the exponentially weighted moving
+// average of the round trip times of factor 1/8 as in RFC 6298.
+func (u *groupUpstream) record(rtt time.Duration, failed bool) {
+	u.access.Lock()
+	defer u.access.Unlock()
+	u.stats.Queries++
+	if failed {
+		u.stats.Failures++
+	}
+	if u.stats.RTT == 0 {
+		u.stats.RTT = rtt
+	} else {
+		u.stats.RTT += (rtt - u.stats.RTT) / 8
+	}
+}
+
+func (u *groupUpstream) loadStats() UpstreamStats {
+	u.access.Lock()
+	defer u.access.Unlock()
+	return u.stats
+}
+
+func NewGroupTransport(transports []Transport, options GroupTransportOptions) (*GroupTransport, error) {
+	if len(transports) == 0 {
+		return nil, ex.New("group: no upstream")
+	}
+	if !options.Strategy.IsValid() {
+		return nil, ex.Cause(ErrInvalidGroupStrategy, options.Strategy.String())
+	}
+	upstreams := make([]*groupUpstream, 0, len(transports))
+	for _, transport := range transports {
+		upstreams = append(upstreams, &groupUpstream{Transport: transport})
+	}
+	return &GroupTransport{
+		upstreams: upstreams,
+		strategy:  options.Strategy,
+		timeout:   values.UseDefault(options.Timeout, netvars.DefaultResolverReadTimeout),
+	}, nil
+}
+
+func (t *GroupTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if t.strategy == GroupParallel {
+		return t.exchangeParallel(ctx, message)
+	}
+	var (
+		failedResponse *dns.Msg
+		errors         []error
+	)
+	for _, upstream := range t.order() {
+		response, err := t.exchange(ctx, upstream, message)
+		if err != nil {
+			errors = append(errors, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if !isFailure(response) {
+			return response, nil
+		}
+		failedResponse = response
+	}
+	// the failure response of the last upstream answering
+	if failedResponse != nil {
+		return failedResponse, nil
+	}
+	return nil, ex.Errors(errors...)
+}
+
+func (t *GroupTransport) exchangeParallel(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	// the losers are cancelled once a response is taken
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type exchangeResult struct {
+		response *dns.Msg
+		err      error
+	}
+	results := make(chan exchangeResult, len(t.upstreams))
+	for _, upstream := range t.upstreams {
+		go func() {
+			response, err := t.exchange(raceCtx, upstream, message.Copy())
+			results <- exchangeResult{response: response, err: err}
+		}()
+	}
+	var (
+		failedResponse *dns.Msg
+		errors         []error
+	)
+	for range t.upstreams {
+		result := <-results
+		if result.err != nil {
+			errors = append(errors, result.err)
+			continue
+		}
+		if !isFailure(result.response) {
+			return result.response, nil
+		}
+		failedResponse = result.response
+	}
+	if failedResponse != nil {
+		return failedResponse, nil
+	}
+	return nil, ex.Errors(errors...)
+}
+
+// exchange queries an upstream, its statistics are not updated when ctx is done.
+func (t *GroupTransport) exchange(ctx context.Context, upstream *groupUpstream, message *dns.Msg) (*dns.Msg, error) {
+	exchangeCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	start := time.Now()
+	response, err := upstream.Exchange(exchangeCtx, message)
+	if ctx.Err() == nil {
+		if err != nil || isFailure(response) {
+			upstream.record(t.timeout, true)
+		} else {
+			upstream.record(time.Since(start), false)
+		}
+	}
+	return response, err
+}
+
+// order returns the upstreams in the order of the strategy.
+func (t *GroupTransport) order() []*groupUpstream {
+	switch t.strategy {
+	case GroupFastest:
+		// the upstreams without exchange yet are tried first
+		upstreams := slices.Clone(t.upstreams)
+		slices.SortStableFunc(upstreams, func(a, b *groupUpstream) int {
+			return cmp.Compare(a.loadStats().RTT, b.loadStats().RTT)
+		})
+		return upstreams
+	case GroupRandom:
+		upstreams := slices.Clone(t.upstreams)
+		rand.Shuffle(len(upstreams), func(i, j int) {
+			upstreams[i], upstreams[j] = upstreams[j], upstreams[i]
+		})
+		return upstreams
+	case GroupRoundRobin:
+		start := int((t.next.Add(1) - 1) % uint32(len(t.upstreams)))
+		return append(slices.Clone(t.upstreams[start:]), t.upstreams[:start]...)
+	default:
+		return t.upstreams
+	}
+}
+
+// Stats returns the statistics of the upstreams, in the order of the transports.
+func (t *GroupTransport) Stats() []UpstreamStats {
+	stats := make([]UpstreamStats, 0, len(t.upstreams))
+	for _, upstream := range t.upstreams {
+		stats = append(stats, upstream.loadStats())
+	}
+	return stats
+}
+
+// Close closes the upstreams.
+func (t *GroupTransport) Close() error {
+	var errors []error
+	for _, upstream := range t.upstreams {
+		if closer, ok := upstream.Transport.(io.Closer); ok {
+			errors = append(errors, closer.Close())
+		}
+	}
+	return ex.Errors(errors...)
+}
+
+func isFailure(response *dns.Msg) bool {
+	return response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused
+}
@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netvars"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errUpstream = errors.New("upstream down")
+
+// upstream answers with address after delay, with rcode if not success, or fails with err.
+func upstream(address string, delay time.Duration, rcode int, err error) Transport {
+	return exchangeFunc(func(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		response := FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr(address)}, 60)
+		response.Rcode = rcode
+		return response, nil
+	})
+}
+
+func exchangeAddress(t *testing.T, transport Transport) string {
+	response, err := transport.Exchange(context.Background(), query("a.test."))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 1)
+	return response.Answer[0].(*dns.A).A.String()
+}
+
+func TestGroupParallel(t *testing.T) {
+	transport, err := NewGroupTransport([]Transport{
+		upstream("192.0.2.1", 50*time.Millisecond, dns.RcodeSuccess, nil),
+		upstream("192.0.2.2", 0, dns.RcodeServerFailure, nil),
+		upstream("192.0.2.3", 0, dns.RcodeSuccess, errUpstream),
+	}, GroupTransportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", exchangeAddress(t, transport))
+	assert.Equal(t, []UpstreamStats{
+		{Queries: 1, RTT: transport.Stats()[0].RTT},
+		{Queries: 1, Failures: 1, RTT: netvars.DefaultResolverReadTimeout},
+		{Queries: 1, Failures: 1, RTT: netvars.DefaultResolverReadTimeout},
+	}, transport.Stats())
+
+	// the slower upstreams are cancelled without counting as failures
+	transport, err = NewGroupTransport([]Transport{
+		upstream("192.0.2.1", time.Second, dns.RcodeSuccess, nil),
+		upstream("192.0.2.2", 0, dns.RcodeSuccess, nil),
+	}, GroupTransportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2", exchangeAddress(t, transport))
+	assert.Zero(t, transport.Stats()[0].Queries)
+}
+
+func TestGroupFailover(t *testing.T) {
+	transport, err := NewGroupTransport([]Transport{
+		upstream("192.0.2.1", time.Second, dns.RcodeSuccess, nil),
+		upstream("192.0.2.2", 0, dns.RcodeRefused, nil),
+		upstream("192.0.2.3", 0, dns.RcodeSuccess, errUpstream),
+		upstream("192.0.2.4", 0, dns.RcodeSuccess, nil),
+	}, GroupTransportOptions{Strategy: GroupFailover, Timeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	start := time.Now()
+	assert.Equal(t, "192.0.2.4", exchangeAddress(t, transport))
+	assert.Less(t, time.Since(start), time.Second)
+	for i, stats := range transport.Stats() {
+		assert.Equal(t, uint64(1), stats.Queries)
+		assert.Equal(t, uint64(min(1, 3-i)), stats.Failures)
+	}
+
+	// all the upstreams failing
+	transport, err = NewGroupTransport([]Transport{
+		upstream("192.0.2.1", 0, dns.RcodeServerFailure, nil),
+		upstream("192.0.2.2", 0, dns.RcodeSuccess, errUpstream),
+	}, GroupTransportOptions{Strategy: GroupFailover})
+	require.NoError(t, err)
+	response, err := transport.Exchange(context.Background(), query("a.test."))
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, response.Rcode)
+
+	transport, err = NewGroupTransport([]Transport{
+		upstream("192.0.2.1", 0, dns.RcodeSuccess, errUpstream),
+	}, GroupTransportOptions{Strategy: GroupFailover})
+	require.NoError(t, err)
+	_, err = transport.Exchange(context.Background(), query("a.test."))
+	assert.ErrorIs(t, err, errUpstream)
+}
+
+func TestGroupFastest(t *testing.T) {
+	transport, err := NewGroupTransport([]Transport{
+		upstream("192.0.2.1", 20*time.Millisecond, dns.RcodeSuccess, nil),
+		upstream("192.0.2.2", time.Millisecond, dns.RcodeSuccess, nil),
+		upstream("192.0.2.3", 0, dns.RcodeSuccess, errUpstream),
+	}, GroupTransportOptions{Strategy: GroupFastest})
+	require.NoError(t, err)
+	// each upstream is measured once, in order, the failing one falling back to the fastest
+	assert.Equal(t, "192.0.2.1", exchangeAddress(t, transport))
+	assert.Equal(t, "192.0.2.2", exchangeAddress(t, transport))
+	assert.Equal(t, "192.0.2.2", exchangeAddress(t, transport))
+	for range 5 {
+		assert.Equal(t, "192.0.2.2", exchangeAddress(t, transport))
+	}
+	stats := transport.Stats()
+	assert.Equal(t, uint64(1), stats[0].Queries)
+	assert.Equal(t, uint64(1), stats[2].Failures)
+	assert.Less(t, stats[1].RTT, stats[0].RTT)
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	transport, err := NewGroupTransport([]Transport{
+		upstream("192.0.2.1", 0, dns.RcodeSuccess, nil),
+		upstream("192.0.2.2", 0, dns.RcodeSuccess, nil),
+		upstream("192.0.2.3", 0, dns.RcodeSuccess, errUpstream),
+	}, GroupTransportOptions{Strategy: GroupRoundRobin})
+	require.NoError(t, err)
+	for _, address := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.1"} {
+		assert.Equal(t, address, exchangeAddress(t, transport))
+	}
+
+	transport, err = NewGroupTransport([]Transport{
+		upstream("192.0.2.1", 0, dns.RcodeSuccess, nil),
+		upstream("192.0.2.2", 0, dns.RcodeSuccess, nil),
+	}, GroupTransportOptions{Strategy: GroupRandom})
+	require.NoError(t, err)
+	for range 64 {
+		exchangeAddress(t, transport)
+	}
+	stats := transport.Stats()
+	assert.Equal(t, uint64(64), stats[0].Queries+stats[1].Queries)
+	assert.NotZero(t, stats[0].Queries)
+	assert.NotZero(t, stats[1].Queries)
+}
+
+func TestGroupStrategy(t *testing.T) {
+	for strategy := range groupStrategyMax {
+		parsed, err := ParseGroupStrategy(strategy.String())
+		require.NoError(t, err)
+		assert.Equal(t, strategy, parsed)
+	}
+	_, err := ParseGroupStrategy("fastest_first")
+	assert.ErrorIs(t, err, ErrInvalidGroupStrategy)
+	_, err = NewGroupTransport([]Transport{upstream("192.0.2.1", 0, dns.RcodeSuccess, nil)}, GroupTransportOptions{Strategy: groupStrategyMax})
+	assert.ErrorIs(t, err, ErrInvalidGroupStrategy)
+	_, err = NewGroupTransport(nil, GroupTransportOptions{})
+	assert.Error(t, err)
+}
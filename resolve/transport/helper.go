@@ -5,6 +5,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/qtraffics/qtfra/enhancements/slicelib"
+
 	"github.com/miekg/dns"
 )
 
@@ -84,3 +86,13 @@ func FixedResponse(id uint16, question dns.Question, addresses []netip.Addr, tim
 	}
 	return &response
 }
+
+// removeAddedOPT removes the OPT record of response if message has none, as the
+// transports add one to the queries for their options.
+func removeAddedOPT(message *dns.Msg, response *dns.Msg) {
+	if message.IsEdns0() == nil {
+		response.Extra = slicelib.Filter(response.Extra, func(it dns.RR) bool {
+			return it.Header().Rrtype != dns.TypeOPT
+		})
+	}
+}
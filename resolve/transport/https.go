@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/ex"
+	"github.com/qtraffics/qtfra/values"
+
+	"github.com/miekg/dns"
+)
+
+const mimeDNSMessage = "application/dns-message"
+
+type HTTPSTransportOptions struct {
+	Dialer dialer.Dialer
+	// Bootstrap is connected instead of the host of the url, so that the host needs no
+	// resolution. The host is still sent as the SNI and verified in the certificate.
+	Bootstrap netip.Addr
+	// TLSConfig is the base of the tls configuration, e.g. for the roots.
+	TLSConfig *tls.Config
+	// UseGET sends the queries by GET instead of POST, which the http caches prefer.
+	UseGET bool
+	// IdleTimeout closes the connections idle for the duration. Default to
+	// netvars.DefaultResolverIdleTimeout.
+	IdleTimeout time.Duration
+	// DisablePadding disables the EDNS(0) padding of the queries (RFC 8467).
+	DisablePadding bool
+}
+
+var _ Transport = (*HTTPSTransport)(nil)
+
+// HTTPSTransport is a DNS-over-HTTPS transport (RFC 8484). The queries are sent with a
+// zero ID, and the connections are reused by HTTP/2.
+type HTTPSTransport struct {
+	url       *url.URL
+	transport *http.Transport
+	useGET    bool
+	padding   bool
+}
+
+func NewHTTPSTransport(serverURL string, options HTTPSTransportOptions) (*HTTPSTransport, error) {
+	parsed, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, ex.New("invalid url: ", serverURL)
+	}
+	if parsed.Path == "" {
+		parsed.Path = "/dns-query"
+	}
+	server := addrs.FromParseSocksaddrHostPortStr(parsed.Hostname(), values.UseDefault(parsed.Port(), "443"))
+	if options.Bootstrap.IsValid() {
+		server = addrs.FromAddrPort(netip.AddrPortFrom(options.Bootstrap, server.Port))
+	}
+	realDialer := options.Dialer
+	if realDialer == nil {
+		realDialer = dialer.System
+	}
+
+	var tlsConfig *tls.Config
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	} else {
+		tlsConfig = new(tls.Config)
+	}
+	tlsConfig.ServerName = values.UseDefault(tlsConfig.ServerName, parsed.Hostname())
+	tlsConfig.MinVersion = max(tlsConfig.MinVersion, tls.VersionTLS12)
+
+	return &HTTPSTransport{
+		url: parsed,
+		transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return realDialer.DialContext(ctx, meta.NetworkTCP, server)
+			},
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			IdleConnTimeout:     values.UseDefault(options.IdleTimeout, netvars.DefaultResolverIdleTimeout),
+			TLSHandshakeTimeout: netvars.DefaultResolverReadTimeout,
+			DisableCompression:  true,
+		},
+		useGET:  options.UseGET,
+		padding: !options.DisablePadding,
+	}, nil
+}
+
+func (t *HTTPSTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	var request *dns.Msg
+	if t.padding {
+		request = padMessage(message, netvars.DNSPaddingBlockSize)
+	} else {
+		request = message.Copy()
+	}
+	// a zero ID makes the responses cacheable
+	request.Id = 0
+	rawMessage, err := request.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var httpRequest *http.Request
+	if t.useGET {
+		requestURL := *t.url
+		query := requestURL.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(rawMessage))
+		requestURL.RawQuery = query.Encode()
+		httpRequest, err = http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	} else {
+		httpRequest, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url.String(), bytes.NewReader(rawMessage))
+		if err == nil {
+			httpRequest.Header.Set("Content-Type", mimeDNSMessage)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Accept", mimeDNSMessage)
+
+	httpResponse, err := t.transport.RoundTrip(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, ex.New("unexpected status: ", httpResponse.Status)
+	}
+	if contentType, _, _ := mime.ParseMediaType(httpResponse.Header.Get("Content-Type")); contentType != mimeDNSMessage {
+		return nil, ex.New("unexpected content type: ", httpResponse.Header.Get("Content-Type"))
+	}
+	rawResponse, err := io.ReadAll(io.LimitReader(httpResponse.Body, dns.MaxMsgSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(rawResponse) > dns.MaxMsgSize {
+		return nil, ex.New("response too large")
+	}
+	response := new(dns.Msg)
+	if err = response.Unpack(rawResponse); err != nil {
+		return nil, err
+	}
+	response.Id = message.Id
+	removeAddedOPT(message, response)
+	if freshness, ok := freshnessLifetime(httpResponse.Header); ok {
+		limitTTL(response, freshness)
+	}
+	return response, nil
+}
+
+// Close closes the idle connections.
+func (t *HTTPSTransport) Close() error {
+	t.transport.CloseIdleConnections()
+	return nil
+}
+
+// freshnessLifetime returns the remaining freshness of a response, the max-age of the
+// Cache-Control header minus the Age header.
+func freshnessLifetime(header http.Header) (uint32, bool) {
+	var maxAge int64 = -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			parsed, err := strconv.ParseUint(strings.Trim(value, `"`), 10, 32)
+			if err != nil {
+				return 0, false
+			}
+			maxAge = int64(parsed)
+		}
+	}
+	if maxAge < 0 {
+		return 0, false
+	}
+	age, _ := strconv.ParseUint(header.Get("Age"), 10, 32)
+	return uint32(max(maxAge-int64(age), 0)), true
+}
+
+// limitTTL lowers the TTL of the records to at most ttl.
+func limitTTL(message *dns.Msg, ttl uint32) {
+	for _, records := range [][]dns.RR{message.Answer, message.Ns, message.Extra} {
+		for _, record := range records {
+			if header := record.Header(); header.Rrtype != dns.TypeOPT {
+				header.Ttl = min(header.Ttl, ttl)
+			}
+		}
+	}
+}
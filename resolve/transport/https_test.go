@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startHTTPSServer answers from a local zone over HTTP/2, the responses have a max-age
+// of 30 seconds and an age of 10 seconds.
+func startHTTPSServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	zone := map[string]netip.Addr{
+		"a.example.com.": netip.MustParseAddr("192.0.2.1"),
+		"b.example.com.": netip.MustParseAddr("192.0.2.2"),
+	}
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		assert.Equal(t, "/dns-query", r.URL.Path)
+		var raw []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			raw, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			assert.Equal(t, mimeDNSMessage, r.Header.Get("Content-Type"))
+			raw, err = io.ReadAll(r.Body)
+		}
+		query := new(dns.Msg)
+		if err == nil {
+			err = query.Unpack(raw)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Zero(t, query.Id)
+		assert.Zero(t, query.Len()%128)
+
+		var addresses []netip.Addr
+		if address, loaded := zone[query.Question[0].Name]; loaded {
+			addresses = append(addresses, address)
+		}
+		response := FixedResponse(query.Id, query.Question[0], addresses, 300)
+		if len(addresses) == 0 {
+			response.Rcode = dns.RcodeNameError
+		}
+		raw, err = response.Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", mimeDNSMessage)
+		w.Header().Set("Cache-Control", "public, max-age=30")
+		w.Header().Set("Age", "10")
+		w.Write(raw)
+	}))
+	server.EnableHTTP2 = true
+	// the handshakes with untrusted certificates fail
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+func TestHTTPS(t *testing.T) {
+	server, conns := startHTTPSServer(t)
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, useGET := range []bool{false, true} {
+		// the certificate of httptest is valid for example.com, which needs no resolution
+		// with the bootstrap address
+		transport, err := NewHTTPSTransport("https://example.com:"+serverURL.Port(), HTTPSTransportOptions{
+			Dialer:    netDialer{},
+			Bootstrap: netip.MustParseAddr("127.0.0.1"),
+			TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+			UseGET:    useGET,
+		})
+		require.NoError(t, err)
+
+		for _, name := range []string{"a.example.com.", "b.example.com."} {
+			message := query(name)
+			message.Id = 42
+			response, err := transport.Exchange(ctx, message)
+			require.NoError(t, err)
+			assert.Equal(t, uint16(42), response.Id)
+			require.Len(t, response.Answer, 1)
+			// max-age minus age, lower than the ttl of the record
+			assert.Equal(t, uint32(20), response.Answer[0].Header().Ttl)
+		}
+		response, err := transport.Exchange(ctx, query("missing.example.com."))
+		require.NoError(t, err)
+		assert.Equal(t, dns.RcodeNameError, response.Rcode)
+		transport.Close()
+	}
+	// one conn for each transport
+	assert.Equal(t, int32(2), conns.Load())
+
+	transport, err := NewHTTPSTransport(server.URL, HTTPSTransportOptions{Dialer: netDialer{}})
+	require.NoError(t, err)
+	_, err = transport.Exchange(ctx, query("a.example.com."))
+	assert.Error(t, err, "not trusted by the system roots")
+
+	_, err = NewHTTPSTransport("http://example.com", HTTPSTransportOptions{})
+	assert.Error(t, err)
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	for _, testCase := range []struct {
+		cacheControl string
+		age          string
+		freshness    uint32
+		ok           bool
+	}{
+		{"max-age=60", "", 60, true},
+		{"public, max-age=60", "70", 0, true},
+		{"no-store", "", 0, false},
+		{"max-age=invalid", "", 0, false},
+	} {
+		header := http.Header{}
+		header.Set("Cache-Control", testCase.cacheControl)
+		header.Set("Age", testCase.age)
+		freshness, ok := freshnessLifetime(header)
+		assert.Equal(t, testCase.freshness, freshness, testCase.cacheControl)
+		assert.Equal(t, testCase.ok, ok, testCase.cacheControl)
+	}
+}
@@ -0,0 +1,271 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/ex"
+	"github.com/qtraffics/qtfra/values"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// the error codes of RFC 9250 section 4.3
+const (
+	doqNoError          = 0x0
+	doqInternalError    = 0x1
+	doqRequestCancelled = 0x3
+)
+
+type QUICTransportOptions struct {
+	Dialer dialer.Dialer
+	// ServerName is sent as the SNI and verified in the certificate. Default to the
+	// address of the server.
+	ServerName string
+	// TLSConfig is the base of the tls configuration, e.g. for the roots.
+	TLSConfig *tls.Config
+	// IdleTimeout closes the connection once idle for the duration. Default to
+	// netvars.DefaultResolverIdleTimeout.
+	IdleTimeout time.Duration
+	// Disable0RTT disables sending the queries in 0-RTT when resuming a session.
+	Disable0RTT bool
+	// DisablePadding disables the EDNS(0) padding of the queries (RFC 8467).
+	DisablePadding bool
+}
+
+var _ Transport = (*QUICTransport)(nil)
+
+// QUICTransport is a DNS-over-QUIC transport (RFC 9250). The queries are sent on their
+// own stream of one QUIC connection, which runs on a packet conn of the dialer.
+type QUICTransport struct {
+	serverAddr addrs.Socksaddr
+	dialer     dialer.Dialer
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	use0RTT    bool
+	padding    bool
+
+	access  sync.Mutex
+	conn    *quicConn
+	dialing *quicDial
+	closed  bool
+}
+
+// quicDial is a connection being dialed, shared by the queries waiting for it.
+type quicDial struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	conn   *quicConn
+	err    error
+}
+
+type quicConn struct {
+	*quic.Conn
+	transport  *quic.Transport
+	packetConn net.PacketConn
+}
+
+func (c *quicConn) close(code quic.ApplicationErrorCode) {
+	_ = c.CloseWithError(code, "")
+	_ = c.transport.Close()
+	_ = c.packetConn.Close()
+}
+
+func NewQUICTransport(server addrs.Socksaddr, options QUICTransportOptions) (*QUICTransport, error) {
+	server.Port = values.UseDefault(server.Port, 853)
+	if options.Dialer == nil {
+		options.Dialer = dialer.System
+	}
+	var tlsConfig *tls.Config
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	} else {
+		tlsConfig = new(tls.Config)
+	}
+	tlsConfig.ServerName = values.UseDefault(options.ServerName, values.UseDefault(tlsConfig.ServerName, server.AddrString()))
+	tlsConfig.NextProtos = []string{"doq"}
+	if tlsConfig.ClientSessionCache == nil && !options.Disable0RTT {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return &QUICTransport{
+		serverAddr: server,
+		dialer:     options.Dialer,
+		tlsConfig:  tlsConfig,
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: netvars.DefaultResolverReadTimeout,
+			MaxIdleTimeout:       values.UseDefault(options.IdleTimeout, netvars.DefaultResolverIdleTimeout),
+		},
+		use0RTT: !options.Disable0RTT,
+		padding: !options.DisablePadding,
+	}, nil
+}
+
+func (t *QUICTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	var request *dns.Msg
+	if t.padding {
+		request = padMessage(message, netvars.DNSPaddingBlockSize)
+	} else {
+		request = message.Copy()
+	}
+	// the ID must be zero, RFC 9250 section 4.2.1
+	request.Id = 0
+
+	var (
+		response *dns.Msg
+		err      error
+	)
+	// a reused conn may have been closed by the server meanwhile, retry once on a new one
+	for range 2 {
+		var (
+			conn   *quicConn
+			reused bool
+		)
+		conn, reused, err = t.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err = t.exchange(ctx, conn, request)
+		if errors.Is(err, quic.Err0RTTRejected) {
+			// the data sent in 0-RTT is lost, send it again once the handshake completes
+			if _, err = conn.NextConnection(ctx); err == nil {
+				response, err = t.exchange(ctx, conn, request)
+			}
+		}
+		if err == nil || !reused || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	response.Id = message.Id
+	removeAddedOPT(message, response)
+	return response, nil
+}
+
+func (t *QUICTransport) exchange(ctx context.Context, conn *quicConn, request *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelWrite(doqRequestCancelled)
+		stream.CancelRead(doqRequestCancelled)
+	})
+	defer stop()
+	if _, err = writeMessage(stream, request); err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	// the client closes the sending side after the query, RFC 9250 section 4.2
+	_ = stream.Close()
+	response, err := readMessage(stream)
+	if err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *QUICTransport) open(ctx context.Context) (*quicConn, bool, error) {
+	t.access.Lock()
+	if t.closed {
+		t.access.Unlock()
+		return nil, false, os.ErrClosed
+	}
+	if t.conn != nil {
+		if t.conn.Context().Err() == nil {
+			conn := t.conn
+			t.access.Unlock()
+			return conn, true, nil
+		}
+		t.conn.close(doqNoError)
+		t.conn = nil
+	}
+	// the queries arriving meanwhile wait for the same dial, which does not depend on the
+	// context of any of them
+	dial := t.dialing
+	if dial == nil {
+		dial = &quicDial{done: make(chan struct{})}
+		var dialCtx context.Context
+		dialCtx, dial.cancel = context.WithTimeout(context.Background(), netvars.DefaultDialerTimeout)
+		t.dialing = dial
+		go t.dial(dialCtx, dial)
+	}
+	t.access.Unlock()
+	select {
+	case <-dial.done:
+		return dial.conn, false, dial.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+func (t *QUICTransport) dial(ctx context.Context, dial *quicDial) {
+	defer dial.cancel()
+	conn, err := t.handshake(ctx)
+
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.dialing = nil
+	switch {
+	case err != nil:
+		dial.err = err
+	case t.closed:
+		conn.close(doqNoError)
+		dial.err = os.ErrClosed
+	default:
+		t.conn = conn
+		dial.conn = conn
+	}
+	close(dial.done)
+}
+
+func (t *QUICTransport) handshake(ctx context.Context) (*quicConn, error) {
+	packetConn, err := t.dialer.ListenPacket(ctx, t.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	// the packet conn of a resolving dialer maps the domain to the resolved address
+	var remoteAddr net.Addr = t.serverAddr
+	if !t.serverAddr.FqdnOnly() {
+		remoteAddr = t.serverAddr.UDPAddr()
+	}
+	transport := &quic.Transport{Conn: packetConn}
+	var conn *quic.Conn
+	if t.use0RTT {
+		conn, err = transport.DialEarly(ctx, remoteAddr, t.tlsConfig, t.quicConfig)
+	} else {
+		conn, err = transport.Dial(ctx, remoteAddr, t.tlsConfig, t.quicConfig)
+	}
+	if err != nil {
+		_ = transport.Close()
+		_ = packetConn.Close()
+		return nil, ex.Cause(err, "quic handshake")
+	}
+	return &quicConn{Conn: conn, transport: transport, packetConn: packetConn}, nil
+}
+
+// Close closes the connection, the transport can not be used anymore.
+func (t *QUICTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.closed = true
+	if t.dialing != nil {
+		t.dialing.cancel()
+	}
+	if t.conn != nil {
+		t.conn.close(doqNoError)
+		t.conn = nil
+	}
+	return nil
+}
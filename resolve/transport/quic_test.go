@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type quicServer struct {
+	tlsServer
+	zeroRTT atomic.Int32
+}
+
+// startQUICServer answers the A queries with 127.0.0.1 on each stream, with 0-RTT allowed.
+func startQUICServer(t *testing.T) *quicServer {
+	s := &quicServer{tlsServer: tlsServer{certificate: newCertificate(t)}}
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{s.certificate},
+		NextProtos:   []string{"doq"},
+	}, &quic.Config{Allow0RTT: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	s.addr = addrs.FromNetAddr(ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(t, conn)
+		}
+	}()
+	return s
+}
+
+func (s *quicServer) serve(t *testing.T, conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		if conn.ConnectionState().Used0RTT {
+			s.zeroRTT.Add(1)
+		}
+		go func() {
+			defer stream.Close()
+			query, err := readMessage(stream)
+			if err != nil {
+				return
+			}
+			assert.Zero(t, query.Id)
+			assert.Zero(t, query.Len()%128)
+			response := FixedResponse(query.Id, query.Question[0], []netip.Addr{netip.MustParseAddr("127.0.0.1")}, 60)
+			_, _ = writeMessage(stream, response)
+		}()
+	}
+}
+
+func TestQUIC(t *testing.T) {
+	server := startQUICServer(t)
+	transport, err := NewQUICTransport(server.addr, QUICTransportOptions{
+		Dialer:      netDialer{},
+		ServerName:  "dns.test",
+		TLSConfig:   server.roots(),
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = transport.Exchange(ctx, query("first.test."))
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Go(func() {
+			message := query("a.test.")
+			message.Id = 42
+			response, err := transport.Exchange(ctx, message)
+			if assert.NoError(t, err) {
+				assert.Equal(t, uint16(42), response.Id)
+				assert.Len(t, response.Answer, 1)
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), server.conns.Load())
+	assert.Zero(t, server.zeroRTT.Load())
+
+	// reconnect once idle, resuming the session in 0-RTT
+	time.Sleep(500 * time.Millisecond)
+	_, err = transport.Exchange(ctx, query("b.test."))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), server.conns.Load())
+	assert.Equal(t, int32(1), server.zeroRTT.Load())
+}
+
+func TestQUICDial(t *testing.T) {
+	server := startQUICServer(t)
+	dialer := &slowDialer{delay: 100 * time.Millisecond}
+	transport, err := NewQUICTransport(server.addr, QUICTransportOptions{
+		Dialer:     dialer,
+		ServerName: "dns.test",
+		TLSConfig:  server.roots(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	// the query giving up does not fail the dial the other queries wait for
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := transport.Exchange(ctx, query("a.test."))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+	for range 4 {
+		wg.Go(func() {
+			_, err := transport.Exchange(context.Background(), query("b.test."))
+			assert.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), dialer.dials.Load())
+	assert.Equal(t, int32(1), server.conns.Load())
+
+	// closing the transport aborts the dial
+	transport, err = NewQUICTransport(server.addr, QUICTransportOptions{
+		Dialer:     &slowDialer{delay: time.Minute},
+		ServerName: "dns.test",
+		TLSConfig:  server.roots(),
+	})
+	require.NoError(t, err)
+	time.AfterFunc(20*time.Millisecond, func() { transport.Close() })
+	_, err = transport.Exchange(context.Background(), query("c.test."))
+	assert.Error(t, err)
+}
+
+func TestQUICVerify(t *testing.T) {
+	server := startQUICServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	transport, err := NewQUICTransport(server.addr, QUICTransportOptions{Dialer: netDialer{}, ServerName: "other.test", TLSConfig: server.roots()})
+	require.NoError(t, err)
+	defer transport.Close()
+	_, err = transport.Exchange(ctx, query("a.test."))
+	assert.Error(t, err)
+
+	require.NoError(t, transport.Close())
+	_, err = transport.Exchange(ctx, query("a.test."))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
@@ -0,0 +1,254 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/qtraffics/qtfra/enhancements/maplib"
+	"github.com/qtraffics/qtfra/enhancements/slicelib"
+	"github.com/qtraffics/qtfra/ex"
+
+	"github.com/miekg/dns"
+)
+
+// RouteRule routes the queries it matches to its transport. The names match if any of the
+// name conditions does, or if there is none, and the query type if QueryType is empty or
+// contains it.
+type RouteRule struct {
+	// Domain matches the names exactly.
+	Domain []string
+	// Suffix matches the names and their subdomains, "example.com" matches
+	// "www.example.com" but not "myexample.com".
+	Suffix []string
+	// Keyword matches the names containing it.
+	Keyword []string
+	// Regex matches the names in lower case, without the trailing dot.
+	Regex []string
+	// QueryType are the query types of the rule, e.g. dns.TypeA.
+	QueryType []uint16
+
+	Transport Transport
+}
+
+// LoadRouteRule reads the conditions of a rule from a list file, see ParseRouteRule.
+func LoadRouteRule(path string, transport Transport) (RouteRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return RouteRule{}, err
+	}
+	defer file.Close()
+	rule, err := ParseRouteRule(file, transport)
+	if err != nil {
+		return RouteRule{}, ex.Cause(err, path)
+	}
+	return rule, nil
+}
+
+// ParseRouteRule reads the conditions of a rule, one per line, as:
+//
+//	# comment
+//	domain:host.corp.example
+//	suffix:corp.example
+//	keyword:internal
+//	regex:^ci-[0-9]+\.
+//	qtype:AAAA
+//
+// A line without type is a suffix. A comment starts by # at the beginning of a line or
+// after a space, the # within a value, e.g. of a regular expression, is kept.
+func ParseRouteRule(reader io.Reader, transport Transport) (RouteRule, error) {
+	rule := RouteRule{Transport: transport}
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(cutComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		kind, value, found := strings.Cut(line, ":")
+		if !found {
+			kind, value = "suffix", line
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(kind) {
+		case "domain":
+			rule.Domain = append(rule.Domain, value)
+		case "suffix":
+			rule.Suffix = append(rule.Suffix, value)
+		case "keyword":
+			rule.Keyword = append(rule.Keyword, value)
+		case "regex":
+			rule.Regex = append(rule.Regex, value)
+		case "qtype":
+			queryType, loaded := dns.StringToType[strings.ToUpper(value)]
+			if !loaded {
+				return RouteRule{}, ex.New("line ", lineNumber, ": unknown query type: ", value)
+			}
+			rule.QueryType = append(rule.QueryType, queryType)
+		default:
+			return RouteRule{}, ex.New("line ", lineNumber, ": unknown rule type: ", kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return RouteRule{}, err
+	}
+	return rule, nil
+}
+
+type RouteTransportOptions struct {
+	// Rules are matched in order, the first matching one routes the query.
+	Rules []RouteRule
+	// Default routes the queries matching no rule.
+	Default Transport
+}
+
+var _ Transport = (*RouteTransport)(nil)
+
+// RouteTransport routes the queries to a transport by their question, e.g. the internal
+// zones to the corporate servers and the others to a public one.
+type RouteTransport struct {
+	rules            []routeRule
+	defaultTransport Transport
+}
+
+type routeRule struct {
+	domains    maplib.Set[string]
+	suffixes   maplib.Set[string]
+	keywords   []string
+	regexes    []*regexp.Regexp
+	queryTypes []uint16
+	transport  Transport
+}
+
+func NewRouteTransport(options RouteTransportOptions) (*RouteTransport, error) {
+	if options.Default == nil {
+		return nil, ex.New("route: missing default transport")
+	}
+	rules := make([]routeRule, 0, len(options.Rules))
+	for index, rule := range options.Rules {
+		if rule.Transport == nil {
+			return nil, ex.New("route: missing transport of rule ", index)
+		}
+		compiled := routeRule{
+			domains:    maplib.NewSet[string](),
+			suffixes:   maplib.NewSet[string](),
+			keywords:   slicelib.Map(rule.Keyword, strings.ToLower),
+			queryTypes: rule.QueryType,
+			transport:  rule.Transport,
+		}
+		for _, domain := range rule.Domain {
+			compiled.domains.Add(routeName(domain))
+		}
+		for _, suffix := range rule.Suffix {
+			compiled.suffixes.Add(routeName(strings.TrimPrefix(suffix, ".")))
+		}
+		for _, expression := range rule.Regex {
+			regex, err := regexp.Compile(expression)
+			if err != nil {
+				return nil, ex.Cause(err, "route: rule "+strconv.Itoa(index))
+			}
+			compiled.regexes = append(compiled.regexes, regex)
+		}
+		rules = append(rules, compiled)
+	}
+	return &RouteTransport{
+		rules:            rules,
+		defaultTransport: options.Default,
+	}, nil
+}
+
+func (t *RouteTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) == 0 {
+		return t.defaultTransport.Exchange(ctx, message)
+	}
+	return t.route(message.Question[0]).Exchange(ctx, message)
+}
+
+// route returns the transport of the question.
+func (t *RouteTransport) route(question dns.Question) Transport {
+	name := routeName(question.Name)
+	for _, rule := range t.rules {
+		if rule.match(name, question.Qtype) {
+			return rule.transport
+		}
+	}
+	return t.defaultTransport
+}
+
+// Close closes the transports of the rules and the default one.
+// A transport shared by several of them is closed once.
+func (t *RouteTransport) Close() error {
+	var errors []error
+	closed := maplib.NewSet[io.Closer]()
+	transports := slicelib.Map(t.rules, func(it routeRule) Transport { return it.transport })
+	for _, transport := range append(transports, t.defaultTransport) {
+		closer, ok := transport.(io.Closer)
+		if !ok {
+			continue
+		}
+		// the values of some types, e.g. functions, can not be compared
+		if reflect.TypeOf(closer).Comparable() {
+			if closed.Contains(closer) {
+				continue
+			}
+			closed.Add(closer)
+		}
+		errors = append(errors, closer.Close())
+	}
+	return ex.Errors(errors...)
+}
+
+func (r *routeRule) match(name string, queryType uint16) bool {
+	if len(r.queryTypes) > 0 && !slices.Contains(r.queryTypes, queryType) {
+		return false
+	}
+	if len(r.domains) == 0 && len(r.suffixes) == 0 && len(r.keywords) == 0 && len(r.regexes) == 0 {
+		return true
+	}
+	if r.domains.Contains(name) {
+		return true
+	}
+	if len(r.suffixes) > 0 {
+		for suffix := name; ; {
+			if r.suffixes.Contains(suffix) {
+				return true
+			}
+			_, parent, found := strings.Cut(suffix, ".")
+			if !found {
+				break
+			}
+			suffix = parent
+		}
+	}
+	for _, keyword := range r.keywords {
+		if strings.Contains(name, keyword) {
+			return true
+		}
+	}
+	for _, regex := range r.regexes {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cutComment removes the comment of a line of a rule file.
+func cutComment(line string) string {
+	for index := 0; index < len(line); index++ {
+		if line[index] == '#' && (index == 0 || line[index-1] == ' ' || line[index-1] == '\t') {
+			return line[:index]
+		}
+	}
+	return line
+}
+
+// routeName returns the name in lower case without the trailing dot.
+func routeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoute(t *testing.T) {
+	corp := upstream("10.0.0.1", 0, dns.RcodeSuccess, nil)
+	v6 := upstream("10.0.0.2", 0, dns.RcodeSuccess, nil)
+	public := upstream("192.0.2.1", 0, dns.RcodeSuccess, nil)
+	rule, err := ParseRouteRule(strings.NewReader(`
+# the corporate zones
+corp.example
+domain: Intranet.Example
+keyword:internal
+regex:^ci-[0-9]+\.build\. # the build hosts
+regex:^queue#[0-9]+\.
+`), corp)
+	require.NoError(t, err)
+	transport, err := NewRouteTransport(RouteTransportOptions{
+		Rules: []RouteRule{
+			rule,
+			{Suffix: []string{".example"}, QueryType: []uint16{dns.TypeAAAA}, Transport: v6},
+		},
+		Default: public,
+	})
+	require.NoError(t, err)
+
+	for _, testCase := range []struct {
+		name      string
+		queryType uint16
+		address   string
+	}{
+		{"corp.example.", dns.TypeA, "10.0.0.1"},
+		{"www.Corp.Example.", dns.TypeA, "10.0.0.1"},
+		{"mycorp.example.", dns.TypeA, "192.0.2.1"},
+		{"mycorp.example.", dns.TypeAAAA, "10.0.0.2"},
+		{"intranet.example.", dns.TypeA, "10.0.0.1"},
+		{"www.intranet.example.", dns.TypeA, "192.0.2.1"},
+		{"api.internal.test.", dns.TypeA, "10.0.0.1"},
+		{"ci-42.build.test.", dns.TypeA, "10.0.0.1"},
+		{"ci-x.build.test.", dns.TypeA, "192.0.2.1"},
+		{"queue#7.test.", dns.TypeA, "10.0.0.1"},
+		{"queue7.test.", dns.TypeA, "192.0.2.1"},
+		{"example.", dns.TypeAAAA, "10.0.0.2"},
+		{"example.com.", dns.TypeAAAA, "192.0.2.1"},
+	} {
+		routed := transport.route(dns.Question{Name: testCase.name, Qtype: testCase.queryType, Qclass: dns.ClassINET})
+		assert.Equal(t, testCase.address, exchangeAddress(t, routed), testCase.name)
+	}
+
+	// the question of the message routes it
+	message := query("host.corp.example.")
+	message.Id = 42
+	response, err := transport.Exchange(context.Background(), message)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(42), response.Id)
+	assert.Equal(t, "10.0.0.1", response.Answer[0].(*dns.A).A.String())
+}
+
+func TestRouteRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corp.list")
+	require.NoError(t, os.WriteFile(path, []byte("corp.example\nqtype: aaaa\n"), 0o644))
+	rule, err := LoadRouteRule(path, exchangeFunc(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"corp.example"}, rule.Suffix)
+	assert.Equal(t, []uint16{dns.TypeAAAA}, rule.QueryType)
+
+	_, err = ParseRouteRule(strings.NewReader("corp.example\nzone:corp.example\n"), nil)
+	assert.EqualError(t, err, "line 2: unknown rule type: zone")
+	_, err = ParseRouteRule(strings.NewReader("qtype:NOPE\n"), nil)
+	assert.EqualError(t, err, "line 1: unknown query type: NOPE")
+
+	_, err = NewRouteTransport(RouteTransportOptions{Rules: []RouteRule{{Regex: []string{"("}, Transport: exchangeFunc(nil)}}, Default: exchangeFunc(nil)})
+	assert.Error(t, err)
+	_, err = NewRouteTransport(RouteTransportOptions{Rules: []RouteRule{{Domain: []string{"a.test"}}}, Default: exchangeFunc(nil)})
+	assert.Error(t, err)
+	_, err = NewRouteTransport(RouteTransportOptions{})
+	assert.Error(t, err)
+}
+
+// closeCounter is a transport counting its closes.
+type closeCounter struct {
+	Transport
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.closes++
+	return nil
+}
+
+// closeFunc is a transport closed by calling it, its values can not be compared.
+type closeFunc func() error
+
+func (f closeFunc) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	return nil, errUpstream
+}
+
+func (f closeFunc) Close() error {
+	return f()
+}
+
+func TestRouteClose(t *testing.T) {
+	shared := &closeCounter{Transport: exchangeFunc(nil)}
+	var defaultCloses int
+	transport, err := NewRouteTransport(RouteTransportOptions{
+		Rules: []RouteRule{
+			{Suffix: []string{"a.test"}, Transport: shared},
+			{Suffix: []string{"b.test"}, Transport: exchangeFunc(nil)},
+			{Suffix: []string{"c.test"}, Transport: shared},
+		},
+		Default: closeFunc(func() error {
+			defaultCloses++
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, transport.Close())
+	assert.Equal(t, 1, shared.closes)
+	assert.Equal(t, 1, defaultCloses)
+}
@@ -0,0 +1,205 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qtfra/ex"
+
+	"github.com/miekg/dns"
+)
+
+var errStreamIdle = ex.New("stream idle")
+
+// streamConn pipelines the queries over one stream connection, as RFC 7766 section 6.2.1.1
+// describes: each query is sent with an unused message ID, and the responses are matched
+// by the ID in any order.
+type streamConn struct {
+	net.Conn
+
+	idleTimeout time.Duration
+	writeAccess sync.Mutex
+
+	access    sync.Mutex
+	queryID   uint16
+	callbacks map[uint16]chan *dns.Msg
+	idleTimer *time.Timer
+	draining  bool
+	done      chan struct{}
+	err       error
+}
+
+// newStreamConn starts reading the responses on conn, which is closed once no query is
+// pending for idleTimeout. Zero idleTimeout keeps the conn open.
+func newStreamConn(conn net.Conn, idleTimeout time.Duration) *streamConn {
+	c := &streamConn{
+		Conn:        conn,
+		idleTimeout: idleTimeout,
+		queryID:     dns.Id(),
+		callbacks:   make(map[uint16]chan *dns.Msg),
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(idleTimeout, c.closeIdle)
+	}
+	go c.recvLoop()
+	return c
+}
+
+func (c *streamConn) exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	response := make(chan *dns.Msg, 1)
+	c.access.Lock()
+	if c.isClosed() {
+		c.access.Unlock()
+		return nil, c.err
+	}
+	if c.draining {
+		c.access.Unlock()
+		return nil, errStreamIdle
+	}
+	if len(c.callbacks) > 0xffff {
+		c.access.Unlock()
+		return nil, ex.New("too many pending queries")
+	}
+	for {
+		c.queryID++
+		if _, loaded := c.callbacks[c.queryID]; !loaded {
+			break
+		}
+	}
+	queryID := c.queryID
+	c.callbacks[queryID] = response
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.access.Unlock()
+	defer c.release(queryID, response)
+
+	exMessage := *message
+	exMessage.Id = queryID
+	c.writeAccess.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetWriteDeadline(deadline)
+	}
+	_, err := writeMessage(c.Conn, &exMessage)
+	_ = c.SetWriteDeadline(time.Time{})
+	c.writeAccess.Unlock()
+	if err != nil {
+		// a partial write breaks the framing of the stream
+		c.Close(err)
+		return nil, err
+	}
+
+	select {
+	case answer := <-response:
+		answer.Id = message.Id
+		return answer, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *streamConn) release(queryID uint16, response chan *dns.Msg) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	// the ID may have been answered and reused by another query
+	if c.callbacks[queryID] == response {
+		delete(c.callbacks, queryID)
+	}
+	if len(c.callbacks) == 0 {
+		c.idle()
+	}
+}
+
+// idle closes a draining conn, or starts the idle timer, access must be held.
+func (c *streamConn) idle() {
+	if c.draining {
+		c.closeLocked(errStreamIdle)
+	} else if c.idleTimer != nil && !c.isClosed() {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+// keepAlive replaces the idle timeout by the one the server advertised by the EDNS TCP
+// keepalive option (RFC 7828). Zero means the server asks to close the conn, which then
+// takes no more query and is closed once the pending ones are answered.
+func (c *streamConn) keepAlive(timeout time.Duration) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if timeout == 0 {
+		c.draining = true
+	} else {
+		c.idleTimeout = timeout
+		if c.idleTimer == nil {
+			c.idleTimer = time.AfterFunc(timeout, c.closeIdle)
+			c.idleTimer.Stop()
+		}
+	}
+	if len(c.callbacks) == 0 {
+		c.idle()
+	}
+}
+
+// available reports whether the conn takes new queries, and the number of the pending ones.
+func (c *streamConn) available() (bool, int) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return !c.draining && !c.isClosed(), len(c.callbacks)
+}
+
+func (c *streamConn) recvLoop() {
+	for {
+		message, err := readMessage(c.Conn)
+		if err != nil {
+			c.Close(err)
+			return
+		}
+		c.access.Lock()
+		response, loaded := c.callbacks[message.Id]
+		delete(c.callbacks, message.Id)
+		c.access.Unlock()
+		if loaded {
+			response <- message
+		}
+	}
+}
+
+func (c *streamConn) closeIdle() {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if len(c.callbacks) == 0 {
+		c.closeLocked(errStreamIdle)
+	}
+}
+
+// isClosed reports whether the conn is closed.
+func (c *streamConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *streamConn) Close(err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.closeLocked(err)
+}
+
+func (c *streamConn) closeLocked(err error) {
+	if c.isClosed() {
+		return
+	}
+	c.err = err
+	close(c.done)
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	_ = c.Conn.Close()
+}
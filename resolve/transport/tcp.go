@@ -5,25 +5,59 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/qtraffics/qnetwork/addrs"
 	"github.com/qtraffics/qnetwork/dialer"
 	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netvars"
 	"github.com/qtraffics/qtfra/buf"
+	"github.com/qtraffics/qtfra/enhancements/slicelib"
+	"github.com/qtraffics/qtfra/values"
 
 	"github.com/miekg/dns"
 )
 
+// tcpPipelineDepth is the number of pending queries beyond which the pool opens another
+// connection.
+const tcpPipelineDepth = 32
+
 type TCPTransportOptions struct {
 	Dialer dialer.Dialer
+	// MaxConns limits the connections of the pool. Default to
+	// netvars.DefaultResolverMaxConns.
+	MaxConns int
+	// IdleTimeout closes the connections once no query is pending for the duration, unless
+	// the server advertises another one (RFC 7828). Default to
+	// netvars.DefaultResolverIdleTimeout.
+	IdleTimeout time.Duration
 }
 
+var _ Transport = (*TCPTransport)(nil)
+
+// TCPTransport keeps a pool of connections to the server, the queries are pipelined over
+// them and answered in any order (RFC 7766).
 type TCPTransport struct {
-	serverAddr addrs.Socksaddr
-	dialer     dialer.Dialer
+	serverAddr  addrs.Socksaddr
+	dialer      dialer.Dialer
+	maxConns    int
+	idleTimeout time.Duration
+
+	access  sync.Mutex
+	conns   []*streamConn
+	dialing bool
+	// dialed is closed and replaced once a dial is done
+	dialed chan struct{}
+	closed bool
 }
 
 func NewTCPTransport(server addrs.Socksaddr, options TCPTransportOptions) (*TCPTransport, error) {
+	return newTCPTransport(server, options), nil
+}
+
+func newTCPTransport(server addrs.Socksaddr, options TCPTransportOptions) *TCPTransport {
 	if server.Port == 0 {
 		server.Port = 53
 	}
@@ -31,34 +65,154 @@ func NewTCPTransport(server addrs.Socksaddr, options TCPTransportOptions) (*TCPT
 	if realDialer == nil {
 		realDialer = dialer.System
 	}
-	t := &TCPTransport{
-		serverAddr: server,
-		dialer:     realDialer,
+	return &TCPTransport{
+		serverAddr:  server,
+		dialer:      realDialer,
+		maxConns:    values.UseDefault(options.MaxConns, netvars.DefaultResolverMaxConns),
+		idleTimeout: values.UseDefault(options.IdleTimeout, netvars.DefaultResolverIdleTimeout),
+		dialed:      make(chan struct{}),
 	}
-	return t, nil
 }
 
 func (t *TCPTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
-	conn, err := t.dialer.DialContext(ctx, meta.NetworkTCP, t.serverAddr)
-	if err != nil {
-		return nil, err
+	request := message
+	// the keepalive option is only negotiated with the queries using EDNS, adding an OPT
+	// record to the others would fail on the servers without EDNS support
+	if message.IsEdns0() != nil {
+		request = message.Copy()
+		opt := request.IsEdns0()
+		opt.Option = slicelib.Filter(opt.Option, func(it dns.EDNS0) bool {
+			return it.Option() != dns.EDNS0TCPKEEPALIVE
+		})
+		// the clients send the option without timeout, RFC 7828 section 3.2.1
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
 	}
-	closeCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go func() {
-		select {
-		case <-ctx.Done():
-			_ = conn.Close()
-		case <-closeCtx.Done():
+
+	var (
+		conn     *streamConn
+		response *dns.Msg
+		err      error
+	)
+	// a reused conn may have been closed by the server meanwhile, retry once on a new one
+	for range 2 {
+		var reused bool
+		conn, reused, err = t.open(ctx)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	defer conn.Close()
-	_, err = writeMessage(conn, message)
+		response, err = conn.exchange(ctx, request)
+		if err == nil || !reused || ctx.Err() != nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	ansMsg, err := readMessage(conn)
-	return ansMsg, err
+
+	if responseOpt := response.IsEdns0(); responseOpt != nil {
+		for _, option := range responseOpt.Option {
+			if keepalive, ok := option.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				conn.keepAlive(min(time.Duration(keepalive.Timeout)*100*time.Millisecond, t.idleTimeout))
+			}
+		}
+		responseOpt.Option = slicelib.Filter(responseOpt.Option, func(it dns.EDNS0) bool {
+			return it.Option() != dns.EDNS0TCPKEEPALIVE
+		})
+	}
+	removeAddedOPT(message, response)
+	return response, nil
+}
+
+// open returns the least busy conn of the pool, or a new one if all are busy and the
+// pool is not full. One conn is dialed at a time, without holding the lock, the other
+// queries use the pool meanwhile or wait for the dial if it is empty.
+func (t *TCPTransport) open(ctx context.Context) (*streamConn, bool, error) {
+	for {
+		t.access.Lock()
+		if t.closed {
+			t.access.Unlock()
+			return nil, false, os.ErrClosed
+		}
+		var (
+			best        *streamConn
+			bestPending int
+		)
+		conns := t.conns[:0]
+		for _, conn := range t.conns {
+			available, pending := conn.available()
+			if !available {
+				continue
+			}
+			conns = append(conns, conn)
+			if best == nil || pending < bestPending {
+				best, bestPending = conn, pending
+			}
+		}
+		clear(t.conns[len(conns):])
+		t.conns = conns
+		if best != nil && (bestPending < tcpPipelineDepth || len(t.conns) >= t.maxConns || t.dialing) {
+			t.access.Unlock()
+			return best, true, nil
+		}
+		if t.dialing {
+			dialed := t.dialed
+			t.access.Unlock()
+			select {
+			case <-dialed:
+				continue
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+		t.dialing = true
+		t.access.Unlock()
+
+		conn, err := t.dialer.DialContext(ctx, meta.NetworkTCP, t.serverAddr)
+
+		t.access.Lock()
+		t.dialing = false
+		close(t.dialed)
+		t.dialed = make(chan struct{})
+		switch {
+		case err != nil:
+			t.access.Unlock()
+			if best != nil {
+				return best, true, nil
+			}
+			return nil, false, err
+		case t.closed:
+			t.access.Unlock()
+			conn.Close()
+			return nil, false, os.ErrClosed
+		}
+		stream := newStreamConn(conn, t.idleTimeout)
+		t.conns = append(t.conns, stream)
+		t.access.Unlock()
+		return stream, false, nil
+	}
+}
+
+// Close closes the connections of the pool, the transport can not be used anymore.
+func (t *TCPTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.closed = true
+	t.closeConnsLocked()
+	return nil
+}
+
+// closeConns closes the connections of the pool, which opens new ones for the next queries.
+func (t *TCPTransport) closeConns() {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.closeConnsLocked()
+}
+
+func (t *TCPTransport) closeConnsLocked() {
+	for _, conn := range t.conns {
+		conn.Close(os.ErrClosed)
+	}
+	t.conns = nil
 }
 
 func readMessage(r io.Reader) (*dns.Msg, error) {
@@ -0,0 +1,280 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tcpServer struct {
+	addr  addrs.Socksaddr
+	conns atomic.Int32
+	// keepalive is the timeout advertised in the responses, in units of 100ms, negative
+	// for none
+	keepalive int
+	// closeAfter closes the conns after answering that many queries, zero for never
+	closeAfter int
+	// plain counts the queries without OPT record
+	plain atomic.Int32
+}
+
+// startTCPServer answers the A queries with 127.0.0.1, after 100ms for the names starting
+// by "slow". A UDP server on the same port answers truncated responses.
+func startTCPServer(t *testing.T, s *tcpServer) *tcpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	s.addr = addrs.FromNetAddr(ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(t, conn)
+		}
+	}()
+
+	udpConn, err := net.ListenUDP("udp", s.addr.UDPAddr())
+	require.NoError(t, err)
+	t.Cleanup(func() { udpConn.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := udpConn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			if query.Unpack(b[:n]) != nil {
+				continue
+			}
+			response := new(dns.Msg)
+			response.SetReply(query)
+			response.Truncated = true
+			raw, _ := response.Pack()
+			_, _ = udpConn.WriteTo(raw, addr)
+		}
+	}()
+	return s
+}
+
+func (s *tcpServer) serve(t *testing.T, conn net.Conn) {
+	var (
+		writeAccess sync.Mutex
+		answered    int
+	)
+	for {
+		query, err := readMessage(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go func() {
+			edns := query.IsEdns0() != nil
+			if edns {
+				var keepalive *dns.EDNS0_TCP_KEEPALIVE
+				for _, option := range query.IsEdns0().Option {
+					keepalive, _ = option.(*dns.EDNS0_TCP_KEEPALIVE)
+				}
+				if assert.NotNil(t, keepalive) {
+					assert.Zero(t, keepalive.Timeout)
+				}
+			} else {
+				s.plain.Add(1)
+			}
+			if strings.HasPrefix(query.Question[0].Name, "slow") {
+				time.Sleep(100 * time.Millisecond)
+			}
+			response := FixedResponse(query.Id, query.Question[0], []netip.Addr{netip.MustParseAddr("127.0.0.1")}, 60)
+			// the option is only sent in reply to a query using EDNS, RFC 7828 section 3.3.2
+			if edns {
+				response.SetEdns0(1232, false)
+				if s.keepalive >= 0 {
+					opt := response.IsEdns0()
+					opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(s.keepalive)})
+				}
+			}
+			writeAccess.Lock()
+			defer writeAccess.Unlock()
+			_, _ = writeMessage(conn, response)
+			answered++
+			if s.closeAfter > 0 && answered >= s.closeAfter {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// ednsQuery is a query with an OPT record, for which the keepalive option is negotiated.
+func ednsQuery(name string) *dns.Msg {
+	message := query(name)
+	message.SetEdns0(1232, false)
+	return message
+}
+
+func newTCP(t *testing.T, server *tcpServer, options TCPTransportOptions) *TCPTransport {
+	options.Dialer = netDialer{}
+	transport, err := NewTCPTransport(server.addr, options)
+	require.NoError(t, err)
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+func TestTCPPipeline(t *testing.T) {
+	server := startTCPServer(t, &tcpServer{keepalive: -1})
+	transport := newTCP(t, server, TCPTransportOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	slow := make(chan time.Time, 1)
+	go func() {
+		_, err := transport.Exchange(ctx, query("slow.test."))
+		assert.NoError(t, err)
+		slow <- time.Now()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Go(func() {
+			message := query("fast.test.")
+			message.Id = 42
+			response, err := transport.Exchange(ctx, message)
+			if assert.NoError(t, err) {
+				assert.Equal(t, uint16(42), response.Id)
+				assert.Nil(t, response.IsEdns0())
+			}
+		})
+	}
+	wg.Wait()
+	assert.True(t, time.Now().Before(<-slow), "answered out of order")
+	assert.Equal(t, int32(1), server.conns.Load())
+}
+
+func TestTCPPool(t *testing.T) {
+	server := startTCPServer(t, &tcpServer{keepalive: -1})
+	transport := newTCP(t, server, TCPTransportOptions{MaxConns: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for range 3 * tcpPipelineDepth {
+		wg.Go(func() {
+			_, err := transport.Exchange(ctx, query("slow.test."))
+			assert.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), server.conns.Load())
+}
+
+func TestTCPDial(t *testing.T) {
+	server := startTCPServer(t, &tcpServer{keepalive: -1})
+	dialer := &slowDialer{delay: 100 * time.Millisecond}
+	transport, err := NewTCPTransport(server.addr, TCPTransportOptions{Dialer: dialer})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	// the queries wait for the conn being dialed
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			_, err := transport.Exchange(context.Background(), query("a.test."))
+			assert.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), dialer.dials.Load())
+	assert.Equal(t, int32(1), server.conns.Load())
+
+	// the dial does not hold the pool, closing the transport is not blocked
+	transport, err = NewTCPTransport(server.addr, TCPTransportOptions{Dialer: &slowDialer{delay: 500 * time.Millisecond}})
+	require.NoError(t, err)
+	exchanged := make(chan error, 1)
+	go func() {
+		_, err := transport.Exchange(context.Background(), query("b.test."))
+		exchanged <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	transport.Close()
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.ErrorIs(t, <-exchanged, os.ErrClosed)
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the server advertises 100ms, shorter than the idle timeout
+	server := startTCPServer(t, &tcpServer{keepalive: 1})
+	transport := newTCP(t, server, TCPTransportOptions{})
+	for range 2 {
+		_, err := transport.Exchange(ctx, ednsQuery("a.test."))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), server.conns.Load())
+	time.Sleep(300 * time.Millisecond)
+	// the OPT record of the query is kept, without the keepalive option
+	response, err := transport.Exchange(ctx, ednsQuery("a.test."))
+	require.NoError(t, err)
+	require.NotNil(t, response.IsEdns0())
+	assert.Empty(t, response.IsEdns0().Option)
+	assert.Equal(t, int32(2), server.conns.Load())
+
+	// the server asks to close the conn after each response
+	server = startTCPServer(t, &tcpServer{keepalive: 0})
+	transport = newTCP(t, server, TCPTransportOptions{})
+	for range 3 {
+		_, err = transport.Exchange(ctx, ednsQuery("a.test."))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(3), server.conns.Load())
+
+	// the queries without OPT record are sent as is
+	response, err = transport.Exchange(ctx, query("a.test."))
+	require.NoError(t, err)
+	assert.Nil(t, response.IsEdns0())
+	assert.Equal(t, int32(1), server.plain.Load())
+}
+
+func TestTCPReconnect(t *testing.T) {
+	server := startTCPServer(t, &tcpServer{keepalive: -1, closeAfter: 1})
+	transport := newTCP(t, server, TCPTransportOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for range 5 {
+		_, err := transport.Exchange(ctx, query("a.test."))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(5), server.conns.Load())
+}
+
+func TestUDPTruncated(t *testing.T) {
+	server := startTCPServer(t, &tcpServer{keepalive: -1})
+	transport := NewUDP(server.addr, UDPTransportOptions{Dialer: netDialer{}})
+	defer transport.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for range 5 {
+		response, err := transport.Exchange(ctx, query("a.test."))
+		require.NoError(t, err)
+		assert.False(t, response.Truncated)
+		assert.Len(t, response.Answer, 1)
+	}
+	// the fallback reuses the pool
+	assert.Equal(t, int32(1), server.conns.Load())
+}
@@ -0,0 +1,249 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/netvars"
+	"github.com/qtraffics/qtfra/enhancements/slicelib"
+	"github.com/qtraffics/qtfra/ex"
+	"github.com/qtraffics/qtfra/values"
+
+	"github.com/miekg/dns"
+)
+
+var ErrPinMismatch = ex.New("tls: no certificate matches the pins")
+
+type TLSTransportOptions struct {
+	Dialer dialer.Dialer
+	// ServerName is sent as the SNI and verified in the certificate. Default to the
+	// address of the server.
+	ServerName string
+	// Pins are the base64 encoded SHA-256 digests of the SubjectPublicKeyInfo of the
+	// certificates. When set, a certificate of the chain must match a pin, and the chain
+	// is not verified by the roots, as the out-of-band key-pinned profile of RFC 7858.
+	Pins []string
+	// TLSConfig is the base of the tls configuration, e.g. for the roots.
+	TLSConfig *tls.Config
+	// IdleTimeout closes the connection once no query is pending for the duration.
+	// Default to netvars.DefaultResolverIdleTimeout.
+	IdleTimeout time.Duration
+	// DisablePadding disables the EDNS(0) padding of the queries (RFC 8467).
+	DisablePadding bool
+}
+
+var _ Transport = (*TLSTransport)(nil)
+
+// TLSTransport is a DNS-over-TLS transport (RFC 7858). The queries are pipelined over one
+// persistent connection, which is never downgraded to cleartext.
+type TLSTransport struct {
+	serverAddr  addrs.Socksaddr
+	dialer      dialer.Dialer
+	tlsConfig   *tls.Config
+	idleTimeout time.Duration
+	padding     bool
+
+	access  sync.Mutex
+	conn    *streamConn
+	dialing *tlsDial
+	closed  bool
+}
+
+// tlsDial is a connection being dialed, shared by the queries waiting for it.
+type tlsDial struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	conn   *streamConn
+	err    error
+}
+
+func NewTLSTransport(server addrs.Socksaddr, options TLSTransportOptions) (*TLSTransport, error) {
+	server.Port = values.UseDefault(server.Port, 853)
+	if options.Dialer == nil {
+		options.Dialer = dialer.System
+	}
+	var tlsConfig *tls.Config
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	} else {
+		tlsConfig = new(tls.Config)
+	}
+	tlsConfig.ServerName = values.UseDefault(options.ServerName, values.UseDefault(tlsConfig.ServerName, server.AddrString()))
+	tlsConfig.MinVersion = max(tlsConfig.MinVersion, tls.VersionTLS12)
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"dot"}
+	}
+	if len(options.Pins) > 0 {
+		pins, err := parsePins(options.Pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state, pins)
+		}
+	}
+	return &TLSTransport{
+		serverAddr:  server,
+		dialer:      options.Dialer,
+		tlsConfig:   tlsConfig,
+		idleTimeout: values.UseDefault(options.IdleTimeout, netvars.DefaultResolverIdleTimeout),
+		padding:     !options.DisablePadding,
+	}, nil
+}
+
+func (t *TLSTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	request := message
+	if t.padding {
+		request = padMessage(message, netvars.DNSPaddingBlockSize)
+	}
+	var (
+		response *dns.Msg
+		err      error
+	)
+	// a reused conn may have been closed by the server meanwhile, retry once on a new one
+	for range 2 {
+		var (
+			conn   *streamConn
+			reused bool
+		)
+		conn, reused, err = t.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err = conn.exchange(ctx, request)
+		if err == nil || !reused || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	removeAddedOPT(message, response)
+	return response, nil
+}
+
+func (t *TLSTransport) open(ctx context.Context) (*streamConn, bool, error) {
+	t.access.Lock()
+	if t.closed {
+		t.access.Unlock()
+		return nil, false, os.ErrClosed
+	}
+	if t.conn != nil && !t.conn.isClosed() {
+		conn := t.conn
+		t.access.Unlock()
+		return conn, true, nil
+	}
+	// the queries arriving meanwhile wait for the same dial, which does not depend on the
+	// context of any of them
+	dial := t.dialing
+	if dial == nil {
+		dial = &tlsDial{done: make(chan struct{})}
+		var dialCtx context.Context
+		dialCtx, dial.cancel = context.WithTimeout(context.Background(), netvars.DefaultDialerTimeout)
+		t.dialing = dial
+		go t.dial(dialCtx, dial)
+	}
+	t.access.Unlock()
+	select {
+	case <-dial.done:
+		return dial.conn, false, dial.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+func (t *TLSTransport) dial(ctx context.Context, dial *tlsDial) {
+	defer dial.cancel()
+	conn, err := t.dialer.DialContext(ctx, meta.NetworkTCP, t.serverAddr)
+	var tlsConn *tls.Conn
+	if err == nil {
+		tlsConn = tls.Client(conn, t.tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			err = ex.Cause(err, "tls handshake")
+		}
+	}
+
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.dialing = nil
+	switch {
+	case err != nil:
+		dial.err = err
+	case t.closed:
+		tlsConn.Close()
+		dial.err = os.ErrClosed
+	default:
+		t.conn = newStreamConn(tlsConn, t.idleTimeout)
+		dial.conn = t.conn
+	}
+	close(dial.done)
+}
+
+// Close closes the connection, the transport can not be used anymore.
+func (t *TLSTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.closed = true
+	if t.dialing != nil {
+		t.dialing.cancel()
+	}
+	if t.conn != nil {
+		t.conn.Close(os.ErrClosed)
+		t.conn = nil
+	}
+	return nil
+}
+
+// padMessage returns a copy of message padded to a multiple of block, adding the OPT
+// record if missing.
+func padMessage(message *dns.Msg, block int) *dns.Msg {
+	padded := message.Copy()
+	opt := padded.IsEdns0()
+	if opt == nil {
+		padded.SetEdns0(netvars.MaxDNSUDPSize, false)
+		opt = padded.IsEdns0()
+	}
+	opt.Option = slicelib.Filter(opt.Option, func(it dns.EDNS0) bool {
+		return it.Option() != dns.EDNS0PADDING
+	})
+	// the padding option itself takes 4 bytes
+	length := padded.Len() + 4
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, (block-length%block)%block)})
+	return padded
+}
+
+func parsePins(pins []string) ([][]byte, error) {
+	digests := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, errors.Join(ex.New("invalid pin: ", pin), err)
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+func verifyPins(state tls.ConnectionState, pins [][]byte) error {
+	for _, certificate := range state.PeerCertificates {
+		digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(digest[:], pin) {
+				return nil
+			}
+		}
+	}
+	return ErrPinMismatch
+}
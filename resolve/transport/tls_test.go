@@ -0,0 +1,303 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	mathbig "math/big"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/meta"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// netDialer dials with the standard library, the tests only dial addresses.
+type netDialer struct{}
+
+func (netDialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network.String(), address.String())
+}
+
+func (netDialer) ListenPacket(ctx context.Context, _ addrs.Socksaddr) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp", "127.0.0.1:0")
+}
+
+func newCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: new(mathbig.Int).SetInt64(1),
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(raw)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: leaf}
+}
+
+type tlsServer struct {
+	addr        addrs.Socksaddr
+	certificate tls.Certificate
+	conns       atomic.Int32
+}
+
+// startTLSServer answers the A queries with 127.0.0.1, the names starting by "slow" are
+// answered after 100ms, so after the queries sent later on the same conn.
+func startTLSServer(t *testing.T) *tlsServer {
+	s := &tlsServer{certificate: newCertificate(t)}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{s.certificate}})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	s.addr = addrs.FromNetAddr(ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(t, conn)
+		}
+	}()
+	return s
+}
+
+func (s *tlsServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	var writeAccess sync.Mutex
+	for {
+		query, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		go func() {
+			opt := query.IsEdns0()
+			if assert.NotNil(t, opt) {
+				assert.Zero(t, query.Len()%128)
+			}
+			if len(query.Question[0].Name) > 4 && query.Question[0].Name[:4] == "slow" {
+				time.Sleep(100 * time.Millisecond)
+			}
+			response := FixedResponse(query.Id, query.Question[0], []netip.Addr{netip.MustParseAddr("127.0.0.1")}, 60)
+			response.SetEdns0(1232, false)
+			writeAccess.Lock()
+			defer writeAccess.Unlock()
+			_, _ = writeMessage(conn, response)
+		}()
+	}
+}
+
+func (s *tlsServer) pin() string {
+	digest := sha256.Sum256(s.certificate.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func (s *tlsServer) roots() *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.certificate.Leaf)
+	return &tls.Config{RootCAs: roots}
+}
+
+func query(name string) *dns.Msg {
+	message := new(dns.Msg)
+	message.SetQuestion(name, dns.TypeA)
+	return message
+}
+
+func TestTLSPipeline(t *testing.T) {
+	server := startTLSServer(t)
+	transport, err := NewTLSTransport(server.addr, TLSTransportOptions{
+		Dialer:     netDialer{},
+		ServerName: "dns.test",
+		TLSConfig:  server.roots(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// open the conn first, the queries below share it
+	_, err = transport.Exchange(ctx, query("first.test."))
+	require.NoError(t, err)
+
+	slow := make(chan time.Time, 1)
+	go func() {
+		response, err := transport.Exchange(ctx, query("slow.test."))
+		assert.NoError(t, err)
+		assert.Len(t, response.Answer, 1)
+		slow <- time.Now()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Go(func() {
+			message := query("fast.test.")
+			message.Id = 42
+			response, err := transport.Exchange(ctx, message)
+			if assert.NoError(t, err) {
+				assert.Equal(t, uint16(42), response.Id)
+				assert.Equal(t, "fast.test.", response.Question[0].Name)
+				// the OPT record added for the padding is not returned
+				assert.Nil(t, response.IsEdns0())
+			}
+		})
+	}
+	wg.Wait()
+	fastDone := time.Now()
+	assert.True(t, fastDone.Before(<-slow), "answered out of order")
+	assert.Equal(t, int32(1), server.conns.Load())
+}
+
+func TestTLSIdleTimeout(t *testing.T) {
+	server := startTLSServer(t)
+	transport, err := NewTLSTransport(server.addr, TLSTransportOptions{
+		Dialer:      netDialer{},
+		ServerName:  "dns.test",
+		TLSConfig:   server.roots(),
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	ctx := context.Background()
+	_, err = transport.Exchange(ctx, query("a.test."))
+	require.NoError(t, err)
+	_, err = transport.Exchange(ctx, query("b.test."))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), server.conns.Load())
+	time.Sleep(150 * time.Millisecond)
+	_, err = transport.Exchange(ctx, query("c.test."))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), server.conns.Load())
+}
+
+// slowDialer dials and listens after delay, counting the dials and the listens.
+type slowDialer struct {
+	netDialer
+	delay time.Duration
+	dials atomic.Int32
+}
+
+func (d *slowDialer) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+	return d.netDialer.DialContext(ctx, network, address)
+}
+
+func (d *slowDialer) ListenPacket(ctx context.Context, address addrs.Socksaddr) (net.PacketConn, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+	return d.netDialer.ListenPacket(ctx, address)
+}
+
+func (d *slowDialer) wait(ctx context.Context) error {
+	d.dials.Add(1)
+	select {
+	case <-time.After(d.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestTLSDial(t *testing.T) {
+	server := startTLSServer(t)
+	dialer := &slowDialer{delay: 100 * time.Millisecond}
+	transport, err := NewTLSTransport(server.addr, TLSTransportOptions{
+		Dialer:     dialer,
+		ServerName: "dns.test",
+		TLSConfig:  server.roots(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	// the query giving up does not fail the dial the other queries wait for
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := transport.Exchange(ctx, query("a.test."))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+	for range 4 {
+		wg.Go(func() {
+			_, err := transport.Exchange(context.Background(), query("b.test."))
+			assert.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), dialer.dials.Load())
+	assert.Equal(t, int32(1), server.conns.Load())
+
+	// closing the transport aborts the dial
+	transport, err = NewTLSTransport(server.addr, TLSTransportOptions{
+		Dialer:     &slowDialer{delay: time.Minute},
+		ServerName: "dns.test",
+		TLSConfig:  server.roots(),
+	})
+	require.NoError(t, err)
+	time.AfterFunc(20*time.Millisecond, func() { transport.Close() })
+	_, err = transport.Exchange(context.Background(), query("c.test."))
+	assert.Error(t, err)
+}
+
+func TestTLSVerify(t *testing.T) {
+	server := startTLSServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exchange := func(options TLSTransportOptions) error {
+		options.Dialer = netDialer{}
+		transport, err := NewTLSTransport(server.addr, options)
+		if err != nil {
+			return err
+		}
+		defer transport.Close()
+		_, err = transport.Exchange(ctx, query("a.test."))
+		return err
+	}
+
+	// not trusted by the system roots
+	assert.Error(t, exchange(TLSTransportOptions{ServerName: "dns.test"}))
+	assert.Error(t, exchange(TLSTransportOptions{ServerName: "other.test", TLSConfig: server.roots()}))
+	assert.NoError(t, exchange(TLSTransportOptions{Pins: []string{server.pin()}}))
+	assert.ErrorIs(t, exchange(TLSTransportOptions{Pins: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}}), ErrPinMismatch)
+	assert.Error(t, exchange(TLSTransportOptions{Pins: []string{"invalid"}}))
+}
+
+func TestPadMessage(t *testing.T) {
+	for _, name := range []string{"a.", "example.com.", "a-much-longer-name.that.needs.more.padding.example.org."} {
+		padded := padMessage(query(name), 128)
+		assert.Zero(t, padded.Len()%128, name)
+		raw, err := padded.Pack()
+		require.NoError(t, err)
+		assert.Zero(t, len(raw)%128, name)
+		// padding twice keeps a single option
+		assert.Len(t, padMessage(padded, 128).IsEdns0().Option, 1)
+	}
+}
@@ -46,12 +46,10 @@ func NewUDP(server addrs.Socksaddr, options UDPTransportOptions) *UDPTransport {
 	}
 
 	t := &UDPTransport{
-		tcp: &TCPTransport{
-			serverAddr: server,
-			dialer:     options.Dialer,
-		},
+		tcp:        newTCPTransport(server, TCPTransportOptions{Dialer: options.Dialer}),
 		dialer:     options.Dialer,
 		serverAddr: server,
+		done:       make(chan struct{}),
 	}
 
 	t.udpSize.Add(maxUDPSize)
@@ -63,6 +61,7 @@ func (t *UDPTransport) Close() error {
 	defer t.access.Unlock()
 	close(t.done)
 	t.done = make(chan struct{})
+	t.tcp.closeConns()
 	return nil
 }
 
@@ -0,0 +1,272 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/resolve/hosts"
+	"github.com/qtraffics/qtfra/ex"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrUnknownScheme = ex.New("unknown scheme")
+	ErrInvalidServer = ex.New("invalid server")
+)
+
+// URLError records the server url that failed to create a transport.
+type URLError struct {
+	URL string
+	Err error
+}
+
+func (e *URLError) Error() string {
+	return "dns server " + strconv.Quote(e.URL) + ": " + e.Err.Error()
+}
+
+func (e *URLError) Unwrap() error {
+	return e.Err
+}
+
+// Options configures the transports created by New.
+type Options struct {
+	Dialer dialer.Dialer
+	// Bootstrap is the address to connect to when the server is named by domain, which is
+	// then only the name verified in the certificate.
+	Bootstrap netip.Addr
+	// TLSConfig is the base of the tls configuration of the encrypted transports.
+	TLSConfig *tls.Config
+	// Timeout bounds each exchange, zero for the deadline of the context only.
+	Timeout time.Duration
+	// IdleTimeout closes the connections of the stream transports once idle for the
+	// duration. Default to netvars.DefaultResolverIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// Factory creates the transport of a server url, whose scheme it is registered for.
+type Factory func(server *url.URL, options Options) (Transport, error)
+
+var (
+	factoryAccess sync.RWMutex
+	factories     = map[string]Factory{
+		"udp":    newUDPFromURL,
+		"tcp":    newTCPFromURL,
+		"tls":    newTLSFromURL,
+		"https":  newHTTPSFromURL,
+		"quic":   newQUICFromURL,
+		"system": newLocalFromURL,
+	}
+)
+
+// Register sets the factory of the scheme, replacing the registered one if any.
+func Register(scheme string, factory Factory) {
+	factoryAccess.Lock()
+	defer factoryAccess.Unlock()
+	factories[strings.ToLower(scheme)] = factory
+}
+
+// Schemes returns the registered schemes in order.
+func Schemes() []string {
+	factoryAccess.RLock()
+	defer factoryAccess.RUnlock()
+	return slices.Sorted(maps.Keys(factories))
+}
+
+// New creates the transport of a server url, e.g.
+//
+//	udp://8.8.8.8
+//	tcp://[2001:db8::1]:53
+//	tls://dns.example@1.1.1.1
+//	https://dns.example/dns-query
+//	quic://dns.example
+//	system
+//
+// An url without scheme is an udp server. For tls, https and quic, the user of the url is
+// the name verified in the certificate of the server at the host. The errors are of type
+// *URLError.
+func New(rawURL string, options Options) (Transport, error) {
+	server, err := parseURL(rawURL)
+	if err != nil {
+		return nil, &URLError{URL: rawURL, Err: errors.Join(ErrInvalidServer, err)}
+	}
+	factoryAccess.RLock()
+	factory, loaded := factories[server.Scheme]
+	factoryAccess.RUnlock()
+	if !loaded {
+		return nil, &URLError{URL: rawURL, Err: ex.Cause(ErrUnknownScheme, server.Scheme)}
+	}
+	transport, err := factory(server, options)
+	if err != nil {
+		return nil, &URLError{URL: rawURL, Err: err}
+	}
+	if options.Timeout > 0 {
+		transport = &timeoutTransport{Transport: transport, timeout: options.Timeout}
+	}
+	return transport, nil
+}
+
+func parseURL(rawURL string) (*url.URL, error) {
+	if rawURL == "system" {
+		return &url.URL{Scheme: "system"}, nil
+	}
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "udp://" + rawURL
+	}
+	server, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	// the scheme is case insensitive, RFC 3986 section 3.1
+	server.Scheme = strings.ToLower(server.Scheme)
+	return server, nil
+}
+
+// serverAddress returns the address of the server and the name to verify in its
+// certificate, empty for the address itself.
+func serverAddress(server *url.URL, options Options, allowName bool) (addrs.Socksaddr, string, error) {
+	if server.Hostname() == "" {
+		return addrs.Socksaddr{}, "", ex.Cause(ErrInvalidServer, "missing host")
+	}
+	if server.Path != "" && server.Path != "/" || server.RawQuery != "" || server.Fragment != "" {
+		return addrs.Socksaddr{}, "", ex.Cause(ErrInvalidServer, "unexpected path")
+	}
+	var port uint16
+	if portString := server.Port(); portString != "" {
+		parsed, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil || parsed == 0 {
+			return addrs.Socksaddr{}, "", ex.Cause(ErrInvalidServer, "invalid port: "+portString)
+		}
+		port = uint16(parsed)
+	}
+	address := addrs.FromParseSocksaddrHostPort(server.Hostname(), port)
+
+	var name string
+	if server.User != nil {
+		if !allowName {
+			return addrs.Socksaddr{}, "", ex.Cause(ErrInvalidServer, "unexpected server name")
+		}
+		name = server.User.Username()
+		if name == "" {
+			return addrs.Socksaddr{}, "", ex.Cause(ErrInvalidServer, "empty server name")
+		}
+	} else if address.FqdnOnly() {
+		name = address.Fqdn
+	}
+	if address.FqdnOnly() && options.Bootstrap.IsValid() {
+		address = addrs.FromAddrPort(netip.AddrPortFrom(options.Bootstrap, port))
+	}
+	return address, name, nil
+}
+
+func newUDPFromURL(server *url.URL, options Options) (Transport, error) {
+	address, _, err := serverAddress(server, options, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDP(address, UDPTransportOptions{Dialer: options.Dialer}), nil
+}
+
+func newTCPFromURL(server *url.URL, options Options) (Transport, error) {
+	address, _, err := serverAddress(server, options, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPTransport(address, TCPTransportOptions{
+		Dialer:      options.Dialer,
+		IdleTimeout: options.IdleTimeout,
+	})
+}
+
+func newTLSFromURL(server *url.URL, options Options) (Transport, error) {
+	address, name, err := serverAddress(server, options, true)
+	if err != nil {
+		return nil, err
+	}
+	return NewTLSTransport(address, TLSTransportOptions{
+		Dialer:      options.Dialer,
+		ServerName:  name,
+		TLSConfig:   options.TLSConfig,
+		IdleTimeout: options.IdleTimeout,
+	})
+}
+
+func newQUICFromURL(server *url.URL, options Options) (Transport, error) {
+	address, name, err := serverAddress(server, options, true)
+	if err != nil {
+		return nil, err
+	}
+	return NewQUICTransport(address, QUICTransportOptions{
+		Dialer:      options.Dialer,
+		ServerName:  name,
+		TLSConfig:   options.TLSConfig,
+		IdleTimeout: options.IdleTimeout,
+	})
+}
+
+func newHTTPSFromURL(server *url.URL, options Options) (Transport, error) {
+	bootstrap := options.Bootstrap
+	if server.User != nil {
+		// https://dns.example@1.1.1.1/dns-query requests dns.example at 1.1.1.1
+		address, err := netip.ParseAddr(addrs.UnwrapIPv6Address(server.Hostname()))
+		if err != nil {
+			return nil, ex.Cause(ErrInvalidServer, "the host of a named server must be an address")
+		}
+		name := server.User.Username()
+		if name == "" {
+			return nil, ex.Cause(ErrInvalidServer, "empty server name")
+		}
+		bootstrap = address
+		if port := server.Port(); port != "" {
+			name = net.JoinHostPort(name, port)
+		}
+		server = &url.URL{Scheme: server.Scheme, Host: name, Path: server.Path, RawQuery: server.RawQuery}
+	}
+	return NewHTTPSTransport(server.String(), HTTPSTransportOptions{
+		Dialer:      options.Dialer,
+		Bootstrap:   bootstrap,
+		TLSConfig:   options.TLSConfig,
+		IdleTimeout: options.IdleTimeout,
+	})
+}
+
+func newLocalFromURL(server *url.URL, options Options) (Transport, error) {
+	if server.Host != "" || server.Path != "" {
+		return nil, ex.Cause(ErrInvalidServer, "unexpected host")
+	}
+	return NewLocalTransport(&LocalTransportOptions{
+		Dialer: options.Dialer,
+		Host:   hosts.NewFileDefault(),
+	}), nil
+}
+
+type timeoutTransport struct {
+	Transport
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Transport.Exchange(ctx, message)
+}
+
+func (t *timeoutTransport) Close() error {
+	if closer, ok := t.Transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
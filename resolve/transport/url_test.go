@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	options := Options{Bootstrap: netip.MustParseAddr("192.0.2.1")}
+
+	transport, err := New("8.8.8.8", options)
+	require.NoError(t, err)
+	if assert.IsType(t, (*UDPTransport)(nil), transport) {
+		assert.Equal(t, addrs.FromParseSocksaddr("8.8.8.8:53"), transport.(*UDPTransport).serverAddr)
+	}
+
+	transport, err = New("TCP://[2001:db8::1]:5353", options)
+	require.NoError(t, err)
+	if assert.IsType(t, (*TCPTransport)(nil), transport) {
+		assert.Equal(t, addrs.FromParseSocksaddr("[2001:db8::1]:5353"), transport.(*TCPTransport).serverAddr)
+	}
+
+	transport, err = New("tls://dns.example@1.1.1.1", options)
+	require.NoError(t, err)
+	if assert.IsType(t, (*TLSTransport)(nil), transport) {
+		assert.Equal(t, addrs.FromParseSocksaddr("1.1.1.1:853"), transport.(*TLSTransport).serverAddr)
+		assert.Equal(t, "dns.example", transport.(*TLSTransport).tlsConfig.ServerName)
+	}
+
+	// a server named by domain is at the bootstrap address
+	transport, err = New("quic://dns.example:8853", options)
+	require.NoError(t, err)
+	if assert.IsType(t, (*QUICTransport)(nil), transport) {
+		assert.Equal(t, addrs.FromParseSocksaddr("192.0.2.1:8853"), transport.(*QUICTransport).serverAddr)
+		assert.Equal(t, "dns.example", transport.(*QUICTransport).tlsConfig.ServerName)
+	}
+
+	transport, err = New("https://dns.example@1.1.1.1/resolve", Options{})
+	require.NoError(t, err)
+	if assert.IsType(t, (*HTTPSTransport)(nil), transport) {
+		assert.Equal(t, "https://dns.example/resolve", transport.(*HTTPSTransport).url.String())
+	}
+
+	transport, err = New("system", options)
+	require.NoError(t, err)
+	assert.IsType(t, (*LocalTransport)(nil), transport)
+
+	for _, testCase := range []struct {
+		url string
+		err error
+	}{
+		{"ftp://8.8.8.8", ErrUnknownScheme},
+		{"udp://", ErrInvalidServer},
+		{"udp://8.8.8.8:65536", ErrInvalidServer},
+		{"udp://8.8.8.8/path", ErrInvalidServer},
+		{"tcp://dns.example@8.8.8.8", ErrInvalidServer},
+		{"https://dns.example@dns.other/dns-query", ErrInvalidServer},
+		{"system://8.8.8.8", ErrInvalidServer},
+		{"udp://[::1", ErrInvalidServer},
+	} {
+		_, err = New(testCase.url, options)
+		var urlError *URLError
+		if assert.ErrorAs(t, err, &urlError, testCase.url) {
+			assert.Equal(t, testCase.url, urlError.URL)
+		}
+		assert.ErrorIs(t, err, testCase.err, testCase.url)
+	}
+}
+
+type exchangeFunc func(ctx context.Context, message *dns.Msg) (*dns.Msg, error)
+
+func (f exchangeFunc) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	return f(ctx, message)
+}
+
+func TestRegister(t *testing.T) {
+	assert.Equal(t, []string{"https", "quic", "system", "tcp", "tls", "udp"}, Schemes())
+
+	Register("Block", func(server *url.URL, options Options) (Transport, error) {
+		if server.Host != "" {
+			return nil, errors.New("unexpected host")
+		}
+		return exchangeFunc(func(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}), nil
+	})
+	defer func() {
+		factoryAccess.Lock()
+		delete(factories, "block")
+		factoryAccess.Unlock()
+	}()
+	assert.Contains(t, Schemes(), "block")
+
+	transport, err := New("block://", Options{Timeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = transport.Exchange(context.Background(), query("a.test."))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = New("block://host", Options{})
+	assert.EqualError(t, err, `dns server "block://host": unexpected host`)
+}
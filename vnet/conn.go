@@ -0,0 +1,197 @@
+package vnet
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/netio/pipe"
+)
+
+var _ net.Conn = (*Conn)(nil)
+
+// Conn is a reliable stream conn over a Link.
+type Conn struct {
+	network *VirtualNetwork
+	link    Link
+	local   netip.AddrPort
+	remote  netip.AddrPort
+
+	in  *queue
+	out *queue
+
+	writeAccess sync.Mutex
+	departed    time.Time
+
+	closeOnce     sync.Once
+	done          chan struct{}
+	readDeadline  pipe.Deadline
+	writeDeadline pipe.Deadline
+}
+
+func newConnPair(network *VirtualNetwork, link Link, client netip.AddrPort, server netip.AddrPort) (*Conn, *Conn) {
+	clientIn, serverIn := newQueue(), newQueue()
+	clientConn := &Conn{
+		network: network, link: link, local: client, remote: server,
+		in: clientIn, out: serverIn,
+		done:         make(chan struct{}),
+		readDeadline: pipe.MakeDeadline(), writeDeadline: pipe.MakeDeadline(),
+	}
+	serverConn := &Conn{
+		network: network, link: link, local: server, remote: client,
+		in: serverIn, out: clientIn,
+		done:         make(chan struct{}),
+		readDeadline: pipe.MakeDeadline(), writeDeadline: pipe.MakeDeadline(),
+	}
+	return clientConn, serverConn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, _, err := c.in.read(p, true, c.done, c.readDeadline.Wait())
+	if err != nil && err != io.EOF {
+		err = &net.OpError{Op: "read", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+	}
+	return n, err
+}
+
+// Write returns once p has left the sender at the bandwidth of the link,
+// it arrives at the peer after the latency.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if isClosed(c.done) {
+		return 0, c.writeError(net.ErrClosed)
+	}
+	if isClosed(c.writeDeadline.Wait()) {
+		return 0, c.writeError(os.ErrDeadlineExceeded)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.departed = c.link.transmit(time.Now(), c.departed, len(p))
+	timer := time.NewTimer(time.Until(c.departed))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.done:
+		return 0, c.writeError(net.ErrClosed)
+	case <-c.writeDeadline.Wait():
+		return 0, c.writeError(os.ErrDeadlineExceeded)
+	}
+	if !c.out.push(segment{data: append([]byte(nil), p...), at: c.departed.Add(c.link.Latency)}) {
+		return 0, c.writeError(io.ErrClosedPipe)
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeError(err error) error {
+	return &net.OpError{Op: "write", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// CloseWrite sends EOF to the peer after the data already written.
+func (c *Conn) CloseWrite() error {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	c.closeWrite()
+	return nil
+}
+
+func (c *Conn) closeWrite() {
+	at := time.Now()
+	if c.departed.After(at) {
+		at = c.departed
+	}
+	c.out.push(segment{eof: true, at: at.Add(c.link.Latency)})
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.in.shutdown()
+		c.writeAccess.Lock()
+		c.closeWrite()
+		c.writeAccess.Unlock()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return net.TCPAddrFromAddrPort(c.local) }
+func (c *Conn) RemoteAddr() net.Addr { return net.TCPAddrFromAddrPort(c.remote) }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+type Listener struct {
+	network   *VirtualNetwork
+	addr      netip.AddrPort
+	conns     chan *Conn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// enqueue hands conn to Accept, it reports false when the listener is closed or its backlog is full.
+func (l *Listener) enqueue(conn *Conn) bool {
+	if isClosed(l.done) {
+		return false
+	}
+	select {
+	case l.conns <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.removeListener(l)
+		close(l.done)
+		for {
+			select {
+			case conn := <-l.conns:
+				_ = conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr { return net.TCPAddrFromAddrPort(l.addr) }
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,96 @@
+package vnet
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+var _ dialer.Dialer = (*Host)(nil)
+
+// Host is a dialer on a VirtualNetwork, use dialer.DialParallel to race its dials.
+type Host struct {
+	network   *VirtualNetwork
+	addresses []netip.Addr
+}
+
+// DialContext connects to a listener at address. A stream dial takes a round trip of the link
+// and fails with ECONNREFUSED when nothing listens, the link refuses it or the backlog is full.
+// An udp dial returns a packet conn connected to address.
+func (h *Host) DialContext(ctx context.Context, network meta.Network, address addrs.Socksaddr) (net.Conn, error) {
+	if !address.Dialable() {
+		return nil, addrs.ErrNotDialable
+	}
+	if address.FqdnOnly() {
+		return nil, addrs.ErrAddressNotResolved
+	}
+	address = address.Unwrap()
+	if network.Version == meta.NetworkVersion4 && !address.Addr.Is4() ||
+		network.Version == meta.NetworkVersion6 && address.Addr.Is4() {
+		return nil, ex.New("address ", address, " not in network ", network)
+	}
+	source, loaded := h.source(address.Addr)
+	if !loaded {
+		return nil, &net.OpError{Op: "dial", Net: network.String(), Addr: address.TCPAddr(), Err: errNetworkUnreachable}
+	}
+
+	switch network.Protocol {
+	case meta.ProtocolTCP:
+		return h.dialStream(ctx, source, address.AddrPort())
+	case meta.ProtocolUDP:
+		conn, err := h.network.ListenPacket(addrs.Socksaddr{Addr: source})
+		if err != nil {
+			return nil, err
+		}
+		return &udpConn{PacketConn: conn, remote: address.AddrPort()}, nil
+	default:
+		return nil, ex.New("not supported network: ", network.String())
+	}
+}
+
+func (h *Host) dialStream(ctx context.Context, source netip.Addr, destination netip.AddrPort) (net.Conn, error) {
+	link := h.network.link(source, destination.Addr())
+	if !sleep(2*link.Latency, ctx.Done()) {
+		return nil, ctx.Err()
+	}
+	h.network.access.Lock()
+	local, err := h.network.bindLocked(netip.AddrPortFrom(source, 0), func(netip.AddrPort) bool { return false })
+	h.network.access.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	listener := h.network.listener(destination)
+	if link.Refuse || listener == nil {
+		return nil, refused("dial", "tcp", local, destination)
+	}
+	client, server := newConnPair(h.network, link, local, destination)
+	if !listener.enqueue(server) {
+		return nil, refused("dial", "tcp", local, destination)
+	}
+	return client, nil
+}
+
+// ListenPacket binds a packet conn on the host address of the family of address.
+func (h *Host) ListenPacket(ctx context.Context, address addrs.Socksaddr) (net.PacketConn, error) {
+	source, loaded := h.source(address.Addr.Unmap())
+	if !loaded {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: address.UDPAddr(), Err: errNetworkUnreachable}
+	}
+	return h.network.ListenPacket(addrs.Socksaddr{Addr: source})
+}
+
+// source picks the host address of the family of destination,
+// or the first address for an invalid or unspecified destination.
+func (h *Host) source(destination netip.Addr) (netip.Addr, bool) {
+	for _, address := range h.addresses {
+		if !destination.IsValid() || destination.IsUnspecified() || address.Is4() == destination.Is4() {
+			return address.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
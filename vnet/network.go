@@ -0,0 +1,279 @@
+// Package vnet is an in-memory network for tests.
+//
+// A VirtualNetwork routes stream conns and datagrams between listeners and packet conns
+// registered at virtual addresses, so dialers, resolvers and nats can be tested
+// deterministically without real sockets. Every pair of hosts is connected by a Link
+// simulating latency, bandwidth, packet loss, reordering and connection refusal,
+// and all random decisions are drawn from a seeded source.
+package vnet
+
+import (
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qtfra/ex"
+)
+
+// Link describes the path between two hosts, the zero value is a perfect link.
+type Link struct {
+	// Latency is the one way delay of each segment or datagram.
+	Latency time.Duration
+	// Bandwidth limits the bytes per second a conn sends over the link, zero means unlimited.
+	Bandwidth uint64
+	// Loss is the probability in [0, 1] a datagram is dropped, streams are reliable.
+	Loss float64
+	// Reorder is the probability in [0, 1] a datagram is held back for ReorderDelay,
+	// letting the following datagrams overtake it.
+	Reorder float64
+	// ReorderDelay defaults to Latency, or a millisecond without latency.
+	ReorderDelay time.Duration
+	// Refuse fails every stream dial over the link with ECONNREFUSED.
+	Refuse bool
+}
+
+func (l Link) reorderDelay() time.Duration {
+	if l.ReorderDelay > 0 {
+		return l.ReorderDelay
+	}
+	return max(l.Latency, time.Millisecond)
+}
+
+// transmit returns when a payload of n bytes sent at now leaves the sender, given the
+// previous payload left at departed.
+func (l Link) transmit(now time.Time, departed time.Time, n int) time.Time {
+	if l.Bandwidth == 0 {
+		return now
+	}
+	start := now
+	if departed.After(start) {
+		start = departed
+	}
+	return start.Add(time.Duration(uint64(n) * uint64(time.Second) / l.Bandwidth))
+}
+
+type linkKey struct {
+	a netip.Addr
+	b netip.Addr
+}
+
+func makeLinkKey(a netip.Addr, b netip.Addr) linkKey {
+	a, b = a.Unmap(), b.Unmap()
+	if b.Less(a) {
+		a, b = b, a
+	}
+	return linkKey{a, b}
+}
+
+const (
+	ephemeralPortStart = 49152
+	listenBacklog      = 128
+)
+
+type VirtualNetwork struct {
+	access      sync.Mutex
+	rand        *rand.Rand
+	defaultLink Link
+	links       map[linkKey]Link
+
+	listeners   map[netip.AddrPort]*Listener
+	packetConns map[netip.AddrPort]*PacketConn
+	nextPort    map[netip.Addr]uint16
+}
+
+// New creates a network whose random decisions are derived from seed.
+func New(seed uint64) *VirtualNetwork {
+	return &VirtualNetwork{
+		rand:        rand.New(rand.NewPCG(seed, seed)),
+		links:       make(map[linkKey]Link),
+		listeners:   make(map[netip.AddrPort]*Listener),
+		packetConns: make(map[netip.AddrPort]*PacketConn),
+		nextPort:    make(map[netip.Addr]uint16),
+	}
+}
+
+// SetDefaultLink sets the link used between hosts without a link of their own.
+func (n *VirtualNetwork) SetDefaultLink(link Link) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	n.defaultLink = link
+}
+
+// SetLink sets the link between hosts a and b in both directions.
+// An invalid address matches every host, so SetLink(netip.Addr{}, b, link) applies to all traffic of b.
+func (n *VirtualNetwork) SetLink(a netip.Addr, b netip.Addr, link Link) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	n.links[makeLinkKey(a, b)] = link
+}
+
+func (n *VirtualNetwork) link(a netip.Addr, b netip.Addr) Link {
+	n.access.Lock()
+	defer n.access.Unlock()
+	return n.linkLocked(a, b)
+}
+
+func (n *VirtualNetwork) linkLocked(a netip.Addr, b netip.Addr) Link {
+	for _, key := range [...]linkKey{makeLinkKey(a, b), makeLinkKey(netip.Addr{}, b), makeLinkKey(a, netip.Addr{})} {
+		if link, loaded := n.links[key]; loaded {
+			return link
+		}
+	}
+	return n.defaultLink
+}
+
+// chance reports true with probability p.
+func (n *VirtualNetwork) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	n.access.Lock()
+	defer n.access.Unlock()
+	return n.rand.Float64() < p
+}
+
+// Host returns a dialer sending from the given addresses,
+// the address of the same family as the destination is used.
+func (n *VirtualNetwork) Host(addresses ...netip.Addr) *Host {
+	return &Host{network: n, addresses: addresses}
+}
+
+// Listen registers a stream listener at address, an unspecified address accepts conns to any address of its family.
+func (n *VirtualNetwork) Listen(address addrs.Socksaddr) (*Listener, error) {
+	if address.FqdnOnly() {
+		return nil, addrs.ErrAddressNotResolved
+	}
+	n.access.Lock()
+	defer n.access.Unlock()
+	addrPort, err := n.bindLocked(address.AddrPort(), func(addrPort netip.AddrPort) bool {
+		_, loaded := n.listeners[addrPort]
+		return loaded
+	})
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: address.TCPAddr(), Err: err}
+	}
+	listener := &Listener{
+		network: n,
+		addr:    addrPort,
+		conns:   make(chan *Conn, listenBacklog),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addrPort] = listener
+	return listener, nil
+}
+
+// ListenPacket registers a packet conn at address. Datagrams are sent from the bound address,
+// so bind senders to a specified address to let their peers reply.
+func (n *VirtualNetwork) ListenPacket(address addrs.Socksaddr) (*PacketConn, error) {
+	if address.FqdnOnly() {
+		return nil, addrs.ErrAddressNotResolved
+	}
+	n.access.Lock()
+	defer n.access.Unlock()
+	addrPort, err := n.bindLocked(address.AddrPort(), func(addrPort netip.AddrPort) bool {
+		_, loaded := n.packetConns[addrPort]
+		return loaded
+	})
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: address.UDPAddr(), Err: err}
+	}
+	conn := newPacketConn(n, addrPort)
+	n.packetConns[addrPort] = conn
+	return conn, nil
+}
+
+// bindLocked picks an ephemeral port for a zero port and checks the address is free.
+func (n *VirtualNetwork) bindLocked(addrPort netip.AddrPort, used func(addrPort netip.AddrPort) bool) (netip.AddrPort, error) {
+	addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	if addrPort.Port() != 0 {
+		if used(addrPort) {
+			return netip.AddrPort{}, syscall.EADDRINUSE
+		}
+		return addrPort, nil
+	}
+	for range 1<<16 - ephemeralPortStart {
+		port := n.nextPort[addrPort.Addr()]
+		if port < ephemeralPortStart {
+			port = ephemeralPortStart
+		}
+		n.nextPort[addrPort.Addr()] = port + 1
+		candidate := netip.AddrPortFrom(addrPort.Addr(), port)
+		if !used(candidate) {
+			return candidate, nil
+		}
+	}
+	return netip.AddrPort{}, syscall.EADDRINUSE
+}
+
+func (n *VirtualNetwork) listener(destination netip.AddrPort) *Listener {
+	n.access.Lock()
+	defer n.access.Unlock()
+	return lookup(n.listeners, destination)
+}
+
+func (n *VirtualNetwork) packetConn(destination netip.AddrPort) *PacketConn {
+	n.access.Lock()
+	defer n.access.Unlock()
+	return lookup(n.packetConns, destination)
+}
+
+// lookup finds the exact address first, then the unspecified address of the family.
+func lookup[T any](registry map[netip.AddrPort]*T, destination netip.AddrPort) *T {
+	destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+	if value, loaded := registry[destination]; loaded {
+		return value
+	}
+	unspecified := netip.IPv6Unspecified()
+	if destination.Addr().Is4() {
+		unspecified = netip.IPv4Unspecified()
+	}
+	return registry[netip.AddrPortFrom(unspecified, destination.Port())]
+}
+
+func (n *VirtualNetwork) removeListener(listener *Listener) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	if n.listeners[listener.addr] == listener {
+		delete(n.listeners, listener.addr)
+	}
+}
+
+func (n *VirtualNetwork) removePacketConn(conn *PacketConn) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	if n.packetConns[conn.addr] == conn {
+		delete(n.packetConns, conn.addr)
+	}
+}
+
+// sleep waits for d unless done is closed first.
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+var errNetworkUnreachable = ex.New("vnet: no source address for destination family")
+
+func refused(op string, network string, source netip.AddrPort, destination netip.AddrPort) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    network,
+		Source: net.TCPAddrFromAddrPort(source),
+		Addr:   net.TCPAddrFromAddrPort(destination),
+		Err:    os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}
+}
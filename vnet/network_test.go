@@ -0,0 +1,215 @@
+package vnet_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/dialer"
+	"github.com/qtraffics/qnetwork/meta"
+	"github.com/qtraffics/qnetwork/resolve/transport"
+	"github.com/qtraffics/qnetwork/vnet"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	clientAddr  = netip.MustParseAddr("10.0.0.1")
+	serverAddr  = netip.MustParseAddr("10.0.0.2")
+	clientAddr6 = netip.MustParseAddr("fd00::1")
+	serverAddr6 = netip.MustParseAddr("fd00::2")
+)
+
+func echo(t *testing.T, listener net.Listener) {
+	t.Helper()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func TestStream(t *testing.T) {
+	network := vnet.New(1)
+	network.SetLink(clientAddr, serverAddr, vnet.Link{Latency: 20 * time.Millisecond})
+	listener, err := network.Listen(addrs.Socksaddr{Addr: serverAddr, Port: 80})
+	require.NoError(t, err)
+	defer listener.Close()
+	echo(t, listener)
+
+	start := time.Now()
+	conn, err := network.Host(clientAddr).DialContext(context.Background(), meta.NetworkTCP, addrs.Socksaddr{Addr: serverAddr, Port: 80})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.Equal(t, serverAddr, addrs.AddrPortFromNetAddr(conn.RemoteAddr()).Addr())
+	assert.Equal(t, uint16(80), addrs.AddrPortFromNetAddr(conn.RemoteAddr()).Port())
+	assert.Equal(t, clientAddr, addrs.AddrPortFromNetAddr(conn.LocalAddr()).Addr())
+
+	start = time.Now()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestRefuse(t *testing.T) {
+	network := vnet.New(1)
+	host := network.Host(clientAddr)
+	_, err := host.DialContext(context.Background(), meta.NetworkTCP, addrs.Socksaddr{Addr: serverAddr, Port: 80})
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED))
+
+	listener, err := network.Listen(addrs.Socksaddr{Addr: netip.IPv4Unspecified(), Port: 80})
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := host.DialContext(context.Background(), meta.NetworkTCP, addrs.Socksaddr{Addr: serverAddr, Port: 80})
+	require.NoError(t, err)
+	conn.Close()
+
+	network.SetLink(netip.Addr{}, serverAddr, vnet.Link{Refuse: true})
+	_, err = host.DialContext(context.Background(), meta.NetworkTCP, addrs.Socksaddr{Addr: serverAddr, Port: 80})
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED))
+}
+
+func TestDialParallel(t *testing.T) {
+	network := vnet.New(1)
+	network.SetLink(clientAddr, serverAddr, vnet.Link{Latency: time.Second})
+	network.SetLink(clientAddr6, serverAddr6, vnet.Link{Latency: time.Millisecond})
+	for _, address := range []netip.Addr{serverAddr, serverAddr6} {
+		listener, err := network.Listen(addrs.Socksaddr{Addr: address, Port: 443})
+		require.NoError(t, err)
+		defer listener.Close()
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialParallel(context.Background(), network.Host(clientAddr, clientAddr6), meta.NetworkTCP,
+		[]netip.Addr{serverAddr, serverAddr6}, 443, dialer.HappyEyeballConf{FallbackDelay: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer conn.Close()
+	// the ipv4 primary is too slow, the ipv6 fallback wins the race.
+	assert.Equal(t, serverAddr6, addrs.AddrPortFromNetAddr(conn.RemoteAddr()).Addr())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func receive(t *testing.T, conn net.PacketConn, wait time.Duration) []byte {
+	var received []byte
+	buffer := make([]byte, 16)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(wait)))
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return received
+		}
+		received = append(received, buffer[:n]...)
+	}
+}
+
+func lossyTransfer(t *testing.T, seed uint64, link vnet.Link) []byte {
+	network := vnet.New(seed)
+	network.SetDefaultLink(link)
+	server, err := network.ListenPacket(addrs.Socksaddr{Addr: serverAddr, Port: 53})
+	require.NoError(t, err)
+	defer server.Close()
+	client, err := network.Host(clientAddr).ListenPacket(context.Background(), addrs.Socksaddr{Addr: serverAddr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	for i := range 100 {
+		_, err = client.WriteTo([]byte{byte(i)}, server.LocalAddr())
+		require.NoError(t, err)
+	}
+	return receive(t, server, 50*time.Millisecond)
+}
+
+func TestPacketLoss(t *testing.T) {
+	link := vnet.Link{Loss: 0.3}
+	received := lossyTransfer(t, 42, link)
+	assert.InDelta(t, 70, len(received), 15)
+	assert.Equal(t, received, lossyTransfer(t, 42, link), "same seed, same loss")
+	assert.NotEqual(t, received, lossyTransfer(t, 43, link))
+}
+
+func TestPacketReorder(t *testing.T) {
+	received := lossyTransfer(t, 42, vnet.Link{Reorder: 0.2, ReorderDelay: 10 * time.Millisecond})
+	require.Len(t, received, 100)
+	var reordered int
+	for i := 1; i < len(received); i++ {
+		if received[i] < received[i-1] {
+			reordered++
+		}
+	}
+	assert.NotZero(t, reordered)
+}
+
+func TestBandwidth(t *testing.T) {
+	network := vnet.New(1)
+	network.SetLink(clientAddr, serverAddr, vnet.Link{Bandwidth: 1 << 20})
+	listener, err := network.Listen(addrs.Socksaddr{Addr: serverAddr, Port: 80})
+	require.NoError(t, err)
+	defer listener.Close()
+	echo(t, listener)
+	conn, err := network.Host(clientAddr).DialContext(context.Background(), meta.NetworkTCP, addrs.Socksaddr{Addr: serverAddr, Port: 80})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	for range 10 {
+		_, err = conn.Write(make([]byte, 10<<10))
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestUDPTransport(t *testing.T) {
+	network := vnet.New(1)
+	network.SetDefaultLink(vnet.Link{Latency: 5 * time.Millisecond})
+	server, err := network.ListenPacket(addrs.Socksaddr{Addr: serverAddr, Port: 53})
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		buffer := make([]byte, 1232)
+		for {
+			n, from, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var request dns.Msg
+			if request.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			response := new(dns.Msg).SetReply(&request)
+			response.Answer = append(response.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(1, 2, 3, 4),
+			})
+			raw, _ := response.Pack()
+			_, _ = server.WriteTo(raw, from)
+		}
+	}()
+
+	udp := transport.NewUDP(addrs.Socksaddr{Addr: serverAddr}, transport.UDPTransportOptions{Dialer: network.Host(clientAddr)})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := udp.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	assert.Equal(t, "1.2.3.4", response.Answer[0].(*dns.A).A.String())
+}
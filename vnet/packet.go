@@ -0,0 +1,141 @@
+package vnet
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qtraffics/qnetwork/addrs"
+	"github.com/qtraffics/qnetwork/netio/pipe"
+)
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// PacketConn is an unreliable datagram conn, datagrams to an address without a packet conn are dropped.
+type PacketConn struct {
+	network *VirtualNetwork
+	addr    netip.AddrPort
+	in      *queue
+
+	writeAccess sync.Mutex
+	departed    map[netip.Addr]time.Time
+
+	closeOnce     sync.Once
+	done          chan struct{}
+	readDeadline  pipe.Deadline
+	writeDeadline pipe.Deadline
+}
+
+func newPacketConn(network *VirtualNetwork, addr netip.AddrPort) *PacketConn {
+	return &PacketConn{
+		network:       network,
+		addr:          addr,
+		in:            newQueue(),
+		departed:      make(map[netip.Addr]time.Time),
+		done:          make(chan struct{}),
+		readDeadline:  pipe.MakeDeadline(),
+		writeDeadline: pipe.MakeDeadline(),
+	}
+}
+
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, from, err := c.in.read(p, false, c.done, c.readDeadline.Wait())
+	if err != nil {
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Source: c.LocalAddr(), Err: err}
+	}
+	return n, net.UDPAddrFromAddrPort(from), nil
+}
+
+// WriteTo sends p to addr over the link between the two hosts.
+// Lost datagrams and datagrams to nowhere are reported as sent, like a real udp socket.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	destination := addrs.AddrPortFromNetAddr(addr)
+	destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+	if !destination.IsValid() {
+		return 0, c.writeError(addr, addrs.ErrNotDialable)
+	}
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if isClosed(c.done) {
+		return 0, c.writeError(addr, net.ErrClosed)
+	}
+	if isClosed(c.writeDeadline.Wait()) {
+		return 0, c.writeError(addr, os.ErrDeadlineExceeded)
+	}
+	link := c.network.link(c.addr.Addr(), destination.Addr())
+	departed := link.transmit(time.Now(), c.departed[destination.Addr()], len(p))
+	c.departed[destination.Addr()] = departed
+	if !sleep(time.Until(departed), c.done) {
+		return 0, c.writeError(addr, net.ErrClosed)
+	}
+	if c.network.chance(link.Loss) {
+		return len(p), nil
+	}
+	at := departed.Add(link.Latency)
+	if c.network.chance(link.Reorder) {
+		at = at.Add(link.reorderDelay())
+	}
+	if peer := c.network.packetConn(destination); peer != nil {
+		peer.in.push(segment{data: append([]byte(nil), p...), from: c.addr, at: at})
+	}
+	return len(p), nil
+}
+
+func (c *PacketConn) writeError(addr net.Addr, err error) error {
+	return &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: err}
+}
+
+func (c *PacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.network.removePacketConn(c)
+		close(c.done)
+		c.in.shutdown()
+	})
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr { return net.UDPAddrFromAddrPort(c.addr) }
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+var _ net.Conn = (*udpConn)(nil)
+
+// udpConn is a packet conn connected to remote, datagrams from other addresses are ignored.
+type udpConn struct {
+	*PacketConn
+	remote netip.AddrPort
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(p)
+		if err != nil {
+			return 0, err
+		}
+		if addrs.AddrPortFromNetAddr(from) == c.remote {
+			return n, nil
+		}
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.RemoteAddr())
+}
+
+func (c *udpConn) RemoteAddr() net.Addr { return net.UDPAddrFromAddrPort(c.remote) }
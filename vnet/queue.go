@@ -0,0 +1,127 @@
+package vnet
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+type segment struct {
+	data []byte
+	from netip.AddrPort
+	at   time.Time
+	eof  bool
+}
+
+// queue holds segments in flight to a conn, ordered by their arrival time.
+type queue struct {
+	access   sync.Mutex
+	segments []segment
+	notify   chan struct{}
+	eof      bool
+	broken   bool
+}
+
+func newQueue() *queue {
+	return &queue{notify: make(chan struct{}, 1)}
+}
+
+// push queues s, it reports false when the reading side is gone or the writing side has finished.
+func (q *queue) push(s segment) bool {
+	q.access.Lock()
+	if q.broken || q.eof {
+		q.access.Unlock()
+		return false
+	}
+	q.eof = s.eof
+	i := len(q.segments)
+	for i > 0 && q.segments[i-1].at.After(s.at) {
+		i--
+	}
+	q.segments = append(q.segments, segment{})
+	copy(q.segments[i+1:], q.segments[i:])
+	q.segments[i] = s
+	q.access.Unlock()
+	q.signal()
+	return true
+}
+
+// shutdown drops the queued segments and refuses new ones.
+func (q *queue) shutdown() {
+	q.access.Lock()
+	q.broken = true
+	q.segments = nil
+	q.access.Unlock()
+	q.signal()
+}
+
+func (q *queue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// read waits for the first arrived segment and copies it to p. A stream read consumes
+// a segment partially, a datagram read discards what does not fit in p.
+func (q *queue) read(p []byte, stream bool, done <-chan struct{}, deadline <-chan struct{}) (int, netip.AddrPort, error) {
+	for {
+		select {
+		case <-done:
+			return 0, netip.AddrPort{}, net.ErrClosed
+		case <-deadline:
+			return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+		default:
+		}
+		q.access.Lock()
+		var wait time.Duration = -1
+		if len(q.segments) > 0 {
+			head := &q.segments[0]
+			wait = time.Until(head.at)
+			if wait <= 0 {
+				if head.eof {
+					q.access.Unlock()
+					q.signal()
+					return 0, netip.AddrPort{}, io.EOF
+				}
+				n := copy(p, head.data)
+				from := head.from
+				if stream && n < len(head.data) {
+					head.data = head.data[n:]
+				} else {
+					q.segments[0] = segment{}
+					q.segments = q.segments[1:]
+				}
+				more := len(q.segments) > 0
+				q.access.Unlock()
+				if more {
+					// wake up the other readers
+					q.signal()
+				}
+				return n, from, nil
+			}
+		}
+		q.access.Unlock()
+
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-q.notify:
+		case <-timeout:
+		case <-done:
+		case <-deadline:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}